@@ -5,10 +5,14 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/xmapst/lightsocks/internal/api"
+	"github.com/xmapst/lightsocks/internal/cipher"
 	"github.com/xmapst/lightsocks/internal/conf"
 	"github.com/xmapst/lightsocks/internal/dns"
+	"github.com/xmapst/lightsocks/internal/forward"
 	"github.com/xmapst/lightsocks/internal/mixed"
+	"github.com/xmapst/lightsocks/internal/redir"
 	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/reverse"
 	"github.com/xmapst/lightsocks/internal/server"
 	"github.com/xmapst/lightsocks/internal/tunnel"
 	"os"
@@ -23,6 +27,8 @@ import (
 var (
 	s *server.Listener
 	c *mixed.Listener
+	r *redir.Listener
+	f []*forward.Listener
 )
 
 var (
@@ -36,9 +42,11 @@ var (
 			if err != nil {
 				logrus.Fatalln(err)
 			}
-			tunnel.Start(conf.App.Local.Token)
+			tunnel.Start()
 			api.Server(conf.App.Api)
 			conf.App.LoadTLS()
+			startRedir()
+			startForwards()
 			// start socks server
 			c = mixed.New()
 			err = c.ListenAndServe()
@@ -55,7 +63,7 @@ var (
 			if err != nil {
 				logrus.Fatalln(err)
 			}
-			tunnel.Start(conf.App.Local.Token)
+			tunnel.Start()
 			api.Server(conf.App.Api)
 			conf.App.Mode = conf.ServerMode
 			conf.App.LoadTLS()
@@ -77,7 +85,14 @@ var (
 			if err != nil {
 				logrus.Fatalln(err)
 			}
-			tunnel.Start(conf.App.Server.Token)
+			err = cipher.Verify(conf.App.Server.Method)
+			if err != nil {
+				logrus.Fatalln(err)
+			}
+			_, err = conf.App.CodecOptions()
+			if err != nil {
+				logrus.Fatalln(err)
+			}
 			api.Server(conf.App.Api)
 			conf.App.Mode = conf.ClientMode
 			if conf.App.Server.Port == 0 || conf.App.Server.Host == "" {
@@ -85,6 +100,10 @@ var (
 				conf.App.TLS.Enable = false
 			}
 			conf.App.LoadTLS()
+			tunnel.Start()
+			reverse.Start()
+			startRedir()
+			startForwards()
 			// start socks server
 			c = mixed.New()
 			err = c.ListenAndServe()
@@ -151,6 +170,30 @@ func main() {
 	cobra.CheckErr(cmd.Execute())
 }
 
+// startRedir 配置了端口时启动透明代理
+func startRedir() {
+	if conf.App.Redir.Port == 0 {
+		return
+	}
+	r = redir.New()
+	err := r.ListenAndServe()
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+}
+
+// startForwards 启动配置的静态端口转发
+func startForwards() {
+	for _, v := range conf.App.Forwards {
+		l := forward.New(v)
+		err := l.ListenAndServe()
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+		f = append(f, l)
+	}
+}
+
 func registerSignalHandlers() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGQUIT)
@@ -161,6 +204,12 @@ func registerSignalHandlers() {
 		if s != nil {
 			_ = s.ShutdownWithTimeout(time.Second * 15)
 		}
+		if r != nil {
+			_ = r.ShutdownWithTimeout(time.Second * 15)
+		}
+		for _, l := range f {
+			_ = l.ShutdownWithTimeout(time.Second * 15)
+		}
 		if c != nil {
 			_ = c.ShutdownWithTimeout(time.Second * 15)
 		}
@@ -0,0 +1,217 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrDenied      = errors.New("egress denied")
+	ErrInvalidRule = errors.New("invalid egress rule")
+)
+
+// privateCIDR 回环、链路本地、内网及保留地址
+var privateCIDR = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Rule 一组目标匹配条件
+type Rule struct {
+	CIDR    []string // 地址或网段
+	Ports   []string // 端口或端口范围, 如 443, 8000-9000
+	Domains []string // 域名, *.example.com 匹配所有子域名, *example.com 匹配该域名及其子域名, 其他精确匹配
+}
+
+// Policy 服务端出口策略, 先检查拒绝规则, 再检查允许规则
+// 允许规则的某一类条件非空时, 目标必须满足该类条件
+type Policy struct {
+	deny  matcher
+	allow matcher
+}
+
+type matcher struct {
+	nets    []*net.IPNet
+	ports   []portRange
+	domains []string
+}
+
+type portRange struct {
+	min, max int64
+}
+
+// New 创建出口策略, blockPrivate为true时拒绝回环、链路本地及内网地址
+func New(blockPrivate bool, allow, deny Rule) (*Policy, error) {
+	if blockPrivate {
+		deny.CIDR = append(append([]string(nil), deny.CIDR...), privateCIDR...)
+	}
+	p := &Policy{}
+	var err error
+	p.deny, err = newMatcher(deny)
+	if err != nil {
+		return nil, err
+	}
+	p.allow, err = newMatcher(allow)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CheckHost 解析前检查客户端请求的地址及端口, host可能是域名或ip
+func (p *Policy) CheckHost(host string, port int64) error {
+	if p == nil {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if p.deny.matchPort(port) {
+		return fmt.Errorf("%w: port %d", ErrDenied, port)
+	}
+	if d := p.deny.matchDomain(host); d != "" {
+		return fmt.Errorf("%w: %s matches %s", ErrDenied, host, d)
+	}
+	if len(p.allow.ports) > 0 && !p.allow.matchPort(port) {
+		return fmt.Errorf("%w: port %d not allowed", ErrDenied, port)
+	}
+	if len(p.allow.domains) > 0 && p.allow.matchDomain(host) == "" {
+		return fmt.Errorf("%w: %s not in allowed domains", ErrDenied, host)
+	}
+	return nil
+}
+
+// CheckIP 检查解析后实际连接的ip, 避免通过DNS重绑定绕过
+func (p *Policy) CheckIP(ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	if n := p.deny.matchIP(ip); n != nil {
+		return fmt.Errorf("%w: %s in %s", ErrDenied, ip, n)
+	}
+	if len(p.allow.nets) > 0 && p.allow.matchIP(ip) == nil {
+		return fmt.Errorf("%w: %s not in allowed cidr", ErrDenied, ip)
+	}
+	return nil
+}
+
+func newMatcher(r Rule) (m matcher, err error) {
+	for _, v := range r.CIDR {
+		var n *net.IPNet
+		n, err = ParseCIDR(v)
+		if err != nil {
+			return m, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		m.nets = append(m.nets, n)
+	}
+	for _, v := range r.Ports {
+		var pr portRange
+		pr.min, pr.max, err = ParsePorts(v)
+		if err != nil {
+			return m, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+		}
+		m.ports = append(m.ports, pr)
+	}
+	for _, v := range r.Domains {
+		v = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(v), "."))
+		if v == "" || v == "*" {
+			return m, fmt.Errorf("%w: domain %q", ErrInvalidRule, v)
+		}
+		m.domains = append(m.domains, v)
+	}
+	return
+}
+
+// ParseCIDR 解析网段, 单个ip视为只含该ip的网段, ipv4地址使用4字节表示
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// ParsePorts 解析端口或端口范围, 如 443, 8000-9000
+func ParsePorts(s string) (min, max int64, err error) {
+	s = strings.TrimSpace(s)
+	lo, hi, found := strings.Cut(s, "-")
+	min, err = strconv.ParseInt(strings.TrimSpace(lo), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("port %q: %v", s, err)
+	}
+	max = min
+	if found {
+		max, err = strconv.ParseInt(strings.TrimSpace(hi), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("port %q: %v", s, err)
+		}
+	}
+	if min < 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("port %q out of range", s)
+	}
+	return min, max, nil
+}
+
+func (m *matcher) matchIP(ip net.IP) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range m.nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (m *matcher) matchPort(port int64) bool {
+	for _, r := range m.ports {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *matcher) matchDomain(host string) string {
+	for _, d := range m.domains {
+		if suffix, ok := strings.CutPrefix(d, "*"); ok {
+			// 只在标签边界匹配, *example.com 匹配该域名及其子域名, 不匹配 badexample.com
+			if !strings.HasPrefix(suffix, ".") {
+				if host == suffix {
+					return d
+				}
+				suffix = "." + suffix
+			}
+			if strings.HasSuffix(host, suffix) {
+				return d
+			}
+		} else if host == d {
+			return d
+		}
+	}
+	return ""
+}
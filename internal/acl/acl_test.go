@@ -0,0 +1,263 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"net"
+	"testing"
+)
+
+func mustPolicy(t *testing.T, blockPrivate bool, allow, deny Rule) *Policy {
+	p, err := New(blockPrivate, allow, deny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheckIPPrivate(t *testing.T) {
+	p := mustPolicy(t, true, Rule{}, Rule{})
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.255.255.254", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"::1", true},
+		{"::", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"ff02::1", true},
+		{"2001:4860:4860::8888", false},
+		// ipv4映射的ipv6地址按ipv4检查
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:192.168.0.1", true},
+		{"::ffff:8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			err := p.CheckIP(net.ParseIP(tt.ip))
+			if tt.blocked != errors.Is(err, ErrDenied) {
+				t.Fatalf("got %v, want blocked %v", err, tt.blocked)
+			}
+		})
+	}
+
+	open := mustPolicy(t, false, Rule{}, Rule{})
+	if err := open.CheckIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatalf("private allowed: %v", err)
+	}
+}
+
+func TestCheckIPRules(t *testing.T) {
+	p := mustPolicy(t, false, Rule{
+		CIDR: []string{"203.0.113.0/24", "2001:db8::/32"},
+	}, Rule{
+		CIDR: []string{"203.0.113.7", "::ffff:198.51.100.0/120"},
+	})
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"203.0.113.1", false},
+		{"::ffff:203.0.113.1", false},
+		{"2001:db8::1", false},
+		{"203.0.113.7", true},
+		{"198.51.100.1", true},
+		{"198.51.101.1", true},
+		{"8.8.8.8", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			err := p.CheckIP(net.ParseIP(tt.ip))
+			if tt.blocked != errors.Is(err, ErrDenied) {
+				t.Fatalf("got %v, want blocked %v", err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	p := mustPolicy(t, true, Rule{
+		Ports:   []string{"80", "443", "8000-9000"},
+		Domains: []string{"*.example.com", "example.org"},
+	}, Rule{
+		Ports:   []string{"8080"},
+		Domains: []string{"bad.example.com"},
+	})
+	tests := []struct {
+		host    string
+		port    int64
+		blocked bool
+	}{
+		{"www.example.com", 443, false},
+		{"WWW.Example.COM.", 80, false},
+		{"a.b.example.com", 8500, false},
+		{"example.org", 443, false},
+		{"www.example.org", 443, true},
+		{"example.com", 443, true},
+		{"notexample.com", 443, true},
+		{"bad.example.com", 443, true},
+		{"www.example.com", 22, true},
+		{"www.example.com", 8080, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := p.CheckHost(tt.host, tt.port)
+			if tt.blocked != errors.Is(err, ErrDenied) {
+				t.Fatalf("%s:%d: got %v, want blocked %v", tt.host, tt.port, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckHostWildcard(t *testing.T) {
+	p := mustPolicy(t, false, Rule{}, Rule{
+		Domains: []string{"*evil.com", "*.sub.example.com"},
+	})
+	tests := []struct {
+		host    string
+		blocked bool
+	}{
+		{"evil.com", true},
+		{"www.evil.com", true},
+		{"a.b.evil.com", true},
+		{"notevil.com", false},
+		{"evil.com.cn", false},
+		{"sub.example.com", false},
+		{"www.sub.example.com", true},
+		{"wwwsub.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := p.CheckHost(tt.host, 443)
+			if tt.blocked != errors.Is(err, ErrDenied) {
+				t.Fatalf("%s: got %v, want blocked %v", tt.host, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if err := p.CheckHost("localhost", 22); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CheckIP(net.ParseIP("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	tests := []Rule{
+		{CIDR: []string{"10.0.0.0/33"}},
+		{CIDR: []string{"example.com"}},
+		{Ports: []string{"0-65536"}},
+		{Ports: []string{"9000-8000"}},
+		{Ports: []string{"http"}},
+		{Domains: []string{"*."}},
+		{Domains: []string{" "}},
+	}
+	for _, r := range tests {
+		if _, err := New(false, r, Rule{}); !errors.Is(err, ErrInvalidRule) {
+			t.Fatalf("%+v: got %v, want %v", r, err, ErrInvalidRule)
+		}
+	}
+}
+
+// staticResolver 所有域名都解析为固定的ip
+type staticResolver struct {
+	resolver.Resolver
+	ip net.IP
+}
+
+func (r staticResolver) LookupIP(context.Context, string) ([]net.IP, error) {
+	return []net.IP{r.ip}, nil
+}
+
+func TestDNSRebinding(t *testing.T) {
+	p := mustPolicy(t, true, Rule{}, Rule{})
+	old := resolver.DefaultResolver
+	defer func() {
+		resolver.DefaultResolver = old
+	}()
+	for _, addr := range []string{"127.0.0.1", "10.0.0.1", "::ffff:192.168.1.1", "::1"} {
+		resolver.DefaultResolver = staticResolver{ip: net.ParseIP(addr)}
+		// 域名本身允许访问, 解析后的ip被拒绝
+		if err := p.CheckHost("rebind.example.com", 443); err != nil {
+			t.Fatal(err)
+		}
+		ip, err := resolver.ResolveIP("rebind.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.CheckIP(ip); !errors.Is(err, ErrDenied) {
+			t.Fatalf("%s: got %v, want %v", addr, err, ErrDenied)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{" 192.168.1.1 ", "192.168.1.1/32"},
+		{"::1", "::1/128"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"::ffff:10.0.0.1", "10.0.0.1/32"},
+	}
+	for _, tt := range tests {
+		n, err := ParseCIDR(tt.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.in, err)
+		}
+		if n.String() != tt.want {
+			t.Fatalf("%q: got %s, want %s", tt.in, n, tt.want)
+		}
+	}
+	for _, in := range []string{"", "example.com", "10.0.0.0/33", "10.0.0"} {
+		if _, err := ParseCIDR(in); err == nil {
+			t.Fatalf("%q: no error", in)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max int64
+	}{
+		{"443", 443, 443},
+		{" 8000 - 9000 ", 8000, 9000},
+		{"0-65535", 0, 65535},
+	}
+	for _, tt := range tests {
+		min, max, err := ParsePorts(tt.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.in, err)
+		}
+		if min != tt.min || max != tt.max {
+			t.Fatalf("%q: got %d-%d, want %d-%d", tt.in, min, max, tt.min, tt.max)
+		}
+	}
+	for _, in := range []string{"", "http", "-1", "65536", "9000-8000", "80-"} {
+		if _, _, err := ParsePorts(in); err == nil {
+			t.Fatalf("%q: no error", in)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package api
 var (
 	ErrUnauthorized = newError("Unauthorized")
 	ErrBadRequest   = newError("Body invalid")
+	ErrNotFound     = newError("Resource not found")
 )
 
 // HTTPError is custom HTTP error for API
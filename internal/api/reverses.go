@@ -0,0 +1,31 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/xmapst/lightsocks/internal/server"
+	"net/http"
+)
+
+func reverseRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", getReverses)
+	r.Delete("/{id}", revokeReverse)
+	return r
+}
+
+func getReverses(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, render.M{
+		"reverses": server.Reverses(),
+	})
+}
+
+func revokeReverse(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !server.RevokeReverse(id) {
+		render.Status(r, http.StatusNotFound)
+		render.JSON(w, r, ErrNotFound)
+		return
+	}
+	render.NoContent(w, r)
+}
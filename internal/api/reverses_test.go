@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReverseRouter(t *testing.T) {
+	srv := httptest.NewServer(reverseRouter())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list struct {
+		Reverses []json.RawMessage `json:"reverses"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || list.Reverses == nil || len(list.Reverses) != 0 {
+		t.Fatalf("list: %d %+v", resp.StatusCode, list)
+	}
+
+	// 撤销不存在的反向隧道
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/unknown", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e HTTPError
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound || e.Message != ErrNotFound.Message {
+		t.Fatalf("revoke: %d %+v", resp.StatusCode, e)
+	}
+}
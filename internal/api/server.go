@@ -55,6 +55,7 @@ func Server(conf conf.Server) {
 		r.Get("/traffic", traffic)
 		r.Mount("/connections", connectionRouter())
 		r.Mount("/dns", dnsRouter())
+		r.Mount("/reverses", reverseRouter())
 	})
 
 	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Host, conf.Port))
@@ -0,0 +1,72 @@
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+// aead 每帧使用随机nonce, 密文格式: nonce | ciphertext | tag
+type aead struct {
+	cipher.AEAD
+}
+
+func newAESGCM(key []byte) (Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aead{AEAD: gcm}, nil
+}
+
+func newChaCha20Poly1305(key []byte) (Cipher, error) {
+	c, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aead{AEAD: c}, nil
+}
+
+func (a *aead) Overhead() int {
+	return a.NonceSize() + a.AEAD.Overhead()
+}
+
+func (a *aead) Seal(dst, plaintext, additionalData []byte) []byte {
+	nonceSize := a.NonceSize()
+	ret, out := sliceForAppend(dst, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		panic(err)
+	}
+	return a.AEAD.Seal(ret, out, plaintext, additionalData)
+}
+
+func (a *aead) Open(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	nonceSize := a.NonceSize()
+	if len(ciphertext) < a.Overhead() {
+		return nil, ErrShortCiphertext
+	}
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	out, err := a.AEAD.Open(dst, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return out, nil
+}
+
+// sliceForAppend 扩展in n个字节, 返回扩展后的切片及新增部分
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,116 @@
+package cipher
+
+import (
+	"bytes"
+	"testing"
+)
+
+var methods = []string{AES256GCM, ChaCha20Poly1305}
+
+func newTestCipher(t *testing.T, method string) Cipher {
+	t.Helper()
+	c, err := New(method, bytes.Repeat([]byte{1}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	plain := []byte("lightsocks aead test")
+	ad := []byte("header")
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			sealed := c.Seal(nil, plain, ad)
+			if len(sealed) != len(plain)+c.Overhead() {
+				t.Fatalf("sealed length %d, want %d", len(sealed), len(plain)+c.Overhead())
+			}
+			out, err := c.Open(nil, sealed, ad)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, plain) {
+				t.Fatalf("got %q, want %q", out, plain)
+			}
+			// 每次加密使用随机nonce
+			if bytes.Equal(sealed, c.Seal(nil, plain, ad)) {
+				t.Fatal("nonce reused")
+			}
+		})
+	}
+}
+
+func TestAEADInPlace(t *testing.T) {
+	plain := []byte("in place")
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			nonceSize := c.NonceSize()
+			buf := make([]byte, nonceSize+len(plain), nonceSize+len(plain)+c.Overhead())
+			copy(buf[nonceSize:], plain)
+			sealed := c.Seal(buf[:0], buf[nonceSize:], nil)
+			if &sealed[0] != &buf[0] {
+				t.Fatal("seal reallocated")
+			}
+			out, err := c.Open(sealed[nonceSize:nonceSize], sealed, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, plain) {
+				t.Fatalf("got %q, want %q", out, plain)
+			}
+		})
+	}
+}
+
+func TestAEADTamper(t *testing.T) {
+	plain := []byte("tamper")
+	ad := []byte("header")
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			sealed := c.Seal(nil, plain, ad)
+			for i := range sealed {
+				tampered := append([]byte(nil), sealed...)
+				tampered[i] ^= 0x80
+				if _, err := c.Open(nil, tampered, ad); err != ErrAuthentication {
+					t.Fatalf("byte %d flipped: got %v, want %v", i, err, ErrAuthentication)
+				}
+			}
+			if _, err := c.Open(nil, sealed, []byte("other")); err != ErrAuthentication {
+				t.Fatalf("additional data changed: got %v, want %v", err, ErrAuthentication)
+			}
+			if _, err := c.Open(nil, sealed[:c.Overhead()-1], ad); err != ErrShortCiphertext {
+				t.Fatalf("short ciphertext: got %v, want %v", err, ErrShortCiphertext)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	key := make([]byte, KeySize)
+	tests := []struct {
+		method string
+		err    error
+	}{
+		{"", nil},
+		{AES256GCM, nil},
+		{"AES-256-GCM", nil},
+		{ChaCha20Poly1305, nil},
+		{"rc4", ErrUnsupportedMethod},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.method, key); err != tt.err {
+			t.Errorf("New(%q): got %v, want %v", tt.method, err, tt.err)
+		}
+		if err := Verify(tt.method); err != tt.err {
+			t.Errorf("Verify(%q): got %v, want %v", tt.method, err, tt.err)
+		}
+	}
+	// 不同加密方式的密文不能互相解密
+	sealed := newTestCipher(t, AES256GCM).Seal(nil, []byte("x"), nil)
+	if _, err := newTestCipher(t, ChaCha20Poly1305).Open(nil, sealed, nil); err != ErrAuthentication {
+		t.Fatalf("cross method open: got %v, want %v", err, ErrAuthentication)
+	}
+}
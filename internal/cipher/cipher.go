@@ -0,0 +1,84 @@
+package cipher
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+)
+
+// 支持的加密方式
+const (
+	AES256GCM        = "aes-256-gcm"
+	ChaCha20Poly1305 = "chacha20-poly1305"
+
+	DefaultMethod = AES256GCM
+)
+
+const (
+	// KeySize 会话密钥长度
+	KeySize = 32
+	// SaltSize 每个连接随机盐长度
+	SaltSize = 32
+)
+
+var subkeyInfo = []byte("lightsocks-subkey")
+
+var (
+	ErrUnsupportedMethod = errors.New("unsupported cipher method")
+	ErrAuthentication    = errors.New("cipher: message authentication failed")
+	ErrShortCiphertext   = errors.New("cipher: ciphertext too short")
+)
+
+// Cipher 帧加解密
+type Cipher interface {
+	// NonceSize 密文前附带的nonce长度
+	NonceSize() int
+	// Overhead 密文比明文多出的长度(nonce + tag)
+	Overhead() int
+	// Seal 加密plaintext并追加到dst, additionalData参与认证但不加密
+	// plaintext位于dst之后NonceSize个字节处时原地加密
+	Seal(dst, plaintext, additionalData []byte) []byte
+	// Open 校验并解密ciphertext追加到dst, 认证失败返回 ErrAuthentication
+	// dst为ciphertext[NonceSize():NonceSize()]时原地解密
+	Open(dst, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// New 根据加密方式及密钥创建 Cipher
+func New(method string, key []byte) (Cipher, error) {
+	switch strings.ToLower(method) {
+	case "", AES256GCM:
+		return newAESGCM(key)
+	case ChaCha20Poly1305:
+		return newChaCha20Poly1305(key)
+	default:
+		return nil, ErrUnsupportedMethod
+	}
+}
+
+// Verify 检查加密方式是否支持
+func Verify(method string) error {
+	_, err := New(method, make([]byte, KeySize))
+	return err
+}
+
+// NewSalt 生成连接的随机盐
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Derive 使用HKDF-SHA256从token及salt派生会话密钥, 并创建 Cipher
+func Derive(method string, token, salt []byte) (Cipher, error) {
+	key := make([]byte, KeySize)
+	r := hkdf.New(sha256.New, token, salt, subkeyInfo)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return New(method, key)
+}
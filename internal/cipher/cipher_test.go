@@ -0,0 +1,86 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"testing"
+)
+
+func TestNewSalt(t *testing.T) {
+	a, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != SaltSize || len(b) != SaltSize {
+		t.Fatalf("salt size %d, %d, want %d", len(a), len(b), SaltSize)
+	}
+	if bytes.Equal(a, b) {
+		t.Fatal("salt repeated")
+	}
+}
+
+func TestDerive(t *testing.T) {
+	token := []byte("token")
+	salt := bytes.Repeat([]byte{7}, SaltSize)
+	otherSalt := bytes.Repeat([]byte{8}, SaltSize)
+	plain := []byte("derive")
+	for _, method := range methods {
+		t.Run(method, func(t *testing.T) {
+			derive := func(token, salt []byte) Cipher {
+				c, err := Derive(method, token, salt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+			sealed := derive(token, salt).Seal(nil, plain, nil)
+			// 同一token及salt在两端派生相同的密钥
+			out, err := derive(token, salt).Open(nil, sealed, nil)
+			if err != nil || !bytes.Equal(out, plain) {
+				t.Fatalf("same token and salt: %q, %v", out, err)
+			}
+			if _, err = derive(token, otherSalt).Open(nil, sealed, nil); err != ErrAuthentication {
+				t.Fatalf("other salt: got %v, want %v", err, ErrAuthentication)
+			}
+			if _, err = derive([]byte("other"), salt).Open(nil, sealed, nil); err != ErrAuthentication {
+				t.Fatalf("other token: got %v, want %v", err, ErrAuthentication)
+			}
+			// 派生的密钥不是token本身
+			raw, err := New(method, append(token, make([]byte, KeySize-len(token))...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = raw.Open(nil, sealed, nil); err != ErrAuthentication {
+				t.Fatalf("raw token key: got %v, want %v", err, ErrAuthentication)
+			}
+		})
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	token := []byte("token")
+	salt := bytes.Repeat([]byte{7}, SaltSize)
+	// 会话密钥为 HKDF-SHA256(token, salt, "lightsocks-subkey") 的前 KeySize 个字节
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, token, salt, []byte("lightsocks-subkey")), key); err != nil {
+		t.Fatal(err)
+	}
+	want, err := New(AES256GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Derive(AES256GCM, token, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := want.Open(nil, got.Seal(nil, []byte("x"), nil), nil)
+	if err != nil || string(out) != "x" {
+		t.Fatalf("derived key mismatch: %q, %v", out, err)
+	}
+}
@@ -0,0 +1,114 @@
+package compress
+
+import (
+	"encoding/json"
+	"go.uber.org/atomic"
+	"strings"
+)
+
+// 支持的压缩方式
+const (
+	None   = "none"
+	Snappy = "snappy"
+	Flate  = "flate"
+)
+
+// MaxSize 解压后数据的最大长度
+const MaxSize = 1 << 24
+
+// Compressor 帧压缩, 结果追加到dst后返回
+type Compressor interface {
+	Name() string
+	Compress(dst, src []byte) ([]byte, error)
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var compressors = map[string]Compressor{
+	None:   &none{},
+	Snappy: &snappyCompressor{},
+	Flate:  newFlate(),
+}
+
+// New 根据名称获取压缩方式
+func New(method string) (Compressor, error) {
+	if method == "" {
+		return compressors[None], nil
+	}
+	c, ok := compressors[strings.ToLower(method)]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return c, nil
+}
+
+type none struct{}
+
+func (n *none) Name() string {
+	return None
+}
+
+func (n *none) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (n *none) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// Stats 连接的压缩统计, 上传及下载方向分别统计, 方向以客户端为准
+type Stats struct {
+	Method   string
+	Upload   *Counter
+	Download *Counter
+}
+
+func NewStats(method string) *Stats {
+	return &Stats{
+		Method:   method,
+		Upload:   NewCounter(),
+		Download: NewCounter(),
+	}
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"method":   s.Method,
+		"upload":   s.Upload,
+		"download": s.Download,
+	})
+}
+
+// Counter 一个方向的压缩统计, Raw为压缩前字节数, Compressed为实际传输的字节数
+type Counter struct {
+	Raw        *atomic.Int64
+	Compressed *atomic.Int64
+}
+
+func NewCounter() *Counter {
+	return &Counter{
+		Raw:        atomic.NewInt64(0),
+		Compressed: atomic.NewInt64(0),
+	}
+}
+
+func (c *Counter) Push(raw, compressed int) {
+	c.Raw.Add(int64(raw))
+	c.Compressed.Add(int64(compressed))
+}
+
+// Ratio 压缩后与压缩前的比值
+func (c *Counter) Ratio() float64 {
+	raw := c.Raw.Load()
+	if raw == 0 {
+		return 1
+	}
+	return float64(c.Compressed.Load()) / float64(raw)
+}
+
+func (c *Counter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"raw":        c.Raw.Load(),
+		"compressed": c.Compressed.Load(),
+		"ratio":      c.Ratio(),
+	})
+}
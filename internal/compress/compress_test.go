@@ -0,0 +1,109 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/golang/snappy"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	for _, method := range []string{"", None, Snappy, Flate, "SNAPPY"} {
+		if _, err := New(method); err != nil {
+			t.Errorf("New(%q): %v", method, err)
+		}
+	}
+	if _, err := New("gzip"); err != ErrUnsupported {
+		t.Fatalf("New(gzip): got %v, want %v", err, ErrUnsupported)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	payloads := map[string][]byte{
+		"short":  []byte("a"),
+		"text":   bytes.Repeat([]byte("lightsocks "), 4096),
+		"random": random,
+	}
+	for _, method := range []string{None, Snappy, Flate} {
+		c, err := New(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, payload := range payloads {
+			t.Run(method+"/"+name, func(t *testing.T) {
+				// 结果追加到dst之后
+				prefix := []byte("prefix")
+				compressed, err := c.Compress(append([]byte(nil), prefix...), payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(compressed, prefix) {
+					t.Fatal("dst prefix overwritten")
+				}
+				out, err := c.Decompress(append([]byte(nil), prefix...), compressed[len(prefix):])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(out[len(prefix):], payload) || !bytes.HasPrefix(out, prefix) {
+					t.Fatal("payload mismatch")
+				}
+				if method != None && name == "text" && len(compressed)-len(prefix) >= len(payload)/2 {
+					t.Fatalf("text compressed to %d of %d bytes", len(compressed)-len(prefix), len(payload))
+				}
+			})
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	for _, method := range []string{Snappy, Flate} {
+		c, _ := New(method)
+		if _, err := c.Compress(nil, nil); err != EmptyData {
+			t.Errorf("%s compress: got %v, want %v", method, err, EmptyData)
+		}
+		if _, err := c.Decompress(nil, nil); err != EmptyData {
+			t.Errorf("%s decompress: got %v, want %v", method, err, EmptyData)
+		}
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	bomb := make([]byte, MaxSize+1)
+	for _, method := range []string{Snappy, Flate} {
+		t.Run(method, func(t *testing.T) {
+			c, _ := New(method)
+			var compressed []byte
+			var err error
+			if method == Snappy {
+				compressed = snappy.Encode(nil, bomb)
+			} else {
+				compressed, err = c.Compress(nil, bomb)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err = c.Decompress(nil, compressed); err != ErrTooLarge {
+				t.Fatalf("got %v, want %v", err, ErrTooLarge)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := NewStats(Snappy)
+	if s.Upload.Ratio() != 1 || s.Download.Ratio() != 1 {
+		t.Fatal("empty stats ratio is not 1")
+	}
+	s.Upload.Push(1000, 250)
+	s.Download.Push(1000, 1000)
+	if got := s.Upload.Ratio(); got != 0.25 {
+		t.Fatalf("upload ratio %v, want 0.25", got)
+	}
+	if got := s.Download.Ratio(); got != 1 {
+		t.Fatalf("download ratio %v, want 1", got)
+	}
+}
@@ -2,4 +2,8 @@ package compress
 
 import "errors"
 
-var EmptyData = errors.New("empty data")
+var (
+	EmptyData      = errors.New("empty data")
+	ErrUnsupported = errors.New("unsupported compression method")
+	ErrTooLarge    = errors.New("decompressed data too large")
+)
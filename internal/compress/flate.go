@@ -0,0 +1,100 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// appendBuffer 将写入的数据追加到切片, 用于压缩结果直接写入调用方的缓冲区
+type appendBuffer struct {
+	b []byte
+}
+
+func (a *appendBuffer) Write(p []byte) (int, error) {
+	a.b = append(a.b, p...)
+	return len(p), nil
+}
+
+type flateWriter struct {
+	w   *flate.Writer
+	buf appendBuffer
+}
+
+type flateReader struct {
+	r   io.ReadCloser
+	src bytes.Reader
+}
+
+type flateCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func newFlate() *flateCompressor {
+	f := &flateCompressor{}
+	f.writers.New = func() any {
+		fw := &flateWriter{}
+		fw.w, _ = flate.NewWriter(&fw.buf, flate.BestSpeed)
+		return fw
+	}
+	f.readers.New = func() any {
+		fr := &flateReader{}
+		fr.r = flate.NewReader(&fr.src)
+		return fr
+	}
+	return f
+}
+
+func (f *flateCompressor) Name() string {
+	return Flate
+}
+
+func (f *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, EmptyData
+	}
+	fw := f.writers.Get().(*flateWriter)
+	defer f.writers.Put(fw)
+	fw.buf.b = dst
+	fw.w.Reset(&fw.buf)
+	if _, err := fw.w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := fw.w.Close(); err != nil {
+		return nil, err
+	}
+	out := fw.buf.b
+	fw.buf.b = nil
+	return out, nil
+}
+
+func (f *flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, EmptyData
+	}
+	fr := f.readers.Get().(*flateReader)
+	defer f.readers.Put(fr)
+	fr.src.Reset(src)
+	if err := fr.r.(flate.Resetter).Reset(&fr.src, nil); err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := fr.r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if len(dst)-start > MaxSize {
+			return nil, ErrTooLarge
+		}
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -1,41 +1,52 @@
 package compress
 
 import (
-	"bytes"
 	"github.com/golang/snappy"
-	"io"
 )
 
-func Zip(data []byte) ([]byte, error) {
-	if len(data) == 0 {
+type snappyCompressor struct{}
+
+func (s *snappyCompressor) Name() string {
+	return Snappy
+}
+
+func (s *snappyCompressor) Compress(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
 		return nil, EmptyData
 	}
+	n := snappy.MaxEncodedLen(len(src))
+	head, tail := grow(dst, n)
+	out := snappy.Encode(tail, src)
+	return head[:len(dst)+len(out)], nil
+}
 
-	var buffer bytes.Buffer
-	writer := snappy.NewBufferedWriter(&buffer)
-	_, err := writer.Write(data)
-	if err != nil {
-		_ = writer.Close()
-		return nil, err
+func (s *snappyCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, EmptyData
 	}
-	err = writer.Close()
+	n, err := snappy.DecodedLen(src)
 	if err != nil {
 		return nil, err
 	}
-
-	return buffer.Bytes(), nil
-}
-
-func Unzip(data []byte) ([]byte, error) {
-	if data == nil {
-		return nil, EmptyData
+	if n > MaxSize {
+		return nil, ErrTooLarge
 	}
-
-	reader := snappy.NewReader(bytes.NewReader(data))
-	out, err := io.ReadAll(reader)
+	head, tail := grow(dst, n)
+	out, err := snappy.Decode(tail, src)
 	if err != nil {
 		return nil, err
 	}
+	return head[:len(dst)+len(out)], nil
+}
 
-	return out, err
+// grow 扩展dst n个字节, 返回扩展后的切片及新增部分
+func grow(dst []byte, n int) (head, tail []byte) {
+	if total := len(dst) + n; cap(dst) >= total {
+		head = dst[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, dst)
+	}
+	tail = head[len(dst):]
+	return
 }
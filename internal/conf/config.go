@@ -6,6 +6,11 @@ import (
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/compress"
+	"github.com/xmapst/lightsocks/internal/mux"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/rule"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"os"
 	"time"
@@ -29,14 +34,32 @@ type Config struct {
 	Api    Server `yaml:""` // RESTful API
 	TLS    TLS    `yaml:""` // 证书
 	// 可动态配置
-	Timeout time.Duration `yaml:""` // 连接超时时间
-	CIDR    []string      `yaml:""` // 服务端或客户端使用的ip白名单
-	Users   []User        `yaml:""` // 客户端的sock(s)/http认证
-	Log     Log           `yaml:""` // 日志输出
+	Timeout     time.Duration `yaml:""` // 连接超时时间
+	CIDR        []string      `yaml:""` // 服务端或客户端使用的ip白名单
+	Users       []User        `yaml:""` // 客户端的sock(s)/http认证
+	Credentials []Credential  `yaml:""` // 服务端: 多个客户端凭据, 与Local.Token同时生效
+	Handshake   Handshake     `yaml:""` // 服务端: 客户端握手
+	Log         Log           `yaml:""` // 日志输出
+	Replay      Replay        `yaml:""` // 服务端握手防重放
+	Padding     Padding       `yaml:""` // 隧道帧长度填充
+	Compress    Compress      `yaml:""` // 隧道帧压缩
+	Mux         Mux           `yaml:""` // 隧道多路复用
+	Pool        Pool          `yaml:""` // 客户端到服务端的连接池
+	Egress      Egress        `yaml:""` // 服务端出口策略
+	UDP         UDP           `yaml:""` // UDP转发
+	HTTP        HTTP          `yaml:""` // HTTP代理
+	Redir       Redir         `yaml:""` // 透明代理, 仅支持linux
+	Forwards    []Forward     `yaml:""` // 静态端口转发, 修改后需重启
+	Reverse     Reverse       `yaml:""` // 反向隧道
+	Rules       []string      `yaml:""` // 客户端: 路由规则, 按顺序匹配, 如 DOMAIN-SUFFIX,example.com,DIRECT, IP-CIDR,10.0.0.0/8,DIRECT,no-resolve
+	Upstreams   []Upstream    `yaml:""` // 客户端: 可在路由规则中按名称使用的其他服务端
+	RuleSets    []RuleSet     `yaml:""` // 客户端: 路由规则中 RULE-SET 引用的规则集文件
 
 	// self
 	Mode    int
 	TLSConf *tls.Config
+	ACL     *acl.Policy
+	Router  *rule.Router
 }
 
 type TLS struct {
@@ -46,9 +69,10 @@ type TLS struct {
 }
 
 type Server struct {
-	Host  string `yaml:""`
-	Port  int64  `yaml:""`
-	Token string `yaml:""`
+	Host   string `yaml:""`
+	Port   int64  `yaml:""`
+	Token  string `yaml:""`
+	Method string `yaml:",default=aes-256-gcm"` // 加密方式: aes-256-gcm, chacha20-poly1305
 }
 
 type User struct {
@@ -57,6 +81,108 @@ type User struct {
 	CIDR     []string
 }
 
+// Credential 服务端接受的客户端凭据, 握手时识别连接使用的凭据
+type Credential struct {
+	Name        string `yaml:""` // 身份标识, 记录在连接信息及日志中
+	Token       string `yaml:""`
+	Enable      bool   `yaml:""`
+	Description string `yaml:""`
+}
+
+type Handshake struct {
+	Timeout time.Duration `yaml:",default=90s"` // 等待客户端完成握手的超时, 应大于客户端连接池的MaxIdle, 0为不限制
+}
+
+type Replay struct {
+	Window time.Duration `yaml:",default=2m"`    // 握手时间戳允许的误差
+	Size   int           `yaml:",default=65536"` // 窗口内缓存的nonce上限, 已满时拒绝新的握手, 0为不限制
+}
+
+type Padding struct {
+	Mode    string `yaml:",default=none"` // 填充方式: none, random, bucket
+	Min     int    `yaml:""`              // random: 最小填充字节数
+	Max     int    `yaml:""`              // random: 最大填充字节数
+	Buckets []int  `yaml:""`              // bucket: 帧长度对齐的桶大小
+}
+
+type Compress struct {
+	Method   string `yaml:",default=snappy"` // 压缩方式: none, snappy, flate
+	Adaptive bool   `yaml:",default=true"`   // 遇到不可压缩的数据后暂停压缩, 多路复用时每个流分别判断
+}
+
+type Mux struct {
+	Enable      bool          `yaml:""`                // 客户端: 多个请求复用少量隧道连接
+	Connections int           `yaml:",default=2"`      // 客户端: 保持的隧道连接数
+	MaxStreams  int           `yaml:",default=128"`    // 单个隧道连接的最大并发流数
+	Window      int           `yaml:",default=262144"` // 单个流的接收窗口
+	KeepAlive   time.Duration `yaml:",default=30s"`    // 客户端: 空闲时的心跳间隔, 0为不启用
+}
+
+type Pool struct {
+	Size    int           `yaml:""`             // 预先建立的连接数, 0为不启用
+	MaxIdle time.Duration `yaml:",default=60s"` // 空闲连接的最长保留时间
+	Probe   time.Duration `yaml:",default=15s"` // 空闲连接健康检查间隔
+}
+
+type Egress struct {
+	BlockPrivate bool     `yaml:",default=true"` // 拒绝回环、链路本地及内网地址
+	Allow        acl.Rule `yaml:""`              // 非空的条件目标必须满足
+	Deny         acl.Rule `yaml:""`              // 满足任一条件即拒绝
+}
+
+type UDP struct {
+	Timeout     time.Duration `yaml:",default=60s"` // NAT映射的空闲超时, 超时后关闭映射及隧道连接
+	MaxSessions int           `yaml:",default=64"`  // 客户端: 每个客户端ip的最大NAT映射数, 0为不限制
+}
+
+type HTTP struct {
+	Realm string `yaml:",default=lightsocks"` // 认证失败时Proxy-Authenticate返回的realm
+}
+
+type Redir struct {
+	Host string `yaml:""`
+	Port int64  `yaml:""`                  // 0为不启用
+	Mode string `yaml:",default=redirect"` // redirect: iptables REDIRECT, tproxy: iptables TPROXY
+}
+
+// Forward 监听本地地址, 将连接或数据报转发到固定的目标, 客户端模式下经服务端转发
+type Forward struct {
+	Listen  string `yaml:""`             // 本地监听地址, host:port
+	Target  string `yaml:""`             // 目标地址, host:port
+	Network string `yaml:",default=tcp"` // tcp, udp
+}
+
+type Reverse struct {
+	Enable  bool            `yaml:""` // 服务端: 允许客户端注册反向隧道
+	Ports   []string        `yaml:""` // 服务端: 允许监听的端口或端口范围, 如 9000-9100, 为空不限制
+	Tunnels []ReverseTunnel `yaml:""` // 客户端: 注册的反向隧道, 修改后需重启
+}
+
+// ReverseTunnel 服务端监听Remote, 连入的连接经隧道转发到客户端可访问的Local, 类似 ssh -R
+type ReverseTunnel struct {
+	Remote string `yaml:""` // 服务端监听的地址, host:port, host为空时监听所有地址
+	Local  string `yaml:""` // 客户端可访问的服务地址, host:port
+}
+
+// Upstream 路由规则的动作可以是其名称, 匹配的连接经该服务端转发
+type Upstream struct {
+	Name   string `yaml:""`
+	Host   string `yaml:""`
+	Port   int64  `yaml:""`
+	Token  string `yaml:""`
+	Method string `yaml:",default=aes-256-gcm"`
+	TLS    bool   `yaml:""` // 使用TLS连接
+}
+
+// RuleSet 规则集文件, 条目的解析方式与clash的rule-provider一致, 文件修改后自动重新加载
+type RuleSet struct {
+	Name     string        `yaml:""`
+	Path     string        `yaml:""`
+	Format   string        `yaml:""` // text, yaml, 为空时按扩展名判断
+	Behavior string        `yaml:""` // mixed, domain, ipcidr, classical, 为空时为mixed
+	Interval time.Duration `yaml:""` // 定期重新加载的间隔, 0为只在文件修改时重新加载
+}
+
 type Log struct {
 	Filename   string `yaml:""`
 	Level      string `yaml:",default=info"`
@@ -74,6 +200,12 @@ func viperLoadConf() error {
 	}
 	var conf = &Config{
 		Mode: DirectMode,
+		Local: Server{
+			Method: "aes-256-gcm",
+		},
+		Server: Server{
+			Method: "aes-256-gcm",
+		},
 		TLSConf: &tls.Config{
 			InsecureSkipVerify: true,
 			MinVersion:         tls.VersionTLS13,
@@ -96,16 +228,98 @@ func viperLoadConf() error {
 			MaxAge:     28,
 			Compress:   true,
 		},
+		Handshake: Handshake{
+			Timeout: 90 * time.Second,
+		},
+		Replay: Replay{
+			Window: 2 * time.Minute,
+			Size:   65536,
+		},
+		Compress: Compress{
+			Method:   compress.Snappy,
+			Adaptive: true,
+		},
+		Mux: Mux{
+			Connections: 2,
+			MaxStreams:  mux.DefaultMaxStreams,
+			Window:      mux.DefaultWindow,
+			KeepAlive:   mux.DefaultKeepAlive,
+		},
+		Pool: Pool{
+			MaxIdle: time.Minute,
+			Probe:   15 * time.Second,
+		},
+		Egress: Egress{
+			BlockPrivate: true,
+		},
+		UDP: UDP{
+			Timeout:     time.Minute,
+			MaxSessions: 64,
+		},
+		HTTP: HTTP{
+			Realm: "lightsocks",
+		},
+		Redir: Redir{
+			Mode: "redirect",
+		},
 	}
 	err = viper.Unmarshal(conf)
 	if err != nil {
 		logrus.Errorln(err)
 		return err
 	}
+	conf.ACL, err = acl.New(conf.Egress.BlockPrivate, conf.Egress.Allow, conf.Egress.Deny)
+	if err != nil {
+		logrus.Errorln(err)
+		return err
+	}
+	var upstreams []string
+	for i := range conf.Upstreams {
+		if conf.Upstreams[i].Method == "" {
+			conf.Upstreams[i].Method = "aes-256-gcm"
+		}
+		upstreams = append(upstreams, conf.Upstreams[i].Name)
+	}
+	conf.Router, err = newRouter(conf.Rules, upstreams, conf.RuleSets)
+	if err != nil {
+		logrus.Errorln(err)
+		return err
+	}
+	if App != nil {
+		App.Router.Close()
+		// 重新加载时保留运行模式及证书
+		conf.Mode = App.Mode
+		conf.TLS.Enable = App.TLS.Enable
+		conf.TLSConf = App.TLSConf
+	}
 	App = conf
 	return nil
 }
 
+// newRouter 加载规则集文件并解析路由规则
+func newRouter(rules, upstreams []string, sets []RuleSet) (*rule.Router, error) {
+	var providers []*rule.Provider
+	closeAll := func() {
+		for _, p := range providers {
+			p.Close()
+		}
+	}
+	for _, v := range sets {
+		p, err := rule.NewProvider(v.Name, v.Path, v.Format, v.Behavior, v.Interval)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	router, err := rule.New(rules, upstreams, providers)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return router, nil
+}
+
 func Load() error {
 	viper.SetConfigFile(Path)
 	err := viperLoadConf()
@@ -162,6 +376,63 @@ func (c *Config) LoadTLS() {
 	}
 }
 
+// CodecOptions 根据配置创建隧道帧的填充及压缩策略
+func (c *Config) CodecOptions() (protocol.Options, error) {
+	padding, err := protocol.NewPadding(c.Padding.Mode, c.Padding.Min, c.Padding.Max, c.Padding.Buckets)
+	if err != nil {
+		return protocol.Options{}, err
+	}
+	compressor, err := compress.New(c.Compress.Method)
+	if err != nil {
+		return protocol.Options{}, err
+	}
+	return protocol.Options{
+		Padding:    padding,
+		Compressor: compressor,
+		Adaptive:   c.Compress.Adaptive,
+	}, nil
+}
+
+// DefaultCredential Local.Token对应的凭据名称
+const DefaultCredential = "default"
+
+// EnabledCredentials 服务端启用的客户端凭据
+func (c *Config) EnabledCredentials() []Credential {
+	var creds []Credential
+	if c.Local.Token != "" {
+		creds = append(creds, Credential{
+			Name:   DefaultCredential,
+			Token:  c.Local.Token,
+			Enable: true,
+		})
+	}
+	for _, v := range c.Credentials {
+		if v.Enable && v.Token != "" {
+			creds = append(creds, v)
+		}
+	}
+	return creds
+}
+
+// Upstream 按名称查找路由规则使用的服务端
+func (c *Config) Upstream(name string) (Upstream, bool) {
+	for _, v := range c.Upstreams {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Upstream{}, false
+}
+
+// MuxConfig 多路复用会话配置
+func (c *Config) MuxConfig() mux.Config {
+	return mux.Config{
+		MaxStreams: c.Mux.MaxStreams,
+		Window:     c.Mux.Window,
+		KeepAlive:  c.Mux.KeepAlive,
+	}
+}
+
 func (c *Config) reload() error {
 	level, err := logrus.ParseLevel(c.Log.Level)
 	if err != nil {
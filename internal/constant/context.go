@@ -15,18 +15,20 @@ const (
 	HTTPCONNECT
 	SOCKS4
 	SOCKS5
-)
-
-const (
-	Direct = iota
-	Proxy
+	REDIR   // 透明代理, iptables REDIRECT
+	TPROXY  // 透明代理, iptables TPROXY
+	FORWARD // 静态端口转发
+	REVERSE // 反向隧道
 )
 
 // TCPContext is used to store connection address
 type TCPContext struct {
 	Conn     net.Conn
 	Metadata *Metadata
-	Line     string // http proxy
-	PreFn    func()
+	Bind     bool                     // BIND请求, 监听并等待Metadata.Dest连入
+	BindFn   func(bind net.Addr)      // BIND请求开始监听后应答客户端监听地址
+	DialFn   func() (net.Conn, error) // 非nil时代替连接Metadata.Dest, 反向隧道由此打开到对端的流
+	PreFn    func(bind net.Addr)      // 连接目标成功后应答客户端, bind为连接目标使用的本地地址, BIND请求时为连入的对端地址, 未知时为nil
+	ErrFn    func(err error)          // 连接目标失败时应答客户端
 	PostFn   func()
 }
@@ -32,6 +32,14 @@ func (t Type) String() string {
 		return "Socks4"
 	case SOCKS5:
 		return "Socks5"
+	case REDIR:
+		return "Redir"
+	case TPROXY:
+		return "TProxy"
+	case FORWARD:
+		return "Forward"
+	case REVERSE:
+		return "Reverse"
 	default:
 		return "Unknown"
 	}
@@ -47,6 +55,9 @@ type Metadata struct {
 	Type    Type      `json:"type"`
 	Src     IP        `json:"src"`
 	Dest    IP        `json:"dest"`
+	User    string    `json:"user,omitempty"`  // 服务端: 客户端使用的凭据, 客户端: SOCKS5或HTTP认证的用户
+	Rule    string    `json:"rule,omitempty"`  // 客户端: 匹配的路由规则
+	Chain   string    `json:"chain,omitempty"` // 客户端: 连接的去向, DIRECT, PROXY, REJECT或服务端名称
 }
 
 type IP struct {
@@ -30,7 +30,7 @@ func putMsgToCache(c *cache.LruCache, key string, msg *dns.Msg) {
 	case len(msg.Extra) != 0:
 		ttl = msg.Extra[0].Header().Ttl
 	default:
-		logrus.Debugln("[DNS] response msg empty: %#v", msg)
+		logrus.Debugf("[DNS] response msg empty: %#v", msg)
 		return
 	}
 
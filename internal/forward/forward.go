@@ -0,0 +1,134 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/tunnel"
+	"github.com/xmapst/lightsocks/internal/udp"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Listener 一条静态端口转发, 类似 ssh -L, 连接交给 tunnel 转发到固定的目标
+type Listener struct {
+	conf conf.Forward
+	dest constant.IP
+	tcp  net.Listener
+	udp  *net.UDPConn
+	wg   *sync.WaitGroup
+}
+
+func New(c conf.Forward) *Listener {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+	return &Listener{
+		conf: c,
+		wg:   new(sync.WaitGroup),
+	}
+}
+
+// ListenAndServe 开始监听, 在后台接受连接或数据报
+func (l *Listener) ListenAndServe() error {
+	host, port, err := net.SplitHostPort(l.conf.Target)
+	if err != nil {
+		return fmt.Errorf("forward %s: invalid target: %w", l.conf.Listen, err)
+	}
+	_port, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || _port == 0 {
+		return fmt.Errorf("forward %s: invalid target port %q", l.conf.Listen, port)
+	}
+	l.dest = constant.IP{
+		Addr: host,
+		Port: int64(_port),
+	}
+	switch l.conf.Network {
+	case "tcp":
+		l.tcp, err = net.Listen("tcp", l.conf.Listen)
+		if err != nil {
+			return err
+		}
+		go l.serveTCP(tunnel.TCPIn.In)
+		logrus.Infoln("Forward Listening At:", "tcp://"+l.tcp.Addr().String(), "-->", l.conf.Target)
+	case "udp":
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp", l.conf.Listen)
+		if err != nil {
+			return err
+		}
+		l.udp, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		go udp.NewForwarder(l.udp, l.conf.Target).Serve()
+		logrus.Infoln("Forward Listening At:", "udp://"+l.udp.LocalAddr().String(), "-->", l.conf.Target)
+	default:
+		return fmt.Errorf("forward %s: unknown network %q", l.conf.Listen, l.conf.Network)
+	}
+	return nil
+}
+
+func (l *Listener) serveTCP(tcpIn chan<- *constant.TCPContext) {
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		clientIP := conn.RemoteAddr().String()
+		if !auth.VerifyIP(clientIP) {
+			logrus.Warningln(clientIP, "access denied, not in allowed address group")
+			_ = conn.Close()
+			continue
+		}
+		id, _ := uuid.NewV4()
+		host, port, _ := net.SplitHostPort(clientIP)
+		_port, _ := strconv.ParseInt(port, 10, 64)
+		l.wg.Add(1)
+		tcpIn <- &constant.TCPContext{
+			Conn: conn,
+			Metadata: &constant.Metadata{
+				ID:      id,
+				NetWork: constant.TCP,
+				Type:    constant.FORWARD,
+				Src: constant.IP{
+					Addr: host,
+					Port: _port,
+				},
+				Dest: l.dest,
+			},
+			PostFn: func() {
+				l.wg.Done()
+			},
+		}
+	}
+}
+
+func (l *Listener) ShutdownWithTimeout(timeout time.Duration) error {
+	if l.tcp != nil {
+		_ = l.tcp.Close()
+	}
+	if l.udp != nil {
+		_ = l.udp.Close()
+	}
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		l.wg.Wait()
+	}()
+	select {
+	case <-time.After(timeout):
+		return errors.New("forward shutdown timeout")
+	case <-c:
+		return nil
+	}
+}
@@ -1,4 +1,17 @@
 package http
 
-const ProxyAuthorization = "Proxy-Authorization: Basic "
+const ProxyAuthorization = "Proxy-Authorization"
 const HTTPCONNECT = "CONNECT"
+
+// hopHeaders 逐跳头部, 只对当前连接有效, 转发时删除
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
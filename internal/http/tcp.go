@@ -1,16 +1,19 @@
 package http
 
 import (
-	"bytes"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/lightsocks/internal/auth"
+	"github.com/xmapst/lightsocks/internal/conf"
 	"github.com/xmapst/lightsocks/internal/constant"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/protocol"
 	"io"
 	"net"
+	H "net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,14 +23,16 @@ import (
 type Proxy struct {
 	wg   *sync.WaitGroup
 	id   uuid.UUID
-	conn net.Conn
+	conn *N.BufferedConn
 	auth auth.Authenticator
+	user string
+	idle map[string]*upstream // 可复用的到目标的连接
 }
 
 func (p *Proxy) init(wg *sync.WaitGroup, id uuid.UUID, conn net.Conn) {
 	p.wg = wg
 	p.id = id
-	p.conn = conn
+	p.conn = N.NewBufferedConn(conn)
 	p.auth = new(auth.Auth)
 }
 
@@ -35,44 +40,61 @@ func (p *Proxy) srcAddr() string {
 	return p.conn.RemoteAddr().String()
 }
 
+// Handle 依次处理连接中的请求, CONNECT请求之后连接交给 tunnel 转发,
+// 其他请求按目标分别转发, 客户端保持连接时继续读取下一个请求
 func (p *Proxy) Handle(wg *sync.WaitGroup, id uuid.UUID, conn net.Conn, tcpIn chan<- *constant.TCPContext) error {
 	p.init(wg, id, conn)
-	lines, err := p.readString("\r\n")
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
-	}
-	if len(lines) < 2 {
-		logrus.Errorln(p.id, p.srcAddr(), "request line error")
-		return errors.New("request line error")
-	}
-	err = p.handshake(lines)
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
+	for {
+		req, err := H.ReadRequest(p.conn.Reader())
+		if err != nil {
+			if err == io.EOF {
+				p.finish()
+				return nil
+			}
+			var netErr net.Error
+			if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.As(err, &netErr) {
+				p.httpWriteResponse(H.StatusBadRequest, nil, fmt.Sprintf("malformed request: %s", err))
+			}
+			p.finish()
+			logrus.Errorln(p.id, p.srcAddr(), err)
+			return err
+		}
+		err = p.handshake(req)
+		if err != nil {
+			p.finish()
+			logrus.Errorln(p.id, p.srcAddr(), err)
+			return err
+		}
+		if req.Method == HTTPCONNECT {
+			p.closeIdle()
+			return p.handleHTTPConnectMethod(req, tcpIn)
+		}
+		if !p.handleHTTPProxy(req, tcpIn) {
+			p.finish()
+			return nil
+		}
 	}
-	return p.processRequest(lines, tcpIn)
 }
 
-func (p *Proxy) handshake(lines []string) (err error) {
+// finish 连接不再交给 tunnel 时关闭连接
+func (p *Proxy) finish() {
+	p.closeIdle()
+	_ = p.conn.Close()
+	p.wg.Done()
+}
+
+func (p *Proxy) handshake(req *H.Request) error {
 	var user, pass string
-	for _, line := range lines {
-		// get username/password
-		if strings.HasPrefix(line, ProxyAuthorization) {
-			line = strings.TrimPrefix(line, ProxyAuthorization)
-			bs, err := base64.StdEncoding.DecodeString(line)
+	// get username/password
+	if v := req.Header.Get(ProxyAuthorization); v != "" {
+		scheme, credentials, _ := strings.Cut(v, " ")
+		if strings.EqualFold(scheme, "Basic") {
+			bs, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
 			if err != nil {
 				logrus.Errorln(p.id, p.srcAddr(), err)
-				continue
-			}
-			if bs == nil {
-				continue
+			} else {
+				user, pass, _ = strings.Cut(string(bs), ":")
 			}
-			_auth := bytes.Split(bs, []byte(":"))
-			if len(_auth) < 2 {
-				continue
-			}
-			user, pass = string(_auth[0]), string(bytes.Join(_auth[1:], []byte(":")))
 		}
 	}
 	if user != "" {
@@ -80,69 +102,16 @@ func (p *Proxy) handshake(lines []string) (err error) {
 	}
 	// check username/password
 	if p.auth.Enable() && !p.auth.Verify(user, pass, p.conn.RemoteAddr().String()) {
-		logrus.Errorln(p.id, p.srcAddr(), "authentication failed")
-		_, err = p.conn.Write([]byte{0x00, 0xff})
-		if err != nil {
-			logrus.Errorln(p.id, p.srcAddr(), err)
-		}
+		header := make(H.Header)
+		header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", conf.App.HTTP.Realm))
+		p.httpWriteResponse(H.StatusProxyAuthRequired, header, "proxy authentication required")
 		return errors.New("authentication failed")
 	}
+	p.user = user
 	return nil
 }
 
-func (p *Proxy) processRequest(lines []string, tcpIn chan<- *constant.TCPContext) error {
-	requestLine := strings.Split(lines[0], " ")
-	if len(requestLine) < 3 {
-		logrus.Errorln(p.id, p.srcAddr(), "request line error")
-		return errors.New("request line error")
-	}
-	method := requestLine[0]
-	requestTarget := requestLine[1]
-	version := requestLine[2]
-	var err error
-	if method == HTTPCONNECT {
-		shp := strings.Split(requestTarget, ":")
-		addr := shp[0]
-		port, _ := strconv.Atoi(shp[1])
-		err = p.handleHTTPConnectMethod(addr, uint16(port), tcpIn)
-	} else {
-		si := strings.Index(requestTarget, "//")
-		restUrl := requestTarget[si+2:]
-		if restUrl == "" {
-			_, _ = p.conn.Write([]byte("HTTP/1.0 404 Not Found\r\n\r\n"))
-			logrus.Errorln(p.id, p.srcAddr(), "404 Not Found")
-			return errors.New("HTTP/1.0 404 Not Found")
-		}
-		port := 80
-		ei := strings.Index(restUrl, "/")
-		url := "/"
-		hostPort := restUrl
-		if ei != -1 {
-			hostPort = restUrl[:ei]
-			url = restUrl[ei:]
-		}
-		as := strings.Split(hostPort, ":")
-		addr := as[0]
-		if len(as) == 2 {
-			port, _ = strconv.Atoi(as[1])
-		}
-		var header string
-		for _, line := range lines[1:] {
-			if strings.HasPrefix(line, ProxyAuthorization) {
-				continue
-			}
-			if strings.HasPrefix(line, "Proxy-") {
-				line = strings.TrimPrefix(line, "Proxy-")
-			}
-			header += fmt.Sprintf("%s\r\n", line)
-		}
-		newline := method + " " + url + " " + version + "\r\n" + header
-		err = p.handleHTTPProxy(addr, uint16(port), newline, tcpIn)
-	}
-	return err
-}
-
-func (p *Proxy) httpWriteProxyHeader() {
+func (p *Proxy) httpWriteProxyHeader(net.Addr) {
 	_, err := p.conn.Write([]byte("HTTP/1.1 200 OK Connection Established\r\n"))
 	if err != nil {
 		logrus.Warningln(p.id, p.srcAddr(), err)
@@ -154,45 +123,60 @@ func (p *Proxy) httpWriteProxyHeader() {
 		logrus.Warningln(p.id, p.srcAddr(), err)
 		return
 	}
-	_, err = p.conn.Write([]byte("Transfer-Encoding: chunked\r\n"))
+	_, err = p.conn.Write([]byte("\r\n"))
 	if err != nil {
 		logrus.Warningln(p.id, p.srcAddr(), err)
 		return
 	}
-	_, err = p.conn.Write([]byte("\r\n"))
+}
+
+// httpWriteError 连接目标失败, 目标被拒绝返回403, 超时返回504, 其他返回502
+func (p *Proxy) httpWriteError(err error) {
+	code := H.StatusBadGateway
+	switch protocol.StatusOf(err) {
+	case protocol.StatusNotAllowed:
+		code = H.StatusForbidden
+	case protocol.StatusTTLExpired:
+		code = H.StatusGatewayTimeout
+	}
+	p.httpWriteResponse(code, nil, err.Error())
+}
+
+// httpWriteResponse 返回错误响应, reason作为响应体, 之后关闭连接
+func (p *Proxy) httpWriteResponse(code int, header H.Header, reason string) {
+	if header == nil {
+		header = make(H.Header)
+	}
+	body := reason + "\n"
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp := &H.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	err := resp.Write(p.conn)
 	if err != nil {
 		logrus.Warningln(p.id, p.srcAddr(), err)
-		return
 	}
 }
 
-func (p *Proxy) handleHTTPConnectMethod(addr string, port uint16, tcpIn chan<- *constant.TCPContext) error {
-	target := fmt.Sprintf("%s:%d", addr, port)
-
+func (p *Proxy) handleHTTPConnectMethod(req *H.Request, tcpIn chan<- *constant.TCPContext) error {
+	_, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		p.httpWriteResponse(H.StatusBadRequest, nil, fmt.Sprintf("invalid connect target %q", req.Host))
+		p.finish()
+		logrus.Errorln(p.id, p.srcAddr(), "invalid connect target", req.Host)
+		return err
+	}
 	tcpIn <- &constant.TCPContext{
-		Conn: p.conn,
-		Metadata: &constant.Metadata{
-			ID:      p.id,
-			NetWork: constant.TCP,
-			Type:    constant.HTTPCONNECT,
-			Src: func() constant.IP {
-				host, port, _ := net.SplitHostPort(p.srcAddr())
-				_port, _ := strconv.ParseInt(port, 10, 64)
-				return constant.IP{
-					Addr: host,
-					Port: _port,
-				}
-			}(),
-			Dest: func() constant.IP {
-				host, port, _ := net.SplitHostPort(target)
-				_port, _ := strconv.ParseInt(port, 10, 64)
-				return constant.IP{
-					Addr: host,
-					Port: _port,
-				}
-			}(),
-		},
-		PreFn: p.httpWriteProxyHeader,
+		Conn:     p.conn,
+		Metadata: p.metadata(p.id, constant.HTTPCONNECT, req.Host),
+		PreFn:    p.httpWriteProxyHeader,
+		ErrFn:    p.httpWriteError,
 		PostFn: func() {
 			p.wg.Done()
 		},
@@ -200,47 +184,176 @@ func (p *Proxy) handleHTTPConnectMethod(addr string, port uint16, tcpIn chan<- *
 	return nil
 }
 
-// Subsequent request lines are full paths, some servers may have problems
-func (p *Proxy) handleHTTPProxy(addr string, port uint16, line string, tcpIn chan<- *constant.TCPContext) error {
-	target := fmt.Sprintf("%s:%d", addr, port)
+// handleHTTPProxy 转发一个请求及其响应, 返回客户端连接是否可以继续使用
+func (p *Proxy) handleHTTPProxy(req *H.Request, tcpIn chan<- *constant.TCPContext) bool {
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		p.httpWriteResponse(H.StatusBadRequest, nil, fmt.Sprintf("unsupported request target %q", req.RequestURI))
+		logrus.Errorln(p.id, p.srcAddr(), "unsupported request target", req.RequestURI)
+		return false
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	target := net.JoinHostPort(req.URL.Hostname(), port)
+	keepAlive := !req.Close
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// 避免写入默认的User-Agent
+		req.Header.Set("User-Agent", "")
+	}
+	if req.Header.Get("Expect") == "100-continue" {
+		// 请求体由代理读取, 先应答客户端继续发送
+		req.Header.Del("Expect")
+		_, _ = p.conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	}
+	req.Close = false
+	req.RequestURI = ""
+
+	u, resp, err := p.roundTrip(req, target, tcpIn)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), "-->", target, err)
+		p.httpWriteError(err)
+		return false
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(resp.Body)
 
-	tcpIn <- &constant.TCPContext{
-		Conn: p.conn,
-		Metadata: &constant.Metadata{
-			ID:      p.id,
-			NetWork: constant.TCP,
-			Type:    constant.HTTP,
-			Src: func() constant.IP {
-				host, port, _ := net.SplitHostPort(p.srcAddr())
-				_port, _ := strconv.ParseInt(port, 10, 64)
-				return constant.IP{
-					Addr: host,
-					Port: _port,
-				}
-			}(),
-			Dest: func() constant.IP {
-				host, port, _ := net.SplitHostPort(target)
-				_port, _ := strconv.ParseInt(port, 10, 64)
-				return constant.IP{
-					Addr: host,
-					Port: _port,
-				}
-			}(),
-		},
-		Line: line,
-		PostFn: func() {
-			p.wg.Done()
-		},
+	if resp.StatusCode == H.StatusSwitchingProtocols {
+		err = resp.Write(p.conn)
+		if err == nil {
+			p.relay(u)
+		}
+		_ = u.Close()
+		return false
 	}
-	return nil
+	// 目标要求关闭时连接不再复用, 客户端的连接仍按客户端的要求保持
+	upstreamClose := resp.Close
+	removeHopHeaders(resp.Header)
+	resp.Close = !keepAlive
+	err = resp.Write(p.conn)
+	p.release(u, err == nil && !upstreamClose && keepAlive)
+	if err != nil {
+		logrus.Warningln(p.id, p.srcAddr(), "<--", target, err)
+		return false
+	}
+	return keepAlive
+}
+
+// roundTrip 发送请求并读取响应, 复用的连接可能已被目标关闭, 没有请求体时换新连接重试一次
+func (p *Proxy) roundTrip(req *H.Request, target string, tcpIn chan<- *constant.TCPContext) (*upstream, *H.Response, error) {
+	_, reused := p.idle[target]
+	u, err := p.upstream(target, tcpIn)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := p.exchange(u, req)
+	if err != nil && reused && req.Body == H.NoBody {
+		_ = u.Close()
+		u, err = p.dial(target, tcpIn)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err = p.exchange(u, req)
+	}
+	if err != nil {
+		_ = u.Close()
+		return nil, nil, err
+	}
+	return u, resp, nil
 }
 
-func (p *Proxy) readString(delim string) ([]string, error) {
-	var buf = make([]byte, 4096)
-	_, err := io.ReadAtLeast(p.conn, buf, 1)
-	if err != nil && err != io.EOF {
-		logrus.Errorln(p.id, p.srcAddr(), err)
+func (p *Proxy) exchange(u *upstream, req *H.Request) (*H.Response, error) {
+	err := req.Write(u.conn)
+	if err != nil {
 		return nil, err
 	}
-	return strings.Split(string(buf), delim), nil
+	return p.readResponse(u, req)
+}
+
+// readResponse 读取目标的响应, 1xx的中间响应直接转发给客户端
+func (p *Proxy) readResponse(u *upstream, req *H.Request) (*H.Response, error) {
+	for {
+		resp, err := H.ReadResponse(u.br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == H.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		err = resp.Write(p.conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// relay 协议升级后双向转发客户端与目标
+func (p *Proxy) relay(u *upstream) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(p.conn, u.br)
+		_ = p.conn.SetReadDeadline(time.Now())
+		close(done)
+	}()
+	_, _ = io.Copy(u.conn, p.conn)
+	_ = u.conn.Close()
+	<-done
+}
+
+func (p *Proxy) metadata(id uuid.UUID, typ constant.Type, target string) *constant.Metadata {
+	return &constant.Metadata{
+		ID:      id,
+		User:    p.user,
+		NetWork: constant.TCP,
+		Type:    typ,
+		Src: func() constant.IP {
+			host, port, _ := net.SplitHostPort(p.srcAddr())
+			_port, _ := strconv.ParseInt(port, 10, 64)
+			return constant.IP{
+				Addr: host,
+				Port: _port,
+			}
+		}(),
+		Dest: func() constant.IP {
+			host, port, _ := net.SplitHostPort(target)
+			_port, _ := strconv.ParseInt(port, 10, 64)
+			return constant.IP{
+				Addr: host,
+				Port: _port,
+			}
+		}(),
+	}
+}
+
+// upgradeType 请求或响应要升级的协议
+func upgradeType(h H.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "Upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// removeHopHeaders 删除逐跳头部及Connection中列出的头部
+func removeHopHeaders(h H.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
 }
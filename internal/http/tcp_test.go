@@ -0,0 +1,409 @@
+package http
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/rule"
+	"io"
+	"net"
+	H "net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// request 以用户名密码认证发送请求, 返回交给 tunnel 的连接, 之后放弃连接目标
+func request(t *testing.T, user, pass, req string) *constant.TCPContext {
+	c, s := net.Pipe()
+	defer c.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	tcpIn := make(chan *constant.TCPContext, 1)
+	go func() {
+		_ = new(Proxy).Handle(&wg, uuid.Must(uuid.NewV4()), s, tcpIn)
+	}()
+	// 读取并丢弃代理的响应
+	go func() {
+		_, _ = io.Copy(io.Discard, c)
+	}()
+	credentials := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	_, err := fmt.Fprintf(c, req, credentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-tcpIn
+	ctx.ErrFn(errors.New("test"))
+	return ctx
+}
+
+func TestRouteUser(t *testing.T) {
+	old := conf.App
+	conf.App = &conf.Config{
+		Users: []conf.User{
+			{UserName: "admin", Password: "pw"},
+			{UserName: "bob", Password: "pw"},
+		},
+	}
+	defer func() {
+		conf.App = old
+	}()
+	router, err := rule.New([]string{
+		"USER,admin,REJECT",
+		"INBOUND,HTTPS,DIRECT",
+		"INBOUND,HTTP,PROXY",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		connect = "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n"
+		get     = "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic %s\r\n\r\n"
+	)
+	tests := []struct {
+		name string
+		user string
+		req  string
+		typ  constant.Type
+		want string
+	}{
+		{"connect admin", "admin", connect, constant.HTTPCONNECT, "USER,admin"},
+		{"connect", "bob", connect, constant.HTTPCONNECT, "INBOUND,HTTPS"},
+		{"get admin", "admin", get, constant.HTTP, "USER,admin"},
+		{"get", "bob", get, constant.HTTP, "INBOUND,HTTP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := request(t, tt.user, "pw", tt.req)
+			if ctx.Metadata.User != tt.user || ctx.Metadata.Type != tt.typ {
+				t.Fatalf("metadata: user %q type %s", ctx.Metadata.User, ctx.Metadata.Type)
+			}
+			if r := router.Match(ctx.Metadata); r == nil || r.String() != tt.want {
+				t.Fatalf("rule: got %v, want %s", r, tt.want)
+			}
+		})
+	}
+}
+
+// tunnel 代替 tunnel 直接连接目标并双向转发
+func tunnel() chan<- *constant.TCPContext {
+	tcpIn := make(chan *constant.TCPContext)
+	go func() {
+		for ctx := range tcpIn {
+			go connect(ctx)
+		}
+	}()
+	return tcpIn
+}
+
+func connect(ctx *constant.TCPContext) {
+	defer ctx.PostFn()
+	conn, err := net.Dial("tcp", ctx.Metadata.Dest.String())
+	if err != nil {
+		ctx.ErrFn(err)
+		return
+	}
+	ctx.PreFn(conn.LocalAddr())
+	go func() {
+		_, _ = io.Copy(conn, ctx.Conn)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(ctx.Conn, conn)
+	_ = ctx.Conn.Close()
+}
+
+// origin 目标服务, 返回请求的方法、路径及请求体, 路径为/close时要求关闭连接
+type origin struct {
+	*httptest.Server
+	conns atomic.Int32 // 建立的连接数
+}
+
+func newOrigin(t *testing.T, addr, name string) *origin {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(addr, "unavailable:", err)
+	}
+	o := &origin{}
+	o.Server = &httptest.Server{
+		Listener: l,
+		Config: &H.Server{
+			Handler: H.HandlerFunc(func(w H.ResponseWriter, r *H.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.URL.Path == "/close" {
+					w.Header().Set("Connection", "close")
+				}
+				if r.URL.Path == "/chunked" {
+					// 不设置长度并分段写入, 响应使用chunked编码
+					for _, part := range []string{name, " ", string(body)} {
+						_, _ = io.WriteString(w, part)
+						w.(H.Flusher).Flush()
+					}
+					return
+				}
+				_, _ = fmt.Fprintf(w, "%s %s %s %s", name, r.Method, r.URL.Path, body)
+			}),
+			ConnState: func(_ net.Conn, state H.ConnState) {
+				if state == H.StateNew {
+					o.conns.Add(1)
+				}
+			},
+		},
+	}
+	o.Start()
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *origin) host() string {
+	return o.Listener.Addr().String()
+}
+
+// client 经代理发送请求的客户端连接
+type client struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func newClient(t *testing.T, tcpIn chan<- *constant.TCPContext) *client {
+	old := conf.App
+	conf.App = &conf.Config{}
+	c, s := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	done := make(chan struct{})
+	go func() {
+		_ = new(Proxy).Handle(&wg, uuid.Must(uuid.NewV4()), s, tcpIn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		_ = c.Close()
+		<-done
+		wg.Wait()
+		conf.App = old
+	})
+	return &client{conn: c, br: bufio.NewReader(c)}
+}
+
+// do 发送请求并读取完整的响应
+func (c *client) do(t *testing.T, req string) (*H.Response, string) {
+	t.Helper()
+	_, err := io.WriteString(c.conn, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := H.ReadResponse(c.br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func get(host, path string) string {
+	return fmt.Sprintf("GET http://%s%s HTTP/1.1\r\nHost: %s\r\n\r\n", host, path, host)
+}
+
+func post(host, path, body string) string {
+	return fmt.Sprintf("POST http://%s%s HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", host, path, host, len(body), body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	o := newOrigin(t, "127.0.0.1:0", "a")
+	c := newClient(t, tunnel())
+	for _, path := range []string{"/one", "/two", "/three"} {
+		resp, body := c.do(t, get(o.host(), path))
+		if resp.StatusCode != H.StatusOK || body != "a GET "+path+" " || resp.Close {
+			t.Fatalf("%s: %s %q close %v", path, resp.Status, body, resp.Close)
+		}
+	}
+	if n := o.conns.Load(); n != 1 {
+		t.Fatalf("origin connections: got %d, want 1", n)
+	}
+
+	// 客户端要求关闭时响应后关闭连接
+	req := strings.Replace(get(o.host(), "/last"), "\r\n\r\n", "\r\nConnection: close\r\n\r\n", 1)
+	resp, _ := c.do(t, req)
+	if !resp.Close {
+		t.Fatal("response to Connection: close kept the connection")
+	}
+	if _, err := c.br.ReadByte(); err != io.EOF {
+		t.Fatalf("read after close: got %v, want EOF", err)
+	}
+}
+
+func TestChunked(t *testing.T) {
+	o := newOrigin(t, "127.0.0.1:0", "a")
+	c := newClient(t, tunnel())
+	req := fmt.Sprintf("POST http://%s/chunked HTTP/1.1\r\nHost: %s\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", o.host(), o.host())
+	resp, body := c.do(t, req)
+	if resp.StatusCode != H.StatusOK || body != "a hello world" {
+		t.Fatalf("%s %q", resp.Status, body)
+	}
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("transfer encoding: %v", resp.TransferEncoding)
+	}
+	// 分块的请求及响应结束后连接仍可使用
+	resp, body = c.do(t, post(o.host(), "/next", "data"))
+	if resp.StatusCode != H.StatusOK || body != "a POST /next data" {
+		t.Fatalf("%s %q", resp.Status, body)
+	}
+	if n := o.conns.Load(); n != 1 {
+		t.Fatalf("origin connections: got %d, want 1", n)
+	}
+}
+
+func TestUpstreamClose(t *testing.T) {
+	o := newOrigin(t, "127.0.0.1:0", "a")
+	c := newClient(t, tunnel())
+	resp, _ := c.do(t, get(o.host(), "/close"))
+	if resp.StatusCode != H.StatusOK || resp.Close {
+		t.Fatalf("%s close %v", resp.Status, resp.Close)
+	}
+	// 目标关闭的连接不再复用, 有请求体的请求不会重试
+	resp, body := c.do(t, post(o.host(), "/after", "data"))
+	if resp.StatusCode != H.StatusOK || body != "a POST /after data" {
+		t.Fatalf("%s %q", resp.Status, body)
+	}
+	if n := o.conns.Load(); n != 2 {
+		t.Fatalf("origin connections: got %d, want 2", n)
+	}
+}
+
+func TestHostSwitch(t *testing.T) {
+	a := newOrigin(t, "127.0.0.1:0", "a")
+	b := newOrigin(t, "127.0.0.1:0", "b")
+	c := newClient(t, tunnel())
+	for _, o := range []*origin{a, b, a, b} {
+		name := "a"
+		if o == b {
+			name = "b"
+		}
+		resp, body := c.do(t, get(o.host(), "/"))
+		if resp.StatusCode != H.StatusOK || body != name+" GET / " {
+			t.Fatalf("%s: %s %q", o.host(), resp.Status, body)
+		}
+	}
+	// 每个目标保留一条空闲连接
+	for _, o := range []*origin{a, b} {
+		if n := o.conns.Load(); n != 1 {
+			t.Fatalf("%s connections: got %d, want 1", o.host(), n)
+		}
+	}
+}
+
+func TestIPv6Literal(t *testing.T) {
+	o := newOrigin(t, "[::1]:0", "v6")
+	c := newClient(t, tunnel())
+	for i := 0; i < 2; i++ {
+		resp, body := c.do(t, get(o.host(), "/"))
+		if resp.StatusCode != H.StatusOK || body != "v6 GET / " {
+			t.Fatalf("%s: %s %q", o.host(), resp.Status, body)
+		}
+	}
+	if n := o.conns.Load(); n != 1 {
+		t.Fatalf("origin connections: got %d, want 1", n)
+	}
+}
+
+func TestAuthChallenge(t *testing.T) {
+	o := newOrigin(t, "127.0.0.1:0", "a")
+	basic := func(credentials string) string {
+		return "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"none", "", H.StatusProxyAuthRequired},
+		{"wrong password", basic(base64.StdEncoding.EncodeToString([]byte("admin:bad"))), H.StatusProxyAuthRequired},
+		{"unknown user", basic(base64.StdEncoding.EncodeToString([]byte("root:pw"))), H.StatusProxyAuthRequired},
+		{"malformed", basic("!!!"), H.StatusProxyAuthRequired},
+		{"other scheme", "Proxy-Authorization: Bearer token\r\n", H.StatusProxyAuthRequired},
+		{"ok", basic(base64.StdEncoding.EncodeToString([]byte("admin:pw"))), H.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClient(t, tunnel())
+			conf.App.Users = []conf.User{{UserName: "admin", Password: "pw"}}
+			conf.App.HTTP.Realm = "test"
+			req := strings.Replace(get(o.host(), "/"), "\r\n\r\n", "\r\n"+tt.header+"\r\n", 1)
+			resp, _ := c.do(t, req)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %s, want %d", resp.Status, tt.want)
+			}
+			if tt.want == H.StatusOK {
+				return
+			}
+			// 认证失败时返回质询并关闭连接
+			if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="test"` {
+				t.Fatalf("Proxy-Authenticate: %q", got)
+			}
+			if !resp.Close {
+				t.Fatal("connection kept after 407")
+			}
+			if _, err := c.br.ReadByte(); err != io.EOF {
+				t.Fatalf("read after 407: got %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// failTunnel 连接目标总是以err失败
+func failTunnel(err error) chan<- *constant.TCPContext {
+	tcpIn := make(chan *constant.TCPContext)
+	go func() {
+		for ctx := range tcpIn {
+			ctx.ErrFn(err)
+			ctx.PostFn()
+		}
+	}()
+	return tcpIn
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"denied", fmt.Errorf("%w: port 25", acl.ErrDenied), H.StatusForbidden},
+		{"timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, H.StatusGatewayTimeout},
+		{"refused", errors.New("connection refused"), H.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClient(t, failTunnel(tt.err))
+			resp, body := c.do(t, get("example.com", "/"))
+			if resp.StatusCode != tt.want || !strings.Contains(body, tt.err.Error()) {
+				t.Fatalf("got %s %q, want %d", resp.Status, body, tt.want)
+			}
+		})
+		t.Run(tt.name+" connect", func(t *testing.T) {
+			c := newClient(t, failTunnel(tt.err))
+			resp, _ := c.do(t, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %s, want %d", resp.Status, tt.want)
+			}
+		})
+	}
+
+	// 非代理请求的目标
+	c := newClient(t, tunnel())
+	resp, _ := c.do(t, "GET /relative HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp.StatusCode != H.StatusBadRequest {
+		t.Fatalf("relative target: got %s, want 400", resp.Status)
+	}
+}
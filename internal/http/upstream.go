@@ -0,0 +1,87 @@
+package http
+
+import (
+	"bufio"
+	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"net"
+)
+
+// upstream 一条到目标的连接, 由 tunnel 连接目标并统计流量, 代理通过管道的一端收发
+type upstream struct {
+	target string
+	conn   net.Conn
+	br     *bufio.Reader
+}
+
+func (u *upstream) Close() error {
+	return u.conn.Close()
+}
+
+// dial 将管道的另一端交给 tunnel 连接target, 等待连接结果
+func (p *Proxy) dial(target string, tcpIn chan<- *constant.TCPContext) (*upstream, error) {
+	local, remote := net.Pipe()
+	// tunnel 可能在未调用 PreFn 或 ErrFn 的情况下结束
+	ready := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case ready <- err:
+		default:
+		}
+	}
+	id, _ := uuid.NewV4()
+	p.wg.Add(1)
+	tcpIn <- &constant.TCPContext{
+		Conn:     remote,
+		Metadata: p.metadata(id, constant.HTTP, target),
+		PreFn: func(net.Addr) {
+			done(nil)
+		},
+		ErrFn: done,
+		PostFn: func() {
+			done(net.ErrClosed)
+			p.wg.Done()
+		},
+	}
+	err := <-ready
+	if err != nil {
+		_ = local.Close()
+		return nil, err
+	}
+	return &upstream{
+		target: target,
+		conn:   local,
+		br:     bufio.NewReader(local),
+	}, nil
+}
+
+// upstream 取出到target的空闲连接, 没有时建立新连接
+func (p *Proxy) upstream(target string, tcpIn chan<- *constant.TCPContext) (*upstream, error) {
+	if u, ok := p.idle[target]; ok {
+		delete(p.idle, target)
+		return u, nil
+	}
+	return p.dial(target, tcpIn)
+}
+
+// release 响应结束后保留可复用的连接
+func (p *Proxy) release(u *upstream, reuse bool) {
+	if !reuse {
+		_ = u.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string]*upstream)
+	}
+	if old, ok := p.idle[u.target]; ok {
+		_ = old.Close()
+	}
+	p.idle[u.target] = u
+}
+
+func (p *Proxy) closeIdle() {
+	for k, u := range p.idle {
+		_ = u.Close()
+		delete(p.idle, k)
+	}
+}
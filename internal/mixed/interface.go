@@ -6,6 +6,7 @@ import (
 	"github.com/xmapst/lightsocks/internal/http"
 	"github.com/xmapst/lightsocks/internal/socks4"
 	"github.com/xmapst/lightsocks/internal/socks5"
+	"github.com/xmapst/lightsocks/internal/udp"
 	"net"
 	"sync"
 )
@@ -18,8 +19,8 @@ func newSocks4() Proxy {
 	return &socks4.Proxy{}
 }
 
-func newSocks5(udpAddr string) Proxy {
-	return &socks5.Proxy{Udp: udpAddr}
+func newSocks5(relay *udp.Listener) Proxy {
+	return &socks5.Proxy{Udp: relay}
 }
 
 func newHttp() Proxy {
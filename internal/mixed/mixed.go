@@ -20,10 +20,11 @@ import (
 )
 
 type Listener struct {
-	tcp  net.Listener
-	udp  *net.UDPConn
-	wg   *sync.WaitGroup
-	conf *conf.Config
+	tcp   net.Listener
+	udp   *net.UDPConn
+	relay *udp.Listener
+	wg    *sync.WaitGroup
+	conf  *conf.Config
 }
 
 func (l *Listener) RawAddress() string {
@@ -111,9 +112,10 @@ func (l *Listener) ListenAndServe() (err error) {
 	}
 
 	// udp
+	l.relay = udp.NewListener(l.udp)
 	go func() {
 		logrus.Infoln("UDP Server Listening At:", l.udp.LocalAddr().String())
-		udp.Listen(l.udp)
+		l.relay.Serve()
 	}()
 	// tcp
 	listenAddr := []string{
@@ -155,7 +157,7 @@ func (l *Listener) handle(conn net.Conn, tcpIn chan<- *constant.TCPContext) {
 	case socks4.Version:
 		proxy = newSocks4()
 	case socks5.Version:
-		proxy = newSocks5(l.udp.LocalAddr().String())
+		proxy = newSocks5(l.relay)
 	default:
 		proxy = newHttp()
 	}
@@ -0,0 +1,12 @@
+package mux
+
+import "errors"
+
+var (
+	ErrSessionClosed  = errors.New("mux: session closed")
+	ErrStreamReset    = errors.New("mux: stream reset by peer")
+	ErrTooManyStreams = errors.New("mux: too many streams")
+	ErrInvalidFrame   = errors.New("mux: invalid frame")
+	ErrAddrTooLong    = errors.New("mux: address too long")
+	ErrKeepAlive      = errors.New("mux: keepalive timeout")
+)
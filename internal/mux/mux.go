@@ -0,0 +1,82 @@
+package mux
+
+import (
+	"encoding/binary"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"time"
+)
+
+// 帧命令
+const (
+	// cmdSYN 打开流, data为目标地址
+	cmdSYN byte = iota
+	// cmdData 流数据
+	cmdData
+	// cmdFIN 关闭流, 之后不再收发数据
+	cmdFIN
+	// cmdRST 拒绝或中止流
+	cmdRST
+	// cmdWND 增加对端的发送窗口, data为4字节增量
+	cmdWND
+)
+
+const (
+	cmdLen    = 1
+	idLen     = 4
+	lengthLen = 2
+	headerLen = cmdLen + idLen + lengthLen
+	windowLen = 4
+	// maxDataLen 单个帧携带的最大数据长度, 保证一个帧恰好放入一个隧道帧
+	maxDataLen = protocol.MaxPayload - headerLen
+	// initialWindow 流打开时双方默认的发送窗口
+	initialWindow = 256 << 10
+)
+
+const (
+	DefaultMaxStreams = 128
+	DefaultWindow     = initialWindow
+	DefaultKeepAlive  = 30 * time.Second
+)
+
+var frameEndian = binary.BigEndian
+
+// Frame format:
+//
+// * 0       1           5          7
+// * +-------+-----------+----------+-----------+
+// * |  cmd  | stream id |  length  |   data    |
+// * +-------+-----------+----------+-----------+
+// *
+// * client opens streams with odd ids, server with even ids
+// * keepalive: client sends SYN with id 0, server rejects it with RST
+type header [headerLen]byte
+
+func (h *header) cmd() byte {
+	return h[0]
+}
+
+func (h *header) id() uint32 {
+	return frameEndian.Uint32(h[cmdLen:])
+}
+
+func (h *header) length() int {
+	return int(frameEndian.Uint16(h[cmdLen+idLen:]))
+}
+
+// Config 会话配置, 双方可使用不同的配置
+type Config struct {
+	MaxStreams int // 单个会话的最大并发流数, 超出时拒绝打开新的流
+	Window     int // 单个流的接收窗口, 不小于默认窗口
+	// KeepAlive 客户端空闲时的心跳间隔, 超过两个间隔未收到任何帧时关闭会话, 0为不启用
+	KeepAlive time.Duration
+}
+
+func (c Config) normalize() Config {
+	if c.MaxStreams <= 0 {
+		c.MaxStreams = DefaultMaxStreams
+	}
+	if c.Window < initialWindow {
+		c.Window = initialWindow
+	}
+	return c
+}
@@ -0,0 +1,129 @@
+package mux
+
+import (
+	"net"
+	"sync"
+)
+
+// Pool 客户端保持的多个会话, 打开流时选择流最少的会话
+type Pool struct {
+	mu       sync.Mutex
+	size     int
+	config   Config
+	dial     func() (net.Conn, error)
+	sessions []*Session
+	dialing  int           // 正在建立的会话数
+	dialed   chan struct{} // 会话建立完成或失败时关闭
+	closed   bool
+}
+
+// NewPool 创建会话池, size为最多保持的会话数, dial用于建立完成握手的隧道连接
+func NewPool(size int, config Config, dial func() (net.Conn, error)) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &Pool{
+		size:   size,
+		config: config.normalize(),
+		dial:   dial,
+		dialed: make(chan struct{}),
+	}
+}
+
+// Open 在会话池中打开一个到addr的流, 会话数未达上限时建立新的会话分担负载
+// 建立会话时不持有锁, 已有可用会话时在后台建立, 没有时等待自己或其他调用建立的会话
+func (p *Pool) Open(addr string) (*Stream, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrSessionClosed
+		}
+		best, least := p.pick()
+		if (best == nil || least > 0) && len(p.sessions)+p.dialing < p.size {
+			p.dialing++
+			p.mu.Unlock()
+			if best != nil {
+				go func() {
+					_, _ = p.grow()
+				}()
+				return best.Open(addr)
+			}
+			s, err := p.grow()
+			if err != nil {
+				return nil, err
+			}
+			return s.Open(addr)
+		}
+		if best != nil || p.dialing == 0 {
+			p.mu.Unlock()
+			if best == nil {
+				return nil, ErrTooManyStreams
+			}
+			return best.Open(addr)
+		}
+		// 会话都已满, 等待正在建立的会话
+		wait := p.dialed
+		p.mu.Unlock()
+		<-wait
+	}
+}
+
+// pick 清理已断开的会话, 返回流最少且未满的会话
+func (p *Pool) pick() (*Session, int) {
+	alive := p.sessions[:0]
+	for _, s := range p.sessions {
+		if !s.IsClosed() {
+			alive = append(alive, s)
+		}
+	}
+	for i := len(alive); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = alive
+
+	var best *Session
+	var least int
+	for _, s := range p.sessions {
+		n := s.NumStreams()
+		if n >= p.config.MaxStreams {
+			continue
+		}
+		if best == nil || n < least {
+			best, least = s, n
+		}
+	}
+	return best, least
+}
+
+// grow 建立一个新的会话并加入会话池, 调用前需增加dialing
+func (p *Pool) grow() (*Session, error) {
+	conn, err := p.dial()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	close(p.dialed)
+	p.dialed = make(chan struct{})
+	if err != nil {
+		return nil, err
+	}
+	s := Client(conn, p.config)
+	if p.closed {
+		_ = s.Close()
+		return nil, ErrSessionClosed
+	}
+	p.sessions = append(p.sessions, s)
+	return s, nil
+}
+
+// Close 关闭所有会话, 正在建立的会话完成后关闭
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, s := range p.sessions {
+		_ = s.Close()
+	}
+	p.sessions = nil
+	return nil
+}
@@ -0,0 +1,147 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer 返回客户端一侧的连接, 服务端会话回显接受的流
+func newTestServer(t *testing.T) net.Conn {
+	c, s := net.Pipe()
+	srv := Server(s, Config{})
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	go func() {
+		for {
+			st, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(st, st)
+				_ = st.Close()
+			}()
+		}
+	}()
+	return c
+}
+
+func TestPoolDialOutsideLock(t *testing.T) {
+	block := make(chan struct{})
+	dials := make(chan struct{}, 2)
+	pool := NewPool(2, Config{}, func() (net.Conn, error) {
+		dials <- struct{}{}
+		if len(dials) > 1 {
+			<-block
+		}
+		return newTestServer(t), nil
+	})
+	defer func() {
+		close(block)
+		_ = pool.Close()
+	}()
+	first, err := pool.Open("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// 第二个会话的建立被阻塞, 新的流使用已有的会话
+	done := make(chan error, 1)
+	go func() {
+		st, err := pool.Open("example.com:80")
+		if err == nil {
+			_ = st.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Open blocked behind a slow dial")
+	}
+}
+
+func TestPoolWaitDialing(t *testing.T) {
+	block := make(chan struct{})
+	var dials int
+	pool := NewPool(1, Config{}, func() (net.Conn, error) {
+		dials++
+		<-block
+		return newTestServer(t), nil
+	})
+	defer pool.Close()
+
+	// 会话数已达上限时等待正在建立的会话, 不重复建立
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			st, err := pool.Open("example.com:80")
+			if err == nil {
+				_ = st.Close()
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(block)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dials != 1 {
+		t.Fatalf("dials: got %d, want 1", dials)
+	}
+}
+
+func TestPoolDialError(t *testing.T) {
+	pool := NewPool(1, Config{}, func() (net.Conn, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+	if _, err := pool.Open("example.com:80"); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	_ = pool.Close()
+	if _, err := pool.Open("example.com:80"); err != ErrSessionClosed {
+		t.Fatalf("closed pool: got %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestSessionKeepAlive(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	s := Client(newTestServer(t), Config{KeepAlive: interval})
+	defer s.Close()
+	// 对端应答心跳, 空闲的会话保持打开
+	time.Sleep(10 * interval)
+	if s.IsClosed() {
+		t.Fatalf("idle session closed: %v", s.dieErr)
+	}
+	st, err := s.Open("example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = st.Close()
+}
+
+func TestSessionKeepAliveTimeout(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	// 对端不再读取, 心跳写入阻塞
+	c, dead := net.Pipe()
+	defer dead.Close()
+	s := Client(c, Config{KeepAlive: interval})
+	select {
+	case <-s.die:
+	case <-time.After(20 * interval):
+		t.Fatal("dead session not closed")
+	}
+	if s.dieErr != ErrKeepAlive {
+		t.Fatalf("got %v, want %v", s.dieErr, ErrKeepAlive)
+	}
+}
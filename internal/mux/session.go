@@ -0,0 +1,314 @@
+package mux
+
+import (
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session 在一个隧道连接上承载多个流
+type Session struct {
+	conn    net.Conn
+	config  Config
+	client  bool
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	accepts chan *Stream
+
+	wmu  sync.Mutex
+	wbuf []byte
+
+	lastRecv atomic.Int64 // 最后收到帧的时间
+
+	die     chan struct{}
+	dieOnce sync.Once
+	dieErr  error
+}
+
+// Client 创建客户端会话, 由客户端打开流
+func Client(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, true)
+}
+
+// Server 创建服务端会话, 通过 Accept 获取客户端打开的流
+func Server(conn net.Conn, config Config) *Session {
+	return newSession(conn, config, false)
+}
+
+func newSession(conn net.Conn, config Config, client bool) *Session {
+	config = config.normalize()
+	s := &Session{
+		conn:    conn,
+		config:  config,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accepts: make(chan *Stream, config.MaxStreams),
+		wbuf:    make([]byte, 0, headerLen+maxDataLen),
+		die:     make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	if client {
+		s.nextID = 1
+		if config.KeepAlive > 0 {
+			go s.keepAlive(config.KeepAlive)
+		}
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open 打开一个到addr的流
+func (s *Session) Open(addr string) (*Stream, error) {
+	if len(addr) == 0 || len(addr) > maxDataLen {
+		return nil, ErrAddrTooLong
+	}
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if len(s.streams) >= s.config.MaxStreams {
+		s.mu.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	st := newStream(s, s.nextID, addr)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	err := s.writeFrame(cmdSYN, st.id, []byte(addr))
+	if err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	st.announceWindow()
+	return st, nil
+}
+
+// Accept 等待对端打开的流
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.dieErr
+	}
+}
+
+// NumStreams 当前打开的流数量
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWithErr(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// closeWithErr 关闭会话及所有流
+func (s *Session) closeWithErr(err error) {
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		_ = s.conn.Close()
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, st := range streams {
+			st.kill(ErrSessionClosed)
+		}
+	})
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// adaptiveWriter 按流分别自适应压缩的隧道连接, 见 net.SecureTCPConn
+type adaptiveWriter interface {
+	WriteAdaptive(b []byte, a *protocol.Adaptive) (int, error)
+}
+
+// writeFrame 写入一个帧, 写入失败时关闭会话
+func (s *Session) writeFrame(cmd byte, id uint32, data []byte) error {
+	return s.write(cmd, id, data, nil)
+}
+
+// writeData 写入流的数据帧, 隧道连接支持时按流自适应压缩
+func (s *Session) writeData(st *Stream, data []byte) error {
+	return s.write(cmdData, st.id, data, &st.adaptive)
+}
+
+func (s *Session) write(cmd byte, id uint32, data []byte, a *protocol.Adaptive) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	var h header
+	h[0] = cmd
+	frameEndian.PutUint32(h[cmdLen:], id)
+	frameEndian.PutUint16(h[cmdLen+idLen:], uint16(len(data)))
+	s.wbuf = append(append(s.wbuf[:0], h[:]...), data...)
+	var err error
+	if w, ok := s.conn.(adaptiveWriter); ok && a != nil {
+		_, err = w.WriteAdaptive(s.wbuf, a)
+	} else {
+		_, err = s.conn.Write(s.wbuf)
+	}
+	if err != nil {
+		s.closeWithErr(err)
+	}
+	return err
+}
+
+func (s *Session) writeWindow(id uint32, incr int) error {
+	var data [windowLen]byte
+	frameEndian.PutUint32(data[:], uint32(incr))
+	return s.writeFrame(cmdWND, id, data[:])
+}
+
+// reject 重置流, 在接收循环中异步发送, 避免双方同时阻塞在写入上
+func (s *Session) reject(id uint32) {
+	_ = s.writeFrame(cmdRST, id, nil)
+}
+
+// keepAlive 一个间隔内未收到帧时发送id为0的SYN, 对端总是以RST应答, 因此无需双方协商
+// 发送后的下一个间隔内仍未收到帧则关闭会话, 连接已失效时写入可能阻塞, 因此在单独的协程中发送
+func (s *Session) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := s.lastRecv.Load()
+	var pinged bool
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.die:
+			return
+		}
+		if recv := s.lastRecv.Load(); recv != last {
+			last, pinged = recv, false
+			continue
+		}
+		if pinged {
+			s.closeWithErr(ErrKeepAlive)
+			return
+		}
+		pinged = true
+		go s.writeFrame(cmdSYN, 0, nil)
+	}
+}
+
+func (s *Session) recvLoop() {
+	var h header
+	buf := make([]byte, maxDataLen)
+	for {
+		_, err := io.ReadFull(s.conn, h[:])
+		if err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		n := h.length()
+		if n > maxDataLen {
+			s.closeWithErr(ErrInvalidFrame)
+			return
+		}
+		_, err = io.ReadFull(s.conn, buf[:n])
+		if err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+		id, data := h.id(), buf[:n]
+		switch h.cmd() {
+		case cmdSYN:
+			s.handleSYN(id, string(data))
+		case cmdData:
+			if st := s.stream(id); st != nil && !st.push(data) {
+				// 对端未遵守流量控制
+				s.remove(id)
+				st.kill(ErrInvalidFrame)
+				go s.reject(id)
+			}
+		case cmdFIN:
+			if st := s.stream(id); st != nil {
+				st.finish()
+			}
+		case cmdRST:
+			if st := s.stream(id); st != nil {
+				s.remove(id)
+				st.kill(ErrStreamReset)
+			}
+		case cmdWND:
+			if len(data) != windowLen {
+				s.closeWithErr(ErrInvalidFrame)
+				return
+			}
+			if st := s.stream(id); st != nil {
+				st.grow(int(frameEndian.Uint32(data)))
+			}
+		default:
+			s.closeWithErr(ErrInvalidFrame)
+			return
+		}
+	}
+}
+
+// handleSYN 对端打开流, 超出并发上限或id不合法时拒绝
+func (s *Session) handleSYN(id uint32, addr string) {
+	// 客户端的流id为奇数, 服务端为偶数
+	if s.client || id%2 == 0 || addr == "" {
+		go s.reject(id)
+		return
+	}
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok || len(s.streams) >= s.config.MaxStreams {
+		s.mu.Unlock()
+		go s.reject(id)
+		return
+	}
+	st := newStream(s, id, addr)
+	s.streams[id] = st
+	s.mu.Unlock()
+	go st.announceWindow()
+	select {
+	case s.accepts <- st:
+	default:
+		s.remove(id)
+		st.kill(ErrTooManyStreams)
+		go s.reject(id)
+	}
+}
@@ -0,0 +1,81 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"io"
+	"net"
+	"testing"
+)
+
+// newSecureConn 启用自适应snappy压缩的隧道连接
+func newSecureConn(t *testing.T, conn net.Conn, server bool) *N.SecureTCPConn {
+	c, err := cipher.Derive(cipher.AES256GCM, []byte("mux"), make([]byte, cipher.SaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp, err := compress.New(compress.Snappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := protocol.NewCodec(c)
+	codec.Server = server
+	codec.Negotiate(protocol.SupportedFeatures, protocol.Options{Compressor: comp, Adaptive: true})
+	return N.NewSecureTCPConn(conn, codec)
+}
+
+func TestStreamAdaptiveCompression(t *testing.T) {
+	c, s := net.Pipe()
+	conn := newSecureConn(t, c, false)
+	srv := Server(newSecureConn(t, s, true), Config{})
+	defer srv.Close()
+	go func() {
+		for {
+			st, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, st)
+			}()
+		}
+	}()
+	sess := Client(conn, Config{})
+	defer sess.Close()
+
+	random := make([]byte, 64<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 64<<10/38)
+	incompressible, err := sess.Open("random.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incompressible.Close()
+	compressible, err := sess.Open("text.example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressible.Close()
+
+	// 一个流的数据不可压缩后, 同一会话中其他流仍然压缩
+	stats := conn.Codec().Stats.Upload
+	for i := 0; i < 2; i++ {
+		if _, err = incompressible.Write(random); err != nil {
+			t.Fatal(err)
+		}
+		raw, compressed := stats.Raw.Load(), stats.Compressed.Load()
+		if _, err = compressible.Write(text); err != nil {
+			t.Fatal(err)
+		}
+		raw, compressed = stats.Raw.Load()-raw, stats.Compressed.Load()-compressed
+		if ratio := float64(compressed) / float64(raw); ratio > 0.5 {
+			t.Fatalf("round %d: compressible stream ratio %.2f", i, ratio)
+		}
+	}
+}
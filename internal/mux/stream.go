@@ -0,0 +1,266 @@
+package mux
+
+import (
+	"bytes"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream 会话中的一个流, 实现 net.Conn
+type Stream struct {
+	id   uint32
+	addr string
+	sess *Session
+
+	mu        sync.Mutex
+	rbuf      bytes.Buffer // 已收到未读取的数据
+	consumed  int          // 已读取但未通知对端的字节数
+	rerr      error        // 数据读完后返回的错误
+	window    int          // 发送窗口
+	werr      error
+	closed    bool
+	reset     bool
+	rdeadline time.Time
+	wdeadline time.Time
+
+	rnotify chan struct{}
+	wnotify chan struct{}
+
+	adaptive protocol.Adaptive // 数据帧的自适应压缩状态, 由会话的wmu保护
+}
+
+func newStream(sess *Session, id uint32, addr string) *Stream {
+	return &Stream{
+		id:      id,
+		addr:    addr,
+		sess:    sess,
+		window:  initialWindow,
+		rnotify: make(chan struct{}, 1),
+		wnotify: make(chan struct{}, 1),
+	}
+}
+
+// ID 流id
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Target 打开流时指定的目标地址
+func (st *Stream) Target() string {
+	return st.addr
+}
+
+// Conn 承载流的隧道连接
+func (st *Stream) Conn() net.Conn {
+	return st.sess.conn
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if expired(st.rdeadline) {
+			st.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if st.rbuf.Len() > 0 {
+			n, _ := st.rbuf.Read(b)
+			st.consumed += n
+			var incr int
+			// 读取超过半个窗口后通知对端
+			if st.consumed >= st.sess.config.Window/2 && st.rerr == nil {
+				incr, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if incr > 0 {
+				_ = st.sess.writeWindow(st.id, incr)
+			}
+			return n, nil
+		}
+		if st.rerr != nil {
+			err := st.rerr
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.rdeadline
+		st.mu.Unlock()
+		err := wait(st.rnotify, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.mu.Lock()
+		if st.werr != nil {
+			err = st.werr
+			st.mu.Unlock()
+			return
+		}
+		if expired(st.wdeadline) {
+			st.mu.Unlock()
+			return n, os.ErrDeadlineExceeded
+		}
+		if st.window == 0 {
+			deadline := st.wdeadline
+			st.mu.Unlock()
+			err = wait(st.wnotify, deadline)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		size := len(b)
+		if size > st.window {
+			size = st.window
+		}
+		if size > maxDataLen {
+			size = maxDataLen
+		}
+		st.window -= size
+		st.mu.Unlock()
+		err = st.sess.writeData(st, b[:size])
+		if err != nil {
+			return
+		}
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+// Close 关闭流并通知对端, 之后不再收发数据
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFIN := !st.reset
+	st.setErr(net.ErrClosed)
+	st.mu.Unlock()
+	st.sess.remove(st.id)
+	if !sendFIN {
+		return nil
+	}
+	return st.sess.writeFrame(cmdFIN, st.id, nil)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+	notify(st.rnotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+	notify(st.wnotify)
+	return nil
+}
+
+// announceWindow 接收窗口大于默认窗口时通知对端
+func (st *Stream) announceWindow() {
+	if incr := st.sess.config.Window - initialWindow; incr > 0 {
+		_ = st.sess.writeWindow(st.id, incr)
+	}
+}
+
+// push 收到对端的数据, 超出接收窗口时返回false
+func (st *Stream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return true
+	}
+	if st.rbuf.Len()+len(data) > st.sess.config.Window {
+		return false
+	}
+	st.rbuf.Write(data)
+	notify(st.rnotify)
+	return true
+}
+
+// finish 对端关闭流, 读完剩余数据后返回 io.EOF
+func (st *Stream) finish() {
+	st.mu.Lock()
+	st.setErr(io.EOF)
+	st.mu.Unlock()
+}
+
+// kill 流被对端重置或会话关闭
+func (st *Stream) kill(err error) {
+	st.mu.Lock()
+	st.reset = true
+	st.setErr(err)
+	st.mu.Unlock()
+}
+
+// grow 对端增加发送窗口
+func (st *Stream) grow(incr int) {
+	st.mu.Lock()
+	st.window += incr
+	st.mu.Unlock()
+	notify(st.wnotify)
+}
+
+// setErr 结束读写并唤醒等待的读写, 调用方需持有mu
+func (st *Stream) setErr(err error) {
+	if st.rerr == nil {
+		st.rerr = err
+	}
+	if st.werr == nil {
+		st.werr = err
+	}
+	notify(st.rnotify)
+	notify(st.wnotify)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// wait 等待通知或超时
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
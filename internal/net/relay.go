@@ -1,53 +1,50 @@
 package net
 
 import (
+    "errors"
     "github.com/sirupsen/logrus"
     "github.com/xmapst/lightsocks/internal/constant"
-    "github.com/xmapst/lightsocks/internal/protocol"
     "io"
     "net"
+    "os"
     "sync"
     "time"
 )
 
+// Relay 双向转发, 加解密由 SecureTCPConn 完成
 type Relay struct {
     Src      net.Conn
     Dest     net.Conn
     Metadata *constant.Metadata
-    Token    []byte
 }
 
-func (r *Relay) Start(s int) {
-    switch s {
-    case constant.Proxy:
-        r.forward()
-    default:
-        r.direct()
-    }
-}
-
-func (r *Relay) direct() {
+func (r *Relay) Start() {
     start := time.Now()
-    logrus.Infoln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, "accepted")
+    if r.Metadata.User != "" {
+        logrus.Infoln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, "accepted", "user", r.Metadata.User)
+    } else {
+        logrus.Infoln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, "accepted")
+    }
     defer func(src, dest net.Conn) {
         _ = dest.Close()
         _ = src.Close()
         logrus.Infoln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, "finish", time.Since(start))
     }(r.Src, r.Dest)
+    // 一端结束后通过读超时结束另一端, 超时不视为错误
     wg := new(sync.WaitGroup)
     wg.Add(2)
     go func() {
         defer wg.Done()
-        _, err := io.Copy(r.Src, r.Dest)
-        if err != nil {
+        _, err := copyBuffer(r.Src, r.Dest)
+        if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
             logrus.Warningln(r.Metadata.ID, r.Metadata.Dest, "-->", r.Metadata.Src, err)
         }
         _ = r.Src.SetReadDeadline(time.Now())
     }()
     go func() {
         defer wg.Done()
-        _, err := io.Copy(r.Dest, r.Src)
-        if err != nil {
+        _, err := copyBuffer(r.Dest, r.Src)
+        if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
             logrus.Warningln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, err)
         }
         _ = r.Dest.SetReadDeadline(time.Now())
@@ -55,40 +52,9 @@ func (r *Relay) direct() {
     wg.Wait()
 }
 
-func (r *Relay) forward() {
-    start := time.Now()
-    logrus.Infoln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, "accepted")
-    defer func(src, dest net.Conn) {
-        _ = dest.Close()
-        _ = src.Close()
-        logrus.Infoln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, "finish", time.Since(start))
-    }(r.Src, r.Dest)
-    wg := new(sync.WaitGroup)
-    wg.Add(2)
-    go func() {
-        defer wg.Done()
-        // dest --> encode --> src
-        conn := &SecureTCPConn{
-            ReadWriteCloser: r.Dest,
-        }
-        _ = conn.EncodeCopy(r.Token, r.Src)
-        _ = r.Src.SetReadDeadline(time.Now())
-    }()
-    go func() {
-        defer wg.Done()
-        // src --> decode --> dest
-        for {
-            pack, err := protocol.ReadFull(r.Token, r.Src)
-            if err != nil {
-                break
-            }
-            logrus.Debugln(r.Metadata.ID, r.Metadata.Src, "-->", r.Metadata.Dest, pack.RandNu)
-            _, err = r.Dest.Write(pack.Payload)
-            if err != nil {
-                break
-            }
-        }
-        _ = r.Dest.SetReadDeadline(time.Now())
-    }()
-    wg.Wait()
+// copyBuffer 使用复用的缓冲区转发, 任一端为 SecureTCPConn 时由其直接读写
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+    buf := bufferPoolGet()
+    defer bufferPoolPut(buf)
+    return io.CopyBuffer(dst, src, *buf)
 }
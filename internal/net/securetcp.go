@@ -3,61 +3,173 @@ package net
 import (
 	"github.com/xmapst/lightsocks/internal/protocol"
 	"io"
+	"net"
 	"sync"
 )
 
 const (
-	bufSize = 2 << 15
+	bufSize = protocol.MaxPayload
 )
 
 var bpool sync.Pool
 
 func init() {
 	bpool.New = func() interface{} {
-		return make([]byte, bufSize)
+		b := make([]byte, bufSize)
+		return &b
 	}
 }
-func bufferPoolGet() []byte {
-	return bpool.Get().([]byte)
+func bufferPoolGet() *[]byte {
+	return bpool.Get().(*[]byte)
 }
-func bufferPoolPut(b []byte) {
+func bufferPoolPut(b *[]byte) {
 	bpool.Put(b)
 }
 
-// SecureTCPConn 加密传输的 TCP Socket
+// SecureTCPConn 加密传输的 TCP Socket, 读写的是解密后的明文
+// 读写可分别在不同的goroutine中进行, 稳定传输时不分配内存
 type SecureTCPConn struct {
-	io.ReadWriteCloser
+	net.Conn
+	codec   *protocol.Codec
+	rmu     sync.Mutex
+	rbuf    *protocol.Buffer
+	pending []byte // 上一个帧中未读取的数据
+	wmu     sync.Mutex
 }
 
-// EncodeWrite 把放在bs里的数据加密后立即全部写入输出流
-func (secureSocket *SecureTCPConn) EncodeWrite(token, bs []byte) (int, error) {
-	// 加密
-	data, err := protocol.Encode(token, bs)
-	if err != nil {
+func NewSecureTCPConn(conn net.Conn, codec *protocol.Codec) *SecureTCPConn {
+	return &SecureTCPConn{
+		Conn:  conn,
+		codec: codec,
+	}
+}
+
+func (c *SecureTCPConn) Codec() *protocol.Codec {
+	return c.codec
+}
+
+// readFrame 读取下一个非空帧, 调用方需持有rmu
+func (c *SecureTCPConn) readFrame() error {
+	if c.rbuf == nil {
+		c.rbuf = protocol.GetBuffer()
+	}
+	for len(c.pending) == 0 {
+		packet, err := c.codec.ReadFrame(c.Conn, c.rbuf)
+		if err != nil {
+			return err
+		}
+		c.pending = packet.Payload
+	}
+	return nil
+}
+
+func (c *SecureTCPConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if err := c.readFrame(); err != nil {
 		return 0, err
 	}
-	return secureSocket.Write(data)
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
 }
 
-func (secureSocket *SecureTCPConn) EncodeCopy(token []byte, dst io.ReadWriteCloser) error {
+// WriteTo 将解密后的数据直接写入w, 避免 io.Copy 额外分配缓冲区
+func (c *SecureTCPConn) WriteTo(w io.Writer) (n int64, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		err = c.readFrame()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		var nw int
+		nw, err = w.Write(c.pending)
+		n += int64(nw)
+		c.pending = c.pending[nw:]
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write 将b按 protocol.MaxPayload 拆分为多个帧写入
+func (c *SecureTCPConn) Write(b []byte) (n int, err error) {
+	return c.WriteAdaptive(b, nil)
+}
+
+// WriteAdaptive 与 Write 相同, 自适应压缩使用a中的状态, 多路复用时每个流分别判断是否压缩
+func (c *SecureTCPConn) WriteAdaptive(b []byte, a *protocol.Adaptive) (n int, err error) {
+	frame := protocol.GetFrame()
+	defer protocol.PutFrame(frame)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > protocol.MaxPayload {
+			chunk = chunk[:protocol.MaxPayload]
+		}
+		err = c.writeFrame(frame, chunk, a)
+		if err != nil {
+			return
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return
+}
+
+// ReadFrom 从r读取数据加密后写入, 避免 io.Copy 额外分配缓冲区
+func (c *SecureTCPConn) ReadFrom(r io.Reader) (n int64, err error) {
 	buf := bufferPoolGet()
 	defer bufferPoolPut(buf)
+	frame := protocol.GetFrame()
+	defer protocol.PutFrame(frame)
 	for {
-		readCount, errRead := secureSocket.Read(buf)
-		if errRead != nil {
-			if errRead != io.EOF {
-				return errRead
-			} else {
-				return nil
+		nr, er := r.Read(*buf)
+		if nr > 0 {
+			c.wmu.Lock()
+			err = c.writeFrame(frame, (*buf)[:nr], nil)
+			c.wmu.Unlock()
+			if err != nil {
+				return
 			}
+			n += int64(nr)
 		}
-		if readCount > 0 {
-			_, errWrite := (&SecureTCPConn{
-				ReadWriteCloser: dst,
-			}).EncodeWrite(token, buf[0:readCount])
-			if errWrite != nil {
-				return errWrite
+		if er != nil {
+			if er != io.EOF {
+				err = er
 			}
+			return
 		}
 	}
 }
+
+// writeFrame 使用frame编码并写入一个帧, 调用方需持有wmu
+func (c *SecureTCPConn) writeFrame(frame *[]byte, payload []byte, a *protocol.Adaptive) error {
+	data, err := c.codec.AppendFrameAdaptive((*frame)[:0], payload, a)
+	if err != nil {
+		return err
+	}
+	if cap(data) > cap(*frame) {
+		// 超出缓冲区时扩容后的切片留给下次使用
+		*frame = data[:0]
+	}
+	_, err = c.Conn.Write(data)
+	return err
+}
+
+func (c *SecureTCPConn) Close() error {
+	err := c.Conn.Close()
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.rbuf != nil {
+		protocol.PutBuffer(c.rbuf)
+		c.rbuf = nil
+		c.pending = nil
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package pool
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pool 预先建立的到服务端的连接, 请求到达时直接取出使用
+type Pool struct {
+	dial    func() (net.Conn, error)
+	size    int
+	maxIdle time.Duration
+	probe   time.Duration
+
+	mu      sync.Mutex
+	idle    []*idleConn
+	dialing int
+	done    chan struct{}
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+// New 创建连接池并开始预建连接
+// size为保持的空闲连接数, maxIdle为空闲连接的最长保留时间, probe为健康检查间隔
+func New(size int, maxIdle, probe time.Duration, dial func() (net.Conn, error)) *Pool {
+	p := &Pool{
+		dial:    dial,
+		size:    size,
+		maxIdle: maxIdle,
+		probe:   probe,
+		done:    make(chan struct{}),
+	}
+	p.fill()
+	if probe > 0 {
+		go p.loop()
+	}
+	return p
+}
+
+// Get 取出一个可用的空闲连接, 没有时直接建立新连接
+func (p *Pool) Get() (net.Conn, error) {
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		statistic.DefaultManager.SetPoolIdle(int64(len(p.idle)))
+		p.mu.Unlock()
+		if p.expired(c) || !alive(c) {
+			p.evict(c)
+			continue
+		}
+		statistic.DefaultManager.PushPoolHit()
+		p.fill()
+		return c.Conn, nil
+	}
+	statistic.DefaultManager.PushPoolMiss()
+	p.fill()
+	return p.dial()
+}
+
+// Len 当前空闲连接数
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Close 停止预建并关闭所有空闲连接
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	close(p.done)
+	for _, c := range p.idle {
+		_ = c.Close()
+	}
+	p.idle = nil
+	statistic.DefaultManager.SetPoolIdle(0)
+	return nil
+}
+
+// fill 异步补足空闲连接
+func (p *Pool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; len(p.idle)+p.dialing < p.size; p.dialing++ {
+		go p.add()
+	}
+}
+
+func (p *Pool) add() {
+	conn, err := p.dial()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if err != nil {
+		logrus.Warningln("connection pool dial", err)
+		return
+	}
+	select {
+	case <-p.done:
+		_ = conn.Close()
+		return
+	default:
+	}
+	p.idle = append(p.idle, &idleConn{Conn: conn, since: time.Now()})
+	statistic.DefaultManager.SetPoolIdle(int64(len(p.idle)))
+}
+
+func (p *Pool) evict(c *idleConn) {
+	_ = c.Close()
+	statistic.DefaultManager.PushPoolEvicted()
+}
+
+func (p *Pool) expired(c *idleConn) bool {
+	return p.maxIdle > 0 && time.Since(c.since) > p.maxIdle
+}
+
+// loop 定期检查空闲连接, 淘汰过期及已断开的连接并补足
+func (p *Pool) loop() {
+	ticker := time.NewTicker(p.probe)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		conns := p.idle
+		p.idle = nil
+		p.mu.Unlock()
+
+		var healthy []*idleConn
+		for _, c := range conns {
+			if p.expired(c) || !alive(c) {
+				p.evict(c)
+				continue
+			}
+			healthy = append(healthy, c)
+		}
+
+		p.mu.Lock()
+		select {
+		case <-p.done:
+			// 检查期间连接池已关闭
+			p.mu.Unlock()
+			for _, c := range healthy {
+				_ = c.Close()
+			}
+			return
+		default:
+		}
+		// 检查期间新建的连接排在后面, 优先被取出
+		p.idle = append(healthy, p.idle...)
+		statistic.DefaultManager.SetPoolIdle(int64(len(p.idle)))
+		p.mu.Unlock()
+		p.fill()
+	}
+}
+
+// alive 非阻塞地读取连接, 对端在握手前不会发送数据, 读超时说明连接仍然可用
+func alive(c net.Conn) bool {
+	var b [1]byte
+	_ = c.SetReadDeadline(time.Now())
+	_, err := c.Read(b[:])
+	_ = c.SetReadDeadline(time.Time{})
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,228 @@
+package pool
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dialer 以管道代替到服务端的连接, 记录建立的连接及对端
+type dialer struct {
+	mu    sync.Mutex
+	conns []net.Conn
+	peers []net.Conn
+	err   error
+}
+
+func (d *dialer) dial() (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	c, s := net.Pipe()
+	d.conns = append(d.conns, c)
+	d.peers = append(d.peers, s)
+	return c, nil
+}
+
+func (d *dialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// index 连接是第几个建立的, 不是由d建立时为-1
+func (d *dialer) index(conn net.Conn) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, c := range d.conns {
+		if c == conn {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *dialer) peer(i int) net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.peers[i]
+}
+
+// closed 连接已被关闭, 对端读取返回EOF
+func (d *dialer) closed(i int) bool {
+	peer := d.peer(i)
+	_ = peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := peer.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func (d *dialer) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.peers {
+		_ = c.Close()
+	}
+}
+
+func newDialer(t *testing.T) *dialer {
+	d := &dialer{}
+	t.Cleanup(d.close)
+	return d
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	d := newDialer(t)
+	p := New(3, 0, 0, d.dial)
+	defer p.Close()
+	waitFor(t, "pool filled", func() bool {
+		return p.Len() == 3
+	})
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := d.index(conn); i < 0 || i > 2 {
+		t.Fatalf("got connection %d, want a pre-dialed one", i)
+	}
+	// 取出后补足空闲连接
+	waitFor(t, "pool refilled", func() bool {
+		return p.Len() == 3 && d.count() == 4
+	})
+	time.Sleep(20 * time.Millisecond)
+	if n := d.count(); n != 4 {
+		t.Fatalf("dials: got %d, want 4", n)
+	}
+}
+
+func TestPoolMiss(t *testing.T) {
+	d := newDialer(t)
+	p := New(0, 0, 0, d.dial)
+	defer p.Close()
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.index(conn) != 0 || p.Len() != 0 {
+		t.Fatalf("miss: connection %d, %d idle", d.index(conn), p.Len())
+	}
+
+	d.err = errors.New("refused")
+	if _, err = p.Get(); err != d.err {
+		t.Fatalf("dial error: got %v, want %v", err, d.err)
+	}
+}
+
+func TestPoolIdleExpiry(t *testing.T) {
+	d := newDialer(t)
+	p := New(2, 30*time.Millisecond, 0, d.dial)
+	defer p.Close()
+	waitFor(t, "pool filled", func() bool {
+		return p.Len() == 2
+	})
+	time.Sleep(50 * time.Millisecond)
+	// 过期的空闲连接被关闭, 直接建立新连接
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := d.index(conn); i != 2 {
+		t.Fatalf("got connection %d, want a new one", i)
+	}
+	for i := 0; i < 2; i++ {
+		if !d.closed(i) {
+			t.Fatalf("expired connection %d not closed", i)
+		}
+	}
+}
+
+func TestPoolProbeExpiry(t *testing.T) {
+	d := newDialer(t)
+	p := New(2, 30*time.Millisecond, 10*time.Millisecond, d.dial)
+	defer p.Close()
+	// 健康检查淘汰过期的连接并补足
+	waitFor(t, "expired connections replaced", func() bool {
+		return d.count() >= 6 && p.Len() == 2
+	})
+	if !d.closed(0) || !d.closed(1) {
+		t.Fatal("expired connections not closed")
+	}
+}
+
+func TestPoolDeadConn(t *testing.T) {
+	d := newDialer(t)
+	p := New(1, 0, 0, d.dial)
+	defer p.Close()
+	waitFor(t, "pool filled", func() bool {
+		return p.Len() == 1
+	})
+	// 服务端关闭的连接在取出时被淘汰
+	_ = d.peer(0).Close()
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := d.index(conn); i < 1 {
+		t.Fatalf("got connection %d, want a new one", i)
+	}
+}
+
+func TestPoolProbeDeadConn(t *testing.T) {
+	d := newDialer(t)
+	p := New(2, 0, 10*time.Millisecond, d.dial)
+	defer p.Close()
+	waitFor(t, "pool filled", func() bool {
+		return p.Len() == 2
+	})
+	_ = d.peer(0).Close()
+	_ = d.peer(1).Close()
+	// 健康检查淘汰断开的连接并补足
+	waitFor(t, "dead connections replaced", func() bool {
+		return d.count() == 4 && p.Len() == 2
+	})
+	for i := 0; i < 2; i++ {
+		conn, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx := d.index(conn); idx < 2 {
+			t.Fatalf("got dead connection %d", idx)
+		}
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	d := newDialer(t)
+	p := New(2, 0, time.Millisecond, d.dial)
+	waitFor(t, "pool filled", func() bool {
+		return p.Len() == 2
+	})
+	_ = p.Close()
+	_ = p.Close()
+	if p.Len() != 0 {
+		t.Fatalf("%d idle after close", p.Len())
+	}
+	// 关闭后包括健康检查中的连接都被关闭, 不再建立新连接
+	waitFor(t, "idle connections closed", func() bool {
+		return d.closed(0) && d.closed(1)
+	})
+	time.Sleep(10 * time.Millisecond)
+	if n := d.count(); n != 2 {
+		t.Fatalf("dials after close: got %d, want 2", n)
+	}
+}
@@ -0,0 +1,396 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+	"io"
+	"math/rand"
+	"sync"
+)
+
+const (
+	// incompressible 压缩后与压缩前的比值超过此值视为不可压缩数据
+	incompressible = 0.95
+	// minCompressSize 小于此长度的数据不压缩, 也不参与自适应判断
+	minCompressSize = 128
+	// minAdaptiveSkip maxAdaptiveSkip 自适应模式遇到不可压缩的数据后跳过压缩的帧数,
+	// 连续不可压缩时逐次加倍
+	minAdaptiveSkip = 16
+	maxAdaptiveSkip = 1024
+	// maxOverhead 帧头及加密、标志位、填充带来的最大额外长度
+	maxOverhead = headerLen + 32 + flagsLen + padLenLen + maxPadding
+)
+
+// frameSize 编码一个 MaxPayload 长度的帧所需的缓冲区大小
+var frameSize = maxOverhead + snappy.MaxEncodedLen(MaxPayload)
+
+var (
+	framePool = sync.Pool{
+		New: func() any {
+			b := make([]byte, frameSize)
+			return &b
+		},
+	}
+	bufferPool = sync.Pool{
+		New: func() any {
+			return new(Buffer)
+		},
+	}
+)
+
+// GetFrame 获取编码帧使用的缓冲区
+func GetFrame() *[]byte {
+	return framePool.Get().(*[]byte)
+}
+
+func PutFrame(b *[]byte) {
+	framePool.Put(b)
+}
+
+// Buffer 读取帧使用的缓冲区, 可在同一连接的多次读取间复用
+type Buffer struct {
+	header [headerLen]byte
+	body   []byte
+	plain  []byte
+}
+
+func GetBuffer() *Buffer {
+	return bufferPool.Get().(*Buffer)
+}
+
+func PutBuffer(b *Buffer) {
+	bufferPool.Put(b)
+}
+
+// Options 本端的帧编码配置, 握手协商后按对端支持的能力生效
+type Options struct {
+	Padding    Padding
+	Compressor compress.Compressor
+	Adaptive   bool // 遇到不可压缩的数据后暂停压缩
+}
+
+// Adaptive 自适应压缩的状态, 遇到不可压缩的数据后跳过之后的若干帧再重新尝试,
+// 多路复用时每个流使用各自的状态, 一个流的数据不影响其他流是否压缩
+type Adaptive struct {
+	skip    int // 剩余不尝试压缩的帧数
+	backoff int // 下次遇到不可压缩数据时跳过的帧数
+}
+
+// miss 遇到不可压缩的数据
+func (a *Adaptive) miss() {
+	if a.backoff == 0 {
+		a.backoff = minAdaptiveSkip
+	}
+	a.skip = a.backoff
+	if a.backoff < maxAdaptiveSkip {
+		a.backoff *= 2
+	}
+}
+
+// hit 数据可压缩, 恢复初始的跳过帧数
+func (a *Adaptive) hit() {
+	a.backoff = 0
+}
+
+// Codec 隧道帧编解码, 握手协商后按双方支持的能力编码
+// 编码及解码可分别在不同的goroutine中调用
+type Codec struct {
+	Cipher     cipher.Cipher
+	Features   Feature             // 握手协商的能力
+	Padding    Padding             // 为nil时不填充
+	Compressor compress.Compressor // 为nil时不压缩
+	Adaptive   bool
+	Stats      *compress.Stats
+	Server     bool // 本端为服务端, 编码的帧计入下载方向的统计
+
+	adaptive Adaptive // 未指定状态时的自适应压缩状态, 即整个连接为一个流
+}
+
+func NewCodec(c cipher.Cipher) *Codec {
+	return &Codec{
+		Cipher: c,
+		Stats:  compress.NewStats(compress.None),
+	}
+}
+
+// Negotiate 启用对端支持的编码能力
+func (c *Codec) Negotiate(features Feature, opts Options) {
+	c.Features = features
+	if features.Has(FeaturePadding) {
+		c.Padding = opts.Padding
+	}
+	if opts.Compressor != nil && features.Has(compressFeature(opts.Compressor.Name())) {
+		c.Compressor = opts.Compressor
+		c.Adaptive = opts.Adaptive
+		c.Stats.Method = opts.Compressor.Name()
+	}
+}
+
+// sent 本端编码的帧所在方向的压缩统计
+func (c *Codec) sent() *compress.Counter {
+	if c.Server {
+		return c.Stats.Download
+	}
+	return c.Stats.Upload
+}
+
+// received 本端解码的帧所在方向的压缩统计
+func (c *Codec) received() *compress.Counter {
+	if c.Server {
+		return c.Stats.Upload
+	}
+	return c.Stats.Download
+}
+
+// Encode 将bin编码为一个新分配的帧
+func (c *Codec) Encode(bin []byte) ([]byte, error) {
+	return c.AppendFrame(nil, bin)
+}
+
+// AppendFrame 将payload编码为一个帧追加到dst, dst容量足够时不分配内存,
+// 压缩结果直接写入dst并原地加密
+func (c *Codec) AppendFrame(dst, payload []byte) ([]byte, error) {
+	return c.AppendFrameAdaptive(dst, payload, nil)
+}
+
+// AppendFrameAdaptive 与 AppendFrame 相同, 自适应压缩使用a中的状态, a为nil时使用连接的状态
+func (c *Codec) AppendFrameAdaptive(dst, payload []byte, a *Adaptive) ([]byte, error) {
+	if a == nil {
+		a = &c.adaptive
+	}
+	start := len(dst)
+	nonceSize := c.Cipher.NonceSize()
+	plainStart := start + headerLen + nonceSize
+	plainLen := flagsLen
+	if c.Padding != nil {
+		plainLen += padLenLen
+	}
+	frame := grow(dst, headerLen+nonceSize+plainLen)
+
+	// 压缩, 结果紧跟在标志位之后
+	frame, flags, err := c.compress(frame, payload, a)
+	if err != nil {
+		return nil, err
+	}
+	c.sent().Push(len(payload), len(frame)-plainStart-plainLen)
+
+	// 填充
+	if c.Padding != nil {
+		flags |= FlagPadded
+		padLen := c.Padding.Size(len(frame) - plainStart)
+		packetEndian.PutUint16(frame[plainStart+flagsLen:], uint16(padLen))
+		n := len(frame)
+		frame = grow(frame, padLen)
+		// 缓冲区来自复用池, 填充必须清零以免泄露其他连接的数据
+		pad := frame[n:]
+		for i := range pad {
+			pad[i] = 0
+		}
+	}
+	frame[plainStart] = byte(flags)
+
+	tagSize := c.Cipher.Overhead() - nonceSize
+	bodyLen := len(frame) - start - headerLen + tagSize
+	if bodyLen > maxByte {
+		return nil, ErrTooLargePacket
+	}
+	// 预留认证标签的空间, 避免加密时重新分配
+	frame = grow(frame, tagSize)[:len(frame)]
+
+	// 添加头部信息
+	header := frame[start : start+headerLen]
+	packetEndian.PutUint32(header, uint32(bodyLen))
+	packetEndian.PutUint16(header[payloadLen:], uint16(rand.Intn(1<<16)))
+
+	// 原地加密, 头部作为附加数据参与认证
+	return c.Cipher.Seal(frame[:start+headerLen], frame[plainStart:], header), nil
+}
+
+func (c *Codec) compress(dst, bin []byte, a *Adaptive) ([]byte, Flag, error) {
+	flag := compressFlag(c.Compressor)
+	if flag == 0 || len(bin) < minCompressSize {
+		return append(dst, bin...), 0, nil
+	}
+	if c.Adaptive && a.skip > 0 {
+		a.skip--
+		return append(dst, bin...), 0, nil
+	}
+	out, err := c.Compressor.Compress(dst, bin)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := len(out) - len(dst)
+	if float64(n) > float64(len(bin))*incompressible {
+		if c.Adaptive {
+			// 加密流量等不可压缩的数据, 暂停压缩该流之后的帧
+			a.miss()
+		}
+		if n >= len(bin) {
+			return append(out[:len(dst)], bin...), 0, nil
+		}
+	} else if c.Adaptive {
+		a.hit()
+	}
+	return out, flag, nil
+}
+
+func (c *Codec) UnPack(buf []byte) (*Packet, error) {
+	if len(buf) < headerLen {
+		return nil, ErrIncompletePacket
+	}
+	bodyLen := packetEndian.Uint32(buf[:payloadLen])
+	msgLen := headerLen + int(bodyLen)
+	if len(buf) < msgLen {
+		return nil, ErrIncompletePacket
+	}
+	body := append([]byte(nil), buf[headerLen:msgLen]...)
+	var plain []byte
+	packet, err := c.decode(buf[:headerLen], body, &plain)
+	if err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// ReadFull 读取一个帧, 返回的数据不引用任何复用的缓冲区
+func (c *Codec) ReadFull(r io.Reader) (*Packet, error) {
+	buf := new(Buffer)
+	packet, err := c.ReadFrame(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// ReadFrameBytes 读取一个完整的帧但不解密, 用于尝试多个密钥, 帧长度超过max时返回 ErrTooLargePacket
+func ReadFrameBytes(r io.Reader, max int) ([]byte, error) {
+	frame := make([]byte, headerLen)
+	_, err := io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+	bodyLen := int(packetEndian.Uint32(frame[:payloadLen]))
+	if bodyLen > max || bodyLen > maxByte {
+		return nil, ErrTooLargePacket
+	}
+	frame = grow(frame, bodyLen)
+	_, err = io.ReadFull(r, frame[headerLen:])
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ReadFrame 使用buf读取并原地解密一个帧, 返回的Payload引用buf内的数据,
+// 在下一次使用buf前有效
+func (c *Codec) ReadFrame(r io.Reader, buf *Buffer) (Packet, error) {
+	_, err := io.ReadFull(r, buf.header[:])
+	if err != nil {
+		return Packet{}, err
+	}
+	bodyLen := packetEndian.Uint32(buf.header[:payloadLen])
+	if bodyLen > maxByte {
+		return Packet{}, ErrTooLargePacket
+	}
+	buf.body = grow(buf.body[:0], int(bodyLen))
+	_, err = io.ReadFull(r, buf.body)
+	if err != nil {
+		return Packet{}, err
+	}
+	return c.decode(buf.header[:], buf.body, &buf.plain)
+}
+
+func (c *Codec) decode(header, body []byte, plainBuf *[]byte) (Packet, error) {
+	nonceSize := c.Cipher.NonceSize()
+	if len(body) < c.Cipher.Overhead() {
+		return Packet{}, ErrIncompletePacket
+	}
+	// 原地解密, 认证失败的帧直接丢弃
+	plain, err := c.Cipher.Open(body[nonceSize:nonceSize], body, header)
+	if err != nil {
+		return Packet{}, err
+	}
+	if len(plain) < flagsLen {
+		return Packet{}, ErrIncompletePacket
+	}
+	packet := Packet{
+		Flags: Flag(plain[0]),
+	}
+	plain = plain[flagsLen:]
+	// 去除填充
+	if packet.Flags.Has(FlagPadded) {
+		if len(plain) < padLenLen {
+			return Packet{}, ErrIncompletePacket
+		}
+		packet.Padding = int(packetEndian.Uint16(plain))
+		plain = plain[padLenLen:]
+		if len(plain) < packet.Padding {
+			return Packet{}, ErrIncompletePacket
+		}
+		plain = plain[:len(plain)-packet.Padding]
+	}
+	// 解压
+	packet.Payload, err = decompress(packet.Flags, (*plainBuf)[:0], plain)
+	if err != nil {
+		return Packet{}, fmt.Errorf("%w: %v", ErrCorruptPacket, err)
+	}
+	if packet.Flags.Has(FlagSnappy) || packet.Flags.Has(FlagFlate) {
+		*plainBuf = packet.Payload[:0]
+	}
+	c.received().Push(len(packet.Payload), len(plain))
+	return packet, nil
+}
+
+func decompress(flags Flag, dst, plain []byte) ([]byte, error) {
+	var method string
+	switch {
+	case flags.Has(FlagSnappy):
+		method = compress.Snappy
+	case flags.Has(FlagFlate):
+		method = compress.Flate
+	default:
+		return plain, nil
+	}
+	c, err := compress.New(method)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(dst, plain)
+}
+
+func compressFlag(c compress.Compressor) Flag {
+	if c == nil {
+		return 0
+	}
+	switch c.Name() {
+	case compress.Snappy:
+		return FlagSnappy
+	case compress.Flate:
+		return FlagFlate
+	default:
+		return 0
+	}
+}
+
+func compressFeature(method string) Feature {
+	switch method {
+	case compress.Snappy:
+		return FeatureSnappy
+	case compress.Flate:
+		return FeatureFlate
+	default:
+		return 0
+	}
+}
+
+// grow 扩展b n个字节, 容量不足时重新分配
+func grow(b []byte, n int) []byte {
+	if total := len(b) + n; cap(b) >= total {
+		return b[:total]
+	}
+	nb := make([]byte, len(b)+n, 2*len(b)+n)
+	copy(nb, b)
+	return nb
+}
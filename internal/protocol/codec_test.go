@@ -0,0 +1,408 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+	"io"
+	"testing"
+)
+
+func newBenchCodec(b *testing.B, method, compressor string) *Codec {
+	c, err := cipher.Derive(method, []byte("benchmark"), make([]byte, cipher.SaltSize))
+	if err != nil {
+		b.Fatal(err)
+	}
+	codec := NewCodec(c)
+	comp, err := compress.New(compressor)
+	if err != nil {
+		b.Fatal(err)
+	}
+	codec.Negotiate(SupportedFeatures, Options{Compressor: comp})
+	return codec
+}
+
+func benchPayload() []byte {
+	return bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), MaxPayload/38)
+}
+
+func benchmarkAppendFrame(b *testing.B, method, compressor string) {
+	codec := newBenchCodec(b, method, compressor)
+	payload := benchPayload()
+	frame := GetFrame()
+	defer PutFrame(frame)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.AppendFrame((*frame)[:0], payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkReadFrame(b *testing.B, method, compressor string) {
+	codec := newBenchCodec(b, method, compressor)
+	payload := benchPayload()
+	data, err := codec.Encode(payload)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var (
+		r   bytes.Reader
+		buf Buffer
+	)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if _, err = codec.ReadFrame(&r, &buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendFrameAESGCM(b *testing.B) {
+	benchmarkAppendFrame(b, cipher.AES256GCM, compress.None)
+}
+
+func BenchmarkAppendFrameChaCha20Poly1305(b *testing.B) {
+	benchmarkAppendFrame(b, cipher.ChaCha20Poly1305, compress.None)
+}
+
+func BenchmarkAppendFrameSnappy(b *testing.B) {
+	benchmarkAppendFrame(b, cipher.AES256GCM, compress.Snappy)
+}
+
+func BenchmarkAppendFrameFlate(b *testing.B) {
+	benchmarkAppendFrame(b, cipher.AES256GCM, compress.Flate)
+}
+
+func BenchmarkReadFrameAESGCM(b *testing.B) {
+	benchmarkReadFrame(b, cipher.AES256GCM, compress.None)
+}
+
+func BenchmarkReadFrameChaCha20Poly1305(b *testing.B) {
+	benchmarkReadFrame(b, cipher.ChaCha20Poly1305, compress.None)
+}
+
+func BenchmarkReadFrameSnappy(b *testing.B) {
+	benchmarkReadFrame(b, cipher.AES256GCM, compress.Snappy)
+}
+
+func BenchmarkReadFrameFlate(b *testing.B) {
+	benchmarkReadFrame(b, cipher.AES256GCM, compress.Flate)
+}
+
+func TestCodecStatsDirection(t *testing.T) {
+	key := make([]byte, cipher.SaltSize)
+	newCodec := func(server bool) *Codec {
+		c, err := cipher.Derive(cipher.AES256GCM, []byte("stats"), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := NewCodec(c)
+		codec.Server = server
+		codec.Negotiate(SupportedFeatures, Options{Compressor: mustCompressor(t, compress.Snappy)})
+		return codec
+	}
+	client, server := newCodec(false), newCodec(true)
+	upload := bytes.Repeat([]byte("upload "), 1024)
+	download := make([]byte, 4096)
+	if _, err := rand.Read(download); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, client, server, upload)
+	roundTrip(t, server, client, download)
+
+	for name, stats := range map[string]*compress.Stats{"client": client.Stats, "server": server.Stats} {
+		if got := stats.Upload.Raw.Load(); got != int64(len(upload)) {
+			t.Errorf("%s upload raw: got %d, want %d", name, got, len(upload))
+		}
+		if got := stats.Download.Raw.Load(); got != int64(len(download)) {
+			t.Errorf("%s download raw: got %d, want %d", name, got, len(download))
+		}
+		if ratio := stats.Upload.Ratio(); ratio >= incompressible {
+			t.Errorf("%s upload ratio %.2f, want compressed", name, ratio)
+		}
+		if ratio := stats.Download.Ratio(); ratio != 1 {
+			t.Errorf("%s download ratio %.2f, want 1 for random data", name, ratio)
+		}
+	}
+}
+
+func mustCompressor(t *testing.T, method string) compress.Compressor {
+	c, err := compress.New(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// roundTrip 以from编码payload, 以to解码并检查结果
+func roundTrip(t *testing.T, from, to *Codec, payload []byte) {
+	t.Helper()
+	data, err := from.Encode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf Buffer
+	packet, err := to.ReadFrame(bytes.NewReader(data), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Payload, payload) {
+		t.Fatalf("payload mismatch: got %d bytes, want %d", len(packet.Payload), len(payload))
+	}
+}
+
+func newTestCodec(t *testing.T, method string, padding Padding, compressor string, adaptive bool) *Codec {
+	t.Helper()
+	c, err := cipher.Derive(method, []byte("test"), make([]byte, cipher.SaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewCodec(c)
+	codec.Negotiate(SupportedFeatures, Options{
+		Padding:    padding,
+		Compressor: mustCompressor(t, compressor),
+		Adaptive:   adaptive,
+	})
+	return codec
+}
+
+type codecCase struct {
+	name     string
+	method   string
+	padding  Padding
+	compress string
+	adaptive bool
+}
+
+func codecCases(t *testing.T) []codecCase {
+	paddings := map[string]func() (Padding, error){
+		PaddingNone: func() (Padding, error) {
+			return NewPadding(PaddingNone, 0, 0, nil)
+		},
+		PaddingBucket: func() (Padding, error) {
+			return NewPadding(PaddingBucket, 0, 0, []int{512, 4096})
+		},
+		PaddingRandom: func() (Padding, error) {
+			return NewPadding(PaddingRandom, 0, 255, nil)
+		},
+	}
+	var cases []codecCase
+	for _, method := range []string{cipher.AES256GCM, cipher.ChaCha20Poly1305} {
+		for _, padName := range []string{PaddingNone, PaddingBucket, PaddingRandom} {
+			padding, err := paddings[padName]()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, comp := range []string{compress.None, compress.Snappy, compress.Flate} {
+				for _, adaptive := range []bool{false, true} {
+					cases = append(cases, codecCase{
+						name:     fmt.Sprintf("%s/%s/%s/adaptive=%v", method, padName, comp, adaptive),
+						method:   method,
+						padding:  padding,
+						compress: comp,
+						adaptive: adaptive,
+					})
+				}
+			}
+		}
+	}
+	return cases
+}
+
+func testPayloads(t *testing.T) map[string][]byte {
+	random := make([]byte, MaxPayload)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"empty":        {},
+		"short":        []byte("hello"),
+		"text":         bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 64),
+		"random":       random,
+		"compressible": benchPayload(),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	payloads := testPayloads(t)
+	order := []string{"empty", "short", "text", "random", "compressible", "text"}
+	for _, tc := range codecCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			enc := newTestCodec(t, tc.method, tc.padding, tc.compress, tc.adaptive)
+			dec := newTestCodec(t, tc.method, tc.padding, tc.compress, tc.adaptive)
+			// 多个帧连续写入同一个流, 复用同一个Buffer读取
+			var stream bytes.Buffer
+			for _, name := range order {
+				data, err := enc.Encode(payloads[name])
+				if err != nil {
+					t.Fatalf("encode %s: %v", name, err)
+				}
+				stream.Write(data)
+			}
+			var buf Buffer
+			for _, name := range order {
+				packet, err := dec.ReadFrame(&stream, &buf)
+				if err != nil {
+					t.Fatalf("read %s: %v", name, err)
+				}
+				if !bytes.Equal(packet.Payload, payloads[name]) {
+					t.Fatalf("%s: payload mismatch", name)
+				}
+				if tc.padding == nil && packet.Padding != 0 {
+					t.Fatalf("%s: unexpected padding %d", name, packet.Padding)
+				}
+			}
+			if stream.Len() != 0 {
+				t.Fatalf("%d bytes left in stream", stream.Len())
+			}
+			// 不可压缩的数据之后, 自适应模式暂停压缩
+			if tc.compress != compress.None && (enc.adaptive.skip > 0) != tc.adaptive {
+				t.Fatalf("skip after incompressible data: %d, adaptive %v", enc.adaptive.skip, tc.adaptive)
+			}
+		})
+	}
+}
+
+func TestCodecTamper(t *testing.T) {
+	payload := testPayloads(t)["text"]
+	for _, tc := range codecCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			enc := newTestCodec(t, tc.method, tc.padding, tc.compress, tc.adaptive)
+			dec := newTestCodec(t, tc.method, tc.padding, tc.compress, tc.adaptive)
+			data, err := enc.Encode(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonceSize := enc.Cipher.NonceSize()
+			// 长度字段被修改时读取的帧不完整, 其他字节被修改时认证失败
+			offsets := map[string]int{
+				"header rand": headerLen - 1,
+				"nonce":       headerLen,
+				"body":        headerLen + nonceSize + 1,
+				"tag":         len(data) - 1,
+			}
+			for name, offset := range offsets {
+				tampered := append([]byte(nil), data...)
+				tampered[offset] ^= 0x01
+				var buf Buffer
+				_, err = dec.ReadFrame(bytes.NewReader(tampered), &buf)
+				if err != cipher.ErrAuthentication {
+					t.Fatalf("%s flipped: got %v, want %v", name, err, cipher.ErrAuthentication)
+				}
+			}
+			var buf Buffer
+			packet, err := dec.ReadFrame(bytes.NewReader(data), &buf)
+			if err != nil || !bytes.Equal(packet.Payload, payload) {
+				t.Fatalf("original frame after tampering: %v", err)
+			}
+		})
+	}
+}
+
+func TestCodecWrongKey(t *testing.T) {
+	enc := newTestCodec(t, cipher.AES256GCM, nil, compress.None, false)
+	c, err := cipher.Derive(cipher.AES256GCM, []byte("other"), make([]byte, cipher.SaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := NewCodec(c)
+	data, err := enc.Encode([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf Buffer
+	if _, err = dec.ReadFrame(bytes.NewReader(data), &buf); err != cipher.ErrAuthentication {
+		t.Fatalf("got %v, want %v", err, cipher.ErrAuthentication)
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	enc := newTestCodec(t, cipher.AES256GCM, nil, compress.None, false)
+	data, err := enc.Encode([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf Buffer
+	_, err = enc.ReadFrame(bytes.NewReader(data[:len(data)-1]), &buf)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// adaptiveFlags 以状态a编码payload, 解码后返回帧的标志位
+func adaptiveFlags(t *testing.T, enc, dec *Codec, payload []byte, a *Adaptive) Flag {
+	t.Helper()
+	data, err := enc.AppendFrameAdaptive(nil, payload, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf Buffer
+	packet, err := dec.ReadFrame(bytes.NewReader(data), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Payload, payload) {
+		t.Fatal("payload mismatch")
+	}
+	return packet.Flags
+}
+
+func TestCodecAdaptive(t *testing.T) {
+	enc := newTestCodec(t, cipher.AES256GCM, nil, compress.Snappy, true)
+	dec := newTestCodec(t, cipher.AES256GCM, nil, compress.Snappy, true)
+	random := testPayloads(t)["random"]
+	text := testPayloads(t)["text"]
+	var a, b Adaptive
+
+	// 一个流的不可压缩数据不影响其他流
+	if adaptiveFlags(t, enc, dec, random, &a).Has(FlagSnappy) {
+		t.Fatal("random data compressed")
+	}
+	if !adaptiveFlags(t, enc, dec, text, &b).Has(FlagSnappy) {
+		t.Fatal("other stream stopped compressing")
+	}
+	// 暂停压缩的流跳过若干帧后重新尝试
+	for i := 0; i < minAdaptiveSkip; i++ {
+		if adaptiveFlags(t, enc, dec, text, &a).Has(FlagSnappy) {
+			t.Fatalf("frame %d compressed while skipping", i)
+		}
+	}
+	if !adaptiveFlags(t, enc, dec, text, &a).Has(FlagSnappy) {
+		t.Fatal("no compression after skipping")
+	}
+
+	// 连续不可压缩时跳过的帧数加倍, 可压缩后恢复
+	var c Adaptive
+	want := minAdaptiveSkip
+	for i := 0; i < 8; i++ {
+		adaptiveFlags(t, enc, dec, random, &c)
+		if c.skip != want {
+			t.Fatalf("miss %d: skip %d, want %d", i, c.skip, want)
+		}
+		c.skip = 0
+		if want < maxAdaptiveSkip {
+			want *= 2
+		}
+	}
+	adaptiveFlags(t, enc, dec, text, &c)
+	adaptiveFlags(t, enc, dec, random, &c)
+	if c.skip != minAdaptiveSkip {
+		t.Fatalf("skip after compressible data: %d, want %d", c.skip, minAdaptiveSkip)
+	}
+
+	// 未指定状态时使用连接的状态
+	if _, err := enc.Encode(random); err != nil {
+		t.Fatal(err)
+	}
+	if enc.adaptive.skip != minAdaptiveSkip || !adaptiveFlags(t, enc, dec, text, &b).Has(FlagSnappy) {
+		t.Fatalf("connection state: skip %d", enc.adaptive.skip)
+	}
+}
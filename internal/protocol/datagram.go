@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+)
+
+// MaxDatagram UDP数据报的最大长度
+const MaxDatagram = 65535
+
+var ErrInvalidDatagram = errors.New("invalid datagram")
+
+// WriteDatagram 在UDP转发连接中写入一个数据报, 客户端发送时addr为目标地址, 服务端发送时为来源地址
+// 隧道连接是字节流, 数据报以长度分隔
+//
+// * 0         2          3
+// * +---------+----------+--------+--------+
+// * |   len   | addr len |  addr  |  data  |
+// * +---------+----------+--------+--------+
+func WriteDatagram(w io.Writer, addr string, data []byte) error {
+	size := 1 + len(addr) + len(data)
+	if len(addr) > 0xff || size > MaxDatagram {
+		return ErrInvalidDatagram
+	}
+	buf := make([]byte, 2+size)
+	packetEndian.PutUint16(buf, uint16(size))
+	buf[2] = byte(len(addr))
+	copy(buf[3:], addr)
+	copy(buf[3+len(addr):], data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram 读取一个数据报, buf的长度至少为 MaxDatagram, 返回的data引用buf
+func ReadDatagram(r io.Reader, buf []byte) (addr string, data []byte, err error) {
+	_, err = io.ReadFull(r, buf[:2])
+	if err != nil {
+		return
+	}
+	size := int(packetEndian.Uint16(buf))
+	if size < 1 || size > len(buf) {
+		return "", nil, ErrInvalidDatagram
+	}
+	_, err = io.ReadFull(r, buf[:size])
+	if err != nil {
+		return
+	}
+	addrLen := int(buf[0])
+	if 1+addrLen > size {
+		return "", nil, ErrInvalidDatagram
+	}
+	return string(buf[1 : 1+addrLen]), buf[1+addrLen : size], nil
+}
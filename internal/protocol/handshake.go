@@ -0,0 +1,221 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// Version 当前隧道协议版本
+	// v2: 帧是否压缩及压缩方式由帧标志位标识
+	// v3: 支持多路复用会话
+	// v4: 服务端连接目标后应答连接结果
+	// v5: 支持BIND请求
+	// v6: 支持UDP转发
+	// v7: 支持反向隧道
+	Version uint8 = 7
+	// MinVersion 可兼容的最低协议版本
+	MinVersion uint8 = 2
+)
+
+// Feature 协议能力位, 握手时双方取交集
+type Feature uint32
+
+const (
+	// FeaturePadding 可解析带填充的帧
+	FeaturePadding Feature = 1 << iota
+	// FeatureSnappy 可解析snappy压缩的帧
+	FeatureSnappy
+	// FeatureFlate 可解析flate压缩的帧
+	FeatureFlate
+	// FeatureMux 连接作为多路复用会话, 握手不携带目标地址
+	FeatureMux
+	// FeatureStatus 服务端连接目标后先发送连接结果
+	FeatureStatus
+	// FeatureBind 连接用于BIND请求, 服务端监听并等待addr指定的对端连入
+	FeatureBind
+	// FeatureUDP 连接用于转发UDP数据报, 握手不携带目标地址
+	FeatureUDP
+	// FeatureReverse 连接用于注册反向隧道, 服务端监听addr, 连入的连接经该连接上的多路复用会话转发给客户端
+	FeatureReverse
+)
+
+// SupportedFeatures 本端支持的能力
+const SupportedFeatures = FeaturePadding | FeatureSnappy | FeatureFlate | FeatureMux | FeatureStatus | FeatureBind | FeatureUDP | FeatureReverse
+
+// kindFeatures 标识连接用途的能力位, 只在对应用途的握手中携带
+const kindFeatures = FeatureMux | FeatureBind | FeatureUDP | FeatureReverse
+
+func (f Feature) Has(feature Feature) bool {
+	return f&feature == feature
+}
+
+const (
+	versionLen   = 1
+	featuresLen  = 4
+	timestampLen = 8
+	nonceLen     = 16
+	addrLenLen   = 2
+	handshakeLen = versionLen + featuresLen + timestampLen + nonceLen + addrLenLen
+	ackLen       = versionLen + featuresLen
+)
+
+var (
+	ErrInvalidHandshake = errors.New("invalid handshake")
+	ErrClientTooOld     = errors.New("client protocol version too old")
+	ErrServerTooOld     = errors.New("server protocol version too old")
+)
+
+// Handshake 隧道握手帧, 客户端连接后发送的第一个帧
+// 高版本只允许在addr之后追加字段, 低版本解析时忽略多余的数据
+//
+// * 0         1          5           13               29         31
+// * +---------+----------+-----------+----------------+----------+--------+-----------+
+// * | version | features | timestamp |     nonce      | addr len |  addr  | ... ...   |
+// * +---------+----------+-----------+----------------+----------+--------+-----------+
+type Handshake struct {
+	Version   uint8
+	Features  Feature
+	Timestamp int64
+	Nonce     []byte
+	Addr      string
+}
+
+// NewHandshake 以当前版本、时间及随机nonce创建握手帧
+func NewHandshake(addr string) (*Handshake, error) {
+	return newHandshake(SupportedFeatures&^kindFeatures, addr)
+}
+
+// NewMuxHandshake 创建多路复用会话的握手帧, 目标地址由会话中的每个流携带
+func NewMuxHandshake() (*Handshake, error) {
+	return newHandshake(SupportedFeatures&^kindFeatures|FeatureMux, "")
+}
+
+// NewBindHandshake 创建BIND请求的握手帧, addr为预期连入的对端地址
+func NewBindHandshake(addr string) (*Handshake, error) {
+	return newHandshake(SupportedFeatures&^kindFeatures|FeatureBind, addr)
+}
+
+// NewUDPHandshake 创建UDP转发的握手帧, 目标地址由每个数据报携带
+func NewUDPHandshake() (*Handshake, error) {
+	return newHandshake(SupportedFeatures&^kindFeatures|FeatureUDP, "")
+}
+
+// NewReverseHandshake 创建注册反向隧道的握手帧, addr为服务端监听的地址
+func NewReverseHandshake(addr string) (*Handshake, error) {
+	return newHandshake(SupportedFeatures&^kindFeatures|FeatureReverse, addr)
+}
+
+func newHandshake(features Feature, addr string) (*Handshake, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &Handshake{
+		Version:   Version,
+		Features:  features,
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+		Addr:      addr,
+	}, nil
+}
+
+func (h *Handshake) Marshal() []byte {
+	buf := make([]byte, handshakeLen+len(h.Addr))
+	buf[0] = h.Version
+	i := versionLen
+	packetEndian.PutUint32(buf[i:], uint32(h.Features))
+	i += featuresLen
+	packetEndian.PutUint64(buf[i:], uint64(h.Timestamp))
+	i += timestampLen
+	copy(buf[i:i+nonceLen], h.Nonce)
+	i += nonceLen
+	packetEndian.PutUint16(buf[i:], uint16(len(h.Addr)))
+	i += addrLenLen
+	copy(buf[i:], h.Addr)
+	return buf
+}
+
+// ParseHandshake 解析握手帧, 版本过低时返回 ErrClientTooOld
+func ParseHandshake(buf []byte) (*Handshake, error) {
+	if len(buf) < versionLen {
+		return nil, ErrInvalidHandshake
+	}
+	h := &Handshake{Version: buf[0]}
+	if h.Version < MinVersion {
+		return h, fmt.Errorf("%w: v%d, minimum supported v%d", ErrClientTooOld, h.Version, MinVersion)
+	}
+	if len(buf) < handshakeLen {
+		return nil, ErrInvalidHandshake
+	}
+	i := versionLen
+	h.Features = Feature(packetEndian.Uint32(buf[i:]))
+	i += featuresLen
+	h.Timestamp = int64(packetEndian.Uint64(buf[i:]))
+	i += timestampLen
+	h.Nonce = append([]byte(nil), buf[i:i+nonceLen]...)
+	i += nonceLen
+	addrLen := int(packetEndian.Uint16(buf[i:]))
+	i += addrLenLen
+	noAddr := h.Features.Has(FeatureMux) || h.Features.Has(FeatureUDP)
+	if (addrLen == 0 && !noAddr) || len(buf) < i+addrLen {
+		return nil, ErrInvalidHandshake
+	}
+	h.Addr = string(buf[i : i+addrLen])
+	return h, nil
+}
+
+// Time 握手帧的发送时间
+func (h *Handshake) Time() time.Time {
+	return time.Unix(h.Timestamp, 0)
+}
+
+// Negotiate 服务端根据客户端握手确定双方使用的版本及能力
+func (h *Handshake) Negotiate() *HandshakeAck {
+	ack := &HandshakeAck{
+		Version:  Version,
+		Features: h.Features & SupportedFeatures,
+	}
+	if h.Version < ack.Version {
+		ack.Version = h.Version
+	}
+	return ack
+}
+
+// HandshakeAck 服务端对握手的应答, 携带协商后的版本及能力
+//
+// * 0         1          5
+// * +---------+----------+
+// * | version | features |
+// * +---------+----------+
+type HandshakeAck struct {
+	Version  uint8
+	Features Feature
+}
+
+func (a *HandshakeAck) Marshal() []byte {
+	buf := make([]byte, ackLen)
+	buf[0] = a.Version
+	packetEndian.PutUint32(buf[versionLen:], uint32(a.Features))
+	return buf
+}
+
+// ParseHandshakeAck 解析服务端应答, 版本过低时返回 ErrServerTooOld
+func ParseHandshakeAck(buf []byte) (*HandshakeAck, error) {
+	if len(buf) < ackLen {
+		return nil, ErrInvalidHandshake
+	}
+	a := &HandshakeAck{
+		Version:  buf[0],
+		Features: Feature(packetEndian.Uint32(buf[versionLen:])),
+	}
+	if a.Version < MinVersion {
+		return nil, fmt.Errorf("%w: v%d, minimum supported v%d", ErrServerTooOld, a.Version, MinVersion)
+	}
+	// 只接受本端支持的能力
+	a.Features &= SupportedFeatures
+	return a, nil
+}
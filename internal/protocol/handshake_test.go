@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHandshakeMarshal(t *testing.T) {
+	constructors := map[string]func() (*Handshake, error){
+		"connect": func() (*Handshake, error) { return NewHandshake("example.com:443") },
+		"mux":     NewMuxHandshake,
+		"bind":    func() (*Handshake, error) { return NewBindHandshake("1.2.3.4:0") },
+		"udp":     NewUDPHandshake,
+		"reverse": func() (*Handshake, error) { return NewReverseHandshake(":9000") },
+	}
+	for name, newHandshake := range constructors {
+		t.Run(name, func(t *testing.T) {
+			h, err := newHandshake()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ParseHandshake(h.Marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Version != h.Version || got.Features != h.Features || got.Timestamp != h.Timestamp ||
+				!bytes.Equal(got.Nonce, h.Nonce) || got.Addr != h.Addr {
+				t.Fatalf("got %+v, want %+v", got, h)
+			}
+			// 每个握手只携带一个用途
+			if kinds := h.Features & kindFeatures; kinds&(kinds-1) != 0 {
+				t.Fatalf("multiple kind features %b", kinds)
+			}
+		})
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	h, err := NewHandshake("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := h.Marshal()
+
+	// 高版本在addr之后追加的字段被忽略
+	got, err := ParseHandshake(append(buf, 1, 2, 3))
+	if err != nil || got.Addr != h.Addr {
+		t.Fatalf("trailing fields: %+v, %v", got, err)
+	}
+
+	old := append([]byte(nil), buf...)
+	old[0] = MinVersion - 1
+	if _, err = ParseHandshake(old); !errors.Is(err, ErrClientTooOld) {
+		t.Fatalf("old version: got %v, want %v", err, ErrClientTooOld)
+	}
+
+	invalid := map[string][]byte{
+		"empty":     nil,
+		"short":     buf[:handshakeLen-1],
+		"truncated": buf[:len(buf)-1],
+	}
+	for name, b := range invalid {
+		if _, err = ParseHandshake(b); err != ErrInvalidHandshake {
+			t.Errorf("%s: got %v, want %v", name, err, ErrInvalidHandshake)
+		}
+	}
+
+	// 只有多路复用及UDP握手可以不带地址
+	noAddr, err := newHandshake(SupportedFeatures&^kindFeatures, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseHandshake(noAddr.Marshal()); err != ErrInvalidHandshake {
+		t.Fatalf("connect without addr: got %v, want %v", err, ErrInvalidHandshake)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	const unknown Feature = 1 << 31
+	tests := []struct {
+		name         string
+		version      uint8
+		features     Feature
+		wantVersion  uint8
+		wantFeatures Feature
+	}{
+		{"current", Version, SupportedFeatures &^ kindFeatures, Version, SupportedFeatures &^ kindFeatures},
+		{"old client", MinVersion, FeaturePadding, MinVersion, FeaturePadding},
+		{"newer client", Version + 1, FeatureSnappy | unknown, Version, FeatureSnappy},
+		{"mux", Version, FeatureMux | FeatureStatus, Version, FeatureMux | FeatureStatus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handshake{Version: tt.version, Features: tt.features}
+			ack := h.Negotiate()
+			if ack.Version != tt.wantVersion || ack.Features != tt.wantFeatures {
+				t.Fatalf("got v%d %b, want v%d %b", ack.Version, ack.Features, tt.wantVersion, tt.wantFeatures)
+			}
+			got, err := ParseHandshakeAck(ack.Marshal())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *ack {
+				t.Fatalf("ack round trip: got %+v, want %+v", got, ack)
+			}
+		})
+	}
+}
+
+func TestParseHandshakeAck(t *testing.T) {
+	if _, err := ParseHandshakeAck([]byte{Version}); err != ErrInvalidHandshake {
+		t.Fatalf("short ack: got %v, want %v", err, ErrInvalidHandshake)
+	}
+	old := (&HandshakeAck{Version: MinVersion - 1}).Marshal()
+	if _, err := ParseHandshakeAck(old); !errors.Is(err, ErrServerTooOld) {
+		t.Fatalf("old server: got %v, want %v", err, ErrServerTooOld)
+	}
+	// 只接受本端支持的能力
+	ack, err := ParseHandshakeAck((&HandshakeAck{Version: Version, Features: 1<<31 | FeatureMux}).Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Features != FeatureMux {
+		t.Fatalf("features %b, want %b", ack.Features, FeatureMux)
+	}
+}
@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// 填充方式
+const (
+	PaddingNone   = "none"
+	PaddingRandom = "random"
+	PaddingBucket = "bucket"
+)
+
+// maxPadding 填充长度字段为2字节
+const maxPadding = 1<<16 - 1
+
+// Padding 帧长度填充策略, 返回长度为n的帧内容需要填充的字节数
+type Padding interface {
+	Size(n int) int
+}
+
+var ErrInvalidPadding = errors.New("invalid padding")
+
+// NewPadding 根据配置创建填充策略, 不填充时返回nil
+func NewPadding(mode string, min, max int, buckets []int) (Padding, error) {
+	switch strings.ToLower(mode) {
+	case "", PaddingNone:
+		return nil, nil
+	case PaddingRandom:
+		if min < 0 || max < min || max > maxPadding {
+			return nil, fmt.Errorf("%w: random range [%d, %d]", ErrInvalidPadding, min, max)
+		}
+		return &randomPadding{min: min, max: max}, nil
+	case PaddingBucket:
+		if len(buckets) == 0 {
+			return nil, fmt.Errorf("%w: no bucket", ErrInvalidPadding)
+		}
+		sizes := make([]int, 0, len(buckets))
+		for _, v := range buckets {
+			if v <= 0 || v > maxPadding {
+				return nil, fmt.Errorf("%w: bucket %d", ErrInvalidPadding, v)
+			}
+			sizes = append(sizes, v)
+		}
+		sort.Ints(sizes)
+		return &bucketPadding{sizes: sizes}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %s", ErrInvalidPadding, mode)
+	}
+}
+
+// randomPadding 在[min, max]范围内随机填充
+type randomPadding struct {
+	min, max int
+}
+
+func (p *randomPadding) Size(int) int {
+	return p.min + rand.Intn(p.max-p.min+1)
+}
+
+// bucketPadding 填充到不小于n的最小桶, 超过最大桶时填充到最大桶的整数倍
+type bucketPadding struct {
+	sizes []int
+}
+
+func (p *bucketPadding) Size(n int) int {
+	for _, v := range p.sizes {
+		if v >= n {
+			return v - n
+		}
+	}
+	largest := p.sizes[len(p.sizes)-1]
+	if r := n % largest; r != 0 {
+		return largest - r
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+	"testing"
+)
+
+func TestNewPadding(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		min, max int
+		buckets  []int
+		wantNil  bool
+		wantErr  bool
+	}{
+		{"empty", "", 0, 0, nil, true, false},
+		{"none", PaddingNone, 0, 0, nil, true, false},
+		{"random", PaddingRandom, 0, 255, nil, false, false},
+		{"random fixed", PaddingRandom, 16, 16, nil, false, false},
+		{"random negative", PaddingRandom, -1, 10, nil, false, true},
+		{"random inverted", PaddingRandom, 10, 5, nil, false, true},
+		{"random too large", PaddingRandom, 0, maxPadding + 1, nil, false, true},
+		{"bucket", PaddingBucket, 0, 0, []int{4096, 512}, false, false},
+		{"bucket empty", PaddingBucket, 0, 0, nil, false, true},
+		{"bucket zero", PaddingBucket, 0, 0, []int{0}, false, true},
+		{"bucket too large", PaddingBucket, 0, 0, []int{maxPadding + 1}, false, true},
+		{"unknown", "zero", 0, 0, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPadding(tt.mode, tt.min, tt.max, tt.buckets)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPadding) {
+					t.Fatalf("got %v, want %v", err, ErrInvalidPadding)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (p == nil) != tt.wantNil {
+				t.Fatalf("padding %v, want nil %v", p, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestRandomPadding(t *testing.T) {
+	p, err := NewPadding(PaddingRandom, 8, 16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		n := p.Size(100)
+		if n < 8 || n > 16 {
+			t.Fatalf("size %d out of [8, 16]", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("random padding is constant")
+	}
+}
+
+func TestBucketPadding(t *testing.T) {
+	p, err := NewPadding(PaddingBucket, 0, 0, []int{4096, 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n, want int
+	}{
+		{1, 511},
+		{512, 0},
+		{513, 3583},
+		{4096, 0},
+		{4097, 4095},
+		{8192, 0},
+	}
+	for _, tt := range tests {
+		if got := p.Size(tt.n); got != tt.want {
+			t.Errorf("Size(%d) = %d, want %d", tt.n, got, tt.want)
+		}
+	}
+}
+
+// TestBucketFrameLength 填充后的帧长度只与桶大小相关, 与payload长度无关
+func TestBucketFrameLength(t *testing.T) {
+	padding, err := NewPadding(PaddingBucket, 0, 0, []int{512, 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cipher.Derive(cipher.AES256GCM, []byte("padding"), make([]byte, cipher.SaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := NewCodec(c)
+	codec.Negotiate(SupportedFeatures, Options{Padding: padding, Compressor: mustCompressor(t, compress.None)})
+	lengths := make(map[int]bool)
+	for _, n := range []int{0, 1, 100, 400, 509} {
+		data, err := codec.Encode(bytes.Repeat([]byte{'a'}, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lengths[len(data)] = true
+	}
+	if len(lengths) != 1 {
+		t.Fatalf("frame lengths %v, want one bucket", lengths)
+	}
+	// 没有协商填充能力时不填充
+	plain := NewCodec(c)
+	plain.Negotiate(SupportedFeatures&^FeaturePadding, Options{Padding: padding})
+	if plain.Padding != nil {
+		t.Fatal("padding enabled without negotiation")
+	}
+}
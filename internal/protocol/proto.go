@@ -3,29 +3,46 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
-	"github.com/sirupsen/logrus"
-	"github.com/xmapst/lightsocks/internal/cipher"
-	"github.com/xmapst/lightsocks/internal/compress"
-	"io"
-	"math/rand"
 )
 
 type Packet struct {
-	RandNu  int
+	Padding int // 去除的填充长度
+	Flags   Flag
 	Payload []byte
 }
 
+// Flag 帧标志位, 位于加密的body内, 用于标识该帧使用的能力
+type Flag uint8
+
+const (
+	// FlagPadded body内带有填充
+	FlagPadded Flag = 1 << iota
+	// FlagSnappy payload经过snappy压缩
+	FlagSnappy
+	// FlagFlate payload经过flate压缩
+	FlagFlate
+)
+
+func (f Flag) Has(flag Flag) bool {
+	return f&flag == flag
+}
+
 const (
 	payloadLen = uint32(4)
 	randLen    = uint32(2)
 	headerLen  = int(payloadLen + randLen)
+	flagsLen   = 1
+	padLenLen  = 2
 	maxByte    = 1 << 24
+	// MaxPayload 单个帧携带的最大数据长度, 更长的数据拆分为多个帧
+	MaxPayload = 1 << 15
 )
 
 var (
 	packetEndian        = binary.BigEndian
 	ErrIncompletePacket = errors.New("incomplete packet")
 	ErrTooLargePacket   = errors.New("too large packet")
+	ErrCorruptPacket    = errors.New("corrupt packet")
 )
 
 // Protocol format:
@@ -40,86 +57,8 @@ var (
 // * +                        +
 // * |         ... ...        |
 // * +-------------------------
-
-func random(i int) int {
-	n := i % (rand.Intn(99) + 1)
-	return n
-}
-
-func Encode(key, bin []byte) ([]byte, error) {
-	randNu := random(len(bin))
-	// 压缩
-	zipBin, err := compress.Zip(bin)
-	if err != nil {
-		return nil, err
-	}
-	// 加密
-	encryptBuff := cipher.Encrypt(zipBin, key)
-
-	msgLen := headerLen + len(encryptBuff)
-	buffer := make([]byte, uint32(msgLen))
-
-	// 添加头部信息
-	packetEndian.PutUint32(buffer, uint32(len(encryptBuff)))
-	packetEndian.PutUint16(buffer[payloadLen:], uint16(randNu))
-
-	// 拷贝数据
-	copy(buffer[headerLen:msgLen], encryptBuff)
-	return buffer[:msgLen], nil
-}
-
-func UnPack(key, buf []byte) (*Packet, error) {
-	if len(buf) < headerLen {
-		return nil, ErrIncompletePacket
-	}
-	bodyLen := packetEndian.Uint32(buf[:payloadLen])
-	randNu := packetEndian.Uint16(buf[payloadLen:headerLen])
-	msgLen := headerLen + int(bodyLen)
-	if len(buf) < msgLen {
-		return nil, ErrIncompletePacket
-	}
-	// 解密
-	decryptBuf := cipher.Decrypt(buf[headerLen:msgLen], key)
-	// 解压
-	unzipBuf, err := compress.Unzip(decryptBuf)
-	if err != nil {
-		logrus.Errorln(err)
-		return nil, err
-	}
-	packet := &Packet{
-		RandNu:  int(randNu),
-		Payload: unzipBuf,
-	}
-	return packet, nil
-}
-
-func ReadFull(key []byte, r io.Reader) (*Packet, error) {
-	preBuff := make([]byte, headerLen)
-	_, err := io.ReadFull(r, preBuff)
-	if err != nil {
-		return nil, err
-	}
-	bodyLen := packetEndian.Uint32(preBuff[:payloadLen])
-	randNu := packetEndian.Uint16(preBuff[payloadLen:headerLen])
-	if bodyLen > maxByte {
-		return nil, ErrTooLargePacket
-	}
-	buf := make([]byte, bodyLen)
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-	// 解密
-	decryptBuf := cipher.Decrypt(buf, key)
-	// 解压
-	unzipBuf, err := compress.Unzip(decryptBuf)
-	if err != nil {
-		logrus.Errorln(err)
-		return nil, err
-	}
-	packet := &Packet{
-		RandNu:  int(randNu),
-		Payload: unzipBuf,
-	}
-	return packet, nil
-}
+// *
+// * body: nonce | AEAD(flags | [pad len] | payload | [padding]) | tag
+// * header is authenticated as additional data, rand is random noise
+// * pad len and padding only present when flags has FlagPadded
+// * payload is compressed when flags has FlagSnappy or FlagFlate
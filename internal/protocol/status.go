@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Status 服务端连接目标的结果, 取值与SOCKS5应答码一致
+type Status uint8
+
+const (
+	StatusSucceeded Status = iota
+	StatusFailure
+	StatusNotAllowed
+	StatusNetworkUnreachable
+	StatusHostUnreachable
+	StatusConnectionRefused
+	StatusTTLExpired
+	StatusCommandNotSupported
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSucceeded:
+		return "succeeded"
+	case StatusNotAllowed:
+		return "connection not allowed"
+	case StatusNetworkUnreachable:
+		return "network unreachable"
+	case StatusHostUnreachable:
+		return "host unreachable"
+	case StatusConnectionRefused:
+		return "connection refused"
+	case StatusTTLExpired:
+		return "TTL expired"
+	case StatusCommandNotSupported:
+		return "command not supported"
+	default:
+		return "general failure"
+	}
+}
+
+// ErrAddrTooLong BIND应答的地址超过255字节, 无法编码
+var ErrAddrTooLong = errors.New("bind address too long")
+
+// StatusError 服务端返回的连接失败
+type StatusError struct {
+	Status Status
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("remote connect failed: %s", e.Status)
+}
+
+// StatusOf 将连接目标时的错误映射为连接结果
+func StatusOf(err error) Status {
+	var statusErr *StatusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return StatusSucceeded
+	case errors.As(err, &statusErr):
+		return statusErr.Status
+	case errors.Is(err, acl.ErrDenied):
+		return StatusNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return StatusConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return StatusNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr),
+		errors.Is(err, resolver.ErrIPNotFound):
+		return StatusHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return StatusTTLExpired
+	default:
+		return StatusFailure
+	}
+}
+
+// WriteStatus 服务端发送连接目标的结果
+func WriteStatus(w io.Writer, err error) error {
+	_, werr := w.Write([]byte{byte(StatusOf(err))})
+	return werr
+}
+
+// ReadStatus 客户端读取服务端连接目标的结果, 连接失败时返回 *StatusError
+func ReadStatus(r io.Reader) error {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return err
+	}
+	if s := Status(b[0]); s != StatusSucceeded {
+		return &StatusError{Status: s}
+	}
+	return nil
+}
+
+// WriteBindReply 服务端发送BIND请求的应答, 成功时携带地址
+// BIND请求有两次应答: 开始监听后携带监听地址, 对端连入后携带对端地址
+//
+// * 0        1          2
+// * +--------+----------+--------+
+// * | status | addr len |  addr  |
+// * +--------+----------+--------+
+// 地址过长时应答失败并返回 ErrAddrTooLong
+func WriteBindReply(w io.Writer, addr net.Addr, err error) error {
+	buf := []byte{byte(StatusOf(err))}
+	if err == nil {
+		s := addr.String()
+		if len(s) > 0xff {
+			_, werr := w.Write([]byte{byte(StatusFailure)})
+			if werr != nil {
+				return werr
+			}
+			return ErrAddrTooLong
+		}
+		buf = append(append(buf, byte(len(s))), s...)
+	}
+	_, werr := w.Write(buf)
+	return werr
+}
+
+// ReadBindReply 客户端读取BIND请求的应答, 失败时返回 *StatusError
+func ReadBindReply(r io.Reader) (string, error) {
+	err := ReadStatus(r)
+	if err != nil {
+		return "", err
+	}
+	var b [1]byte
+	_, err = io.ReadFull(r, b[:])
+	if err != nil {
+		return "", err
+	}
+	addr := make([]byte, b[0])
+	_, err = io.ReadFull(r, addr)
+	if err != nil {
+		return "", err
+	}
+	return string(addr), nil
+}
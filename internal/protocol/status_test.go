@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStatusOf(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Status
+	}{
+		{"nil", nil, StatusSucceeded},
+		{"status", fmt.Errorf("dial: %w", &StatusError{Status: StatusNetworkUnreachable}), StatusNetworkUnreachable},
+		{"acl", fmt.Errorf("%w: 10.0.0.1 in 10.0.0.0/8", acl.ErrDenied), StatusNotAllowed},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, StatusConnectionRefused},
+		{"network unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, StatusNetworkUnreachable},
+		{"host unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, StatusHostUnreachable},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}, StatusHostUnreachable},
+		{"no ip", fmt.Errorf("example.invalid: %w", resolver.ErrIPNotFound), StatusHostUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, StatusTTLExpired},
+		{"context timeout", context.DeadlineExceeded, StatusTTLExpired},
+		{"other", errors.New("boom"), StatusFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StatusOf(tt.err); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusOfDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	_, err = net.Dial("tcp", addr)
+	if got := StatusOf(err); got != StatusConnectionRefused {
+		t.Fatalf("dial %s: got %s (%v), want %s", addr, got, err, StatusConnectionRefused)
+	}
+}
+
+func TestStatusRoundTrip(t *testing.T) {
+	for _, want := range []Status{StatusSucceeded, StatusNotAllowed, StatusConnectionRefused, StatusTTLExpired, StatusFailure} {
+		var buf bytes.Buffer
+		var err error
+		if want != StatusSucceeded {
+			err = &StatusError{Status: want}
+		}
+		if werr := WriteStatus(&buf, err); werr != nil {
+			t.Fatal(werr)
+		}
+		got := ReadStatus(&buf)
+		if StatusOf(got) != want || (got == nil) != (want == StatusSucceeded) {
+			t.Fatalf("%s: got %v", want, got)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%s: %d bytes left", want, buf.Len())
+		}
+	}
+	if err := ReadStatus(bytes.NewReader(nil)); err == nil {
+		t.Fatal("empty reply: want error")
+	}
+}
+
+// rawAddr 任意字符串的地址
+type rawAddr string
+
+func (a rawAddr) Network() string {
+	return "tcp"
+}
+
+func (a rawAddr) String() string {
+	return string(a)
+}
+
+func TestBindReplyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		{"max length", rawAddr(strings.Repeat("a", 255))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			// 开始监听及对端连入的两次应答
+			for i := 0; i < 2; i++ {
+				if err := WriteBindReply(&buf, tt.addr, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				got, err := ReadBindReply(&buf)
+				if err != nil || got != tt.addr.String() {
+					t.Fatalf("reply %d: got %q, %v", i, got, err)
+				}
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("%d bytes left", buf.Len())
+			}
+		})
+	}
+}
+
+func TestBindReplyError(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteBindReply(&buf, nil, fmt.Errorf("%w: port 22", acl.ErrDenied))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadBindReply(&buf)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != StatusNotAllowed {
+		t.Fatalf("got %v, want %s", err, StatusNotAllowed)
+	}
+
+	// 超过255字节的地址不截断, 应答失败
+	buf.Reset()
+	err = WriteBindReply(&buf, rawAddr(strings.Repeat("a", 256)), nil)
+	if !errors.Is(err, ErrAddrTooLong) {
+		t.Fatalf("long address: got %v, want %v", err, ErrAddrTooLong)
+	}
+	_, err = ReadBindReply(&buf)
+	if !errors.As(err, &statusErr) || statusErr.Status != StatusFailure {
+		t.Fatalf("long address reply: got %v, want %s", err, StatusFailure)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("long address: %d bytes left", buf.Len())
+	}
+}
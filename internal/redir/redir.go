@@ -0,0 +1,175 @@
+package redir
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/tunnel"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ModeRedirect = "redirect"
+	ModeTProxy   = "tproxy"
+)
+
+var (
+	ErrUnsupported = errors.New("transparent proxy is only supported on linux")
+	ErrLoop        = errors.New("destination is the transparent proxy itself")
+)
+
+// Listener 透明代理入口, 取出连接的原始目标后交给 tunnel 转发
+type Listener struct {
+	tcp  net.Listener
+	typ  constant.Type
+	wg   *sync.WaitGroup
+	conf *conf.Config
+}
+
+func New() *Listener {
+	return &Listener{
+		wg:   new(sync.WaitGroup),
+		conf: conf.App,
+	}
+}
+
+func (l *Listener) RawAddress() string {
+	return fmt.Sprintf("%s:%d", l.conf.Redir.Host, l.conf.Redir.Port)
+}
+
+// ListenAndServe 开始监听, 在后台接受连接
+func (l *Listener) ListenAndServe() (err error) {
+	switch l.conf.Redir.Mode {
+	case ModeRedirect:
+		l.typ = constant.REDIR
+		l.tcp, err = net.Listen("tcp", l.RawAddress())
+	case ModeTProxy:
+		l.typ = constant.TPROXY
+		l.tcp, err = listenTProxy(l.RawAddress())
+	default:
+		err = fmt.Errorf("unknown transparent proxy mode %q", l.conf.Redir.Mode)
+	}
+	if err != nil {
+		logrus.Errorln(err)
+		return err
+	}
+	logrus.Infoln("Transparent Proxy Listening At:", l.conf.Redir.Mode, l.tcp.Addr().String())
+	go l.serve(tunnel.TCPIn.In)
+	return nil
+}
+
+func (l *Listener) serve(tcpIn chan<- *constant.TCPContext) {
+	for {
+		conn, err := l.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		clientIP := conn.RemoteAddr().String()
+		if !auth.VerifyIP(clientIP) {
+			logrus.Warningln(clientIP, "access denied, not in allowed address group")
+			_ = conn.Close()
+			continue
+		}
+		l.wg.Add(1)
+		go l.handle(conn, tcpIn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn, tcpIn chan<- *constant.TCPContext) {
+	id, _ := uuid.NewV4()
+	dest, err := l.destination(conn)
+	if err != nil {
+		logrus.Errorln(id, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		l.wg.Done()
+		return
+	}
+	host, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	_port, _ := strconv.ParseInt(port, 10, 64)
+	tcpIn <- &constant.TCPContext{
+		Conn: conn,
+		Metadata: &constant.Metadata{
+			ID:      id,
+			NetWork: constant.TCP,
+			Type:    l.typ,
+			Src: constant.IP{
+				Addr: host,
+				Port: _port,
+			},
+			Dest: constant.IP{
+				Addr: dest.IP.String(),
+				Port: int64(dest.Port),
+			},
+		},
+		PostFn: func() {
+			l.wg.Done()
+		},
+	}
+}
+
+// destination 连接的原始目标, REDIRECT从conntrack中取出, TPROXY为连接的本地地址
+func (l *Listener) destination(conn net.Conn) (*net.TCPAddr, error) {
+	var dest *net.TCPAddr
+	if l.typ == constant.TPROXY {
+		dest, _ = conn.LocalAddr().(*net.TCPAddr)
+	} else {
+		var err error
+		dest, err = originalDst(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dest == nil {
+		return nil, errors.New("unknown original destination")
+	}
+	// 未经重定向直接连入的连接, 原始目标就是监听地址
+	self, _ := l.tcp.Addr().(*net.TCPAddr)
+	if self != nil && dest.Port == self.Port && (dest.IP.Equal(self.IP) || isLocal(dest.IP)) {
+		return nil, ErrLoop
+	}
+	return dest, nil
+}
+
+// isLocal ip是否为本机地址
+func isLocal(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Listener) ShutdownWithTimeout(timeout time.Duration) error {
+	if l.tcp != nil {
+		_ = l.tcp.Close()
+	}
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		l.wg.Wait()
+	}()
+	select {
+	case <-time.After(timeout):
+		return errors.New("transparent proxy shutdown timeout")
+	case <-c:
+		return nil
+	}
+}
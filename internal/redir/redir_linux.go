@@ -0,0 +1,86 @@
+//go:build linux
+
+package redir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST, linux/netfilter_ipv4.h
+	ip6tOriginalDst = 80 // IP6T_SO_ORIGINAL_DST, linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent = 75 // IPV6_TRANSPARENT, linux/in6.h
+)
+
+// originalDst 读取被iptables REDIRECT的连接的原始目标
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	rc, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var addr *net.TCPAddr
+	var sysErr error
+	err = rc.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			// 内核写入sockaddr_in6, 长度不超过IPv6MTUInfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tOriginalDst)
+			if err != nil {
+				sysErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+			return
+		}
+		// 内核写入sockaddr_in, 长度不超过IPv6Mreq
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err != nil {
+			sysErr = err
+			return
+		}
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+			Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sysErr != nil {
+		return nil, fmt.Errorf("get original destination: %w", sysErr)
+	}
+	return addr, nil
+}
+
+// listenTProxy 监听设置了IP_TRANSPARENT的套接字, 接受被iptables TPROXY的连接
+func listenTProxy(address string) (net.Listener, error) {
+	lc := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sysErr error
+			err := c.Control(func(fd uintptr) {
+				sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if sysErr == nil && network == "tcp6" {
+					sysErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sysErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
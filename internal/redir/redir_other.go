@@ -0,0 +1,15 @@
+//go:build !linux
+
+package redir
+
+import (
+	"net"
+)
+
+func originalDst(net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrUnsupported
+}
+
+func listenTProxy(string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,187 @@
+package redir
+
+import (
+	"errors"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tproxyListener 接受的连接以dest为本地地址, 与iptables TPROXY到达的连接相同
+type tproxyListener struct {
+	net.Listener
+	dest *net.TCPAddr
+}
+
+func (l *tproxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tproxyConn{Conn: conn, dest: l.dest}, nil
+}
+
+type tproxyConn struct {
+	net.Conn
+	dest *net.TCPAddr
+}
+
+func (c *tproxyConn) LocalAddr() net.Addr {
+	return c.dest
+}
+
+// withConfig 测试期间替换全局配置
+func withConfig(t *testing.T, c *conf.Config) {
+	app := conf.App
+	conf.App = c
+	t.Cleanup(func() {
+		conf.App = app
+	})
+}
+
+// serve 在回环地址上运行透明代理入口, wrap非nil时包装监听, 返回交给tunnel的连接
+func serve(t *testing.T, wrap func(net.Listener) net.Listener) (*Listener, <-chan *constant.TCPContext) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{
+		tcp:  ln,
+		typ:  constant.REDIR,
+		wg:   new(sync.WaitGroup),
+		conf: conf.App,
+	}
+	if conf.App.Redir.Mode == ModeTProxy {
+		l.typ = constant.TPROXY
+	}
+	if wrap != nil {
+		l.tcp = wrap(ln)
+	}
+	t.Cleanup(func() {
+		_ = l.ShutdownWithTimeout(time.Second)
+	})
+	tcpIn := make(chan *constant.TCPContext, 1)
+	go l.serve(tcpIn)
+	return l, tcpIn
+}
+
+func dial(t *testing.T, l *Listener) net.Conn {
+	conn, err := net.Dial("tcp", l.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// expectRejected 连接被关闭且没有交给tunnel
+func expectRejected(t *testing.T, conn net.Conn, tcpIn <-chan *constant.TCPContext) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	select {
+	case ctx := <-tcpIn:
+		t.Fatalf("rejected connection forwarded to %v", ctx.Metadata.Dest)
+	default:
+	}
+}
+
+func TestTProxyDestination(t *testing.T) {
+	dest := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 443}
+	withConfig(t, &conf.Config{Redir: conf.Redir{Mode: ModeTProxy}})
+	l, tcpIn := serve(t, func(ln net.Listener) net.Listener {
+		return &tproxyListener{Listener: ln, dest: dest}
+	})
+	conn := dial(t, l)
+
+	var ctx *constant.TCPContext
+	select {
+	case ctx = <-tcpIn:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not forwarded")
+	}
+	m := ctx.Metadata
+	if m.Type != constant.TPROXY || m.NetWork != constant.TCP {
+		t.Fatalf("type: got %v/%v", m.Type, m.NetWork)
+	}
+	if m.Dest.Addr != "203.0.113.5" || m.Dest.Port != 443 {
+		t.Fatalf("dest: got %v, want %v", m.Dest, dest)
+	}
+	src := conn.LocalAddr().(*net.TCPAddr)
+	if m.Src.Addr != src.IP.String() || m.Src.Port != int64(src.Port) {
+		t.Fatalf("src: got %v, want %v", m.Src, src)
+	}
+
+	// 交给tunnel的连接即客户端的连接
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(ctx.Conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatalf("read: %q %v", buf, err)
+	}
+
+	// 转发结束前关闭等待连接处理完成
+	err = l.ShutdownWithTimeout(50 * time.Millisecond)
+	if err == nil {
+		t.Fatal("shutdown did not wait for the connection")
+	}
+	_ = ctx.Conn.Close()
+	ctx.PostFn()
+	err = l.ShutdownWithTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTProxyLoop(t *testing.T) {
+	// 未经TPROXY直接连入监听地址的连接
+	withConfig(t, &conf.Config{Redir: conf.Redir{Mode: ModeTProxy}})
+	l, tcpIn := serve(t, nil)
+	conn := dial(t, l)
+	expectRejected(t, conn, tcpIn)
+
+	dest, err := l.destination(&tproxyConn{dest: l.tcp.Addr().(*net.TCPAddr)})
+	if !errors.Is(err, ErrLoop) {
+		t.Fatalf("got %v %v, want %v", dest, err, ErrLoop)
+	}
+}
+
+func TestRedirectWithoutOriginalDst(t *testing.T) {
+	// 未经REDIRECT的连接没有原始目标, 或原始目标为监听地址本身
+	withConfig(t, &conf.Config{Redir: conf.Redir{Mode: ModeRedirect}})
+	l, tcpIn := serve(t, nil)
+	conn := dial(t, l)
+	expectRejected(t, conn, tcpIn)
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	_, err := originalDst(s)
+	if err == nil {
+		t.Fatal("original destination of a non tcp connection")
+	}
+}
+
+func TestDeniedSource(t *testing.T) {
+	withConfig(t, &conf.Config{
+		CIDR:  []string{"10.0.0.0/8"},
+		Redir: conf.Redir{Mode: ModeTProxy},
+	})
+	l, tcpIn := serve(t, func(ln net.Listener) net.Listener {
+		return &tproxyListener{Listener: ln, dest: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 443}}
+	})
+	conn := dial(t, l)
+	expectRejected(t, conn, tcpIn)
+}
@@ -0,0 +1,101 @@
+package reverse
+
+import (
+	"errors"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/tunnel"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Start 客户端模式下注册配置的反向隧道
+func Start() {
+	if len(conf.App.Reverse.Tunnels) == 0 {
+		return
+	}
+	if conf.App.Mode != conf.ClientMode {
+		logrus.Warningln("reverse tunnels require a server, ignored")
+		return
+	}
+	for _, t := range conf.App.Reverse.Tunnels {
+		go keep(t, tunnel.TCPIn.In)
+	}
+}
+
+// keep 保持反向隧道的注册, 连接断开后重新注册, 服务端拒绝时停止
+func keep(t conf.ReverseTunnel, tcpIn chan<- *constant.TCPContext) {
+	backoff := minBackoff
+	for {
+		registered, err := serve(t, tcpIn)
+		if registered {
+			backoff = minBackoff
+		}
+		if protocol.StatusOf(err) == protocol.StatusNotAllowed || errors.Is(err, tunnel.ErrReverseUnsupported) {
+			logrus.Errorln("reverse tunnel", t.Remote, "-->", t.Local, err)
+			return
+		}
+		logrus.Warningln("reverse tunnel", t.Remote, "-->", t.Local, err, "retry in", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// serve 注册反向隧道, 服务端打开的每个流交给 tunnel 转发到Local, 直到隧道连接关闭
+func serve(t conf.ReverseTunnel, tcpIn chan<- *constant.TCPContext) (bool, error) {
+	conn, bind, err := tunnel.DialReverse(t.Remote)
+	if err != nil {
+		return false, err
+	}
+	logrus.Infoln("reverse tunnel registered", bind, "-->", t.Local)
+	muxSess := mux.Server(conn, conf.App.MuxConfig())
+	defer func() {
+		_ = muxSess.Close()
+	}()
+	dest := func() constant.IP {
+		host, port, _ := net.SplitHostPort(t.Local)
+		_port, _ := strconv.ParseInt(port, 10, 64)
+		return constant.IP{
+			Addr: host,
+			Port: _port,
+		}
+	}()
+	for {
+		stream, err := muxSess.Accept()
+		if err != nil {
+			return true, err
+		}
+		id, _ := uuid.NewV4()
+		host, port, _ := net.SplitHostPort(stream.Target())
+		_port, _ := strconv.ParseInt(port, 10, 64)
+		tcpIn <- &constant.TCPContext{
+			Conn: stream,
+			Metadata: &constant.Metadata{
+				ID:      id,
+				NetWork: constant.TCP,
+				Type:    constant.REVERSE,
+				Src: constant.IP{
+					Addr: host,
+					Port: _port,
+				},
+				Dest: dest,
+			},
+			DialFn: func() (net.Conn, error) {
+				// Local由客户端直接连接
+				return net.DialTimeout("tcp", t.Local, conf.App.Timeout)
+			},
+		}
+	}
+}
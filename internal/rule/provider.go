@@ -0,0 +1,201 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 规则集文件格式
+const (
+	FormatText = "text" // 每行一个条目, # 开头为注释
+	FormatYAML = "yaml" // payload 列表, 与clash的rule-provider文件相同
+)
+
+var ErrInvalidRuleSet = errors.New("invalid rule set")
+
+// Provider 从文件加载的规则集, 文件修改及定期重新加载, 加载失败时保留之前的内容
+type Provider struct {
+	Name     string
+	Path     string
+	Format   string
+	Behavior string
+
+	set     atomic.Pointer[ruleSet]
+	watcher *fsnotify.Watcher
+	cron    *cron.Cron
+}
+
+// NewProvider 加载规则集文件并开始监听修改, format为空时按扩展名判断, behavior为空时为mixed, interval大于0时定期重新加载
+func NewProvider(name, path, format, behavior string, interval time.Duration) (*Provider, error) {
+	if name == "" || path == "" {
+		return nil, fmt.Errorf("%w: name and path are required", ErrInvalidRuleSet)
+	}
+	if format == "" {
+		format = FormatText
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			format = FormatYAML
+		}
+	}
+	if format != FormatText && format != FormatYAML {
+		return nil, fmt.Errorf("%w: %s: unknown format %s", ErrInvalidRuleSet, name, format)
+	}
+	behavior = strings.ToLower(behavior)
+	switch behavior {
+	case "":
+		behavior = BehaviorMixed
+	case BehaviorMixed, BehaviorDomain, BehaviorIPCIDR, BehaviorClassical:
+	default:
+		return nil, fmt.Errorf("%w: %s: unknown behavior %s", ErrInvalidRuleSet, name, behavior)
+	}
+	p := &Provider{
+		Name:     name,
+		Path:     filepath.Clean(path),
+		Format:   format,
+		Behavior: behavior,
+	}
+	err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	p.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// 监听所在目录, 编辑器保存时可能替换文件
+	err = p.watcher.Add(filepath.Dir(p.Path))
+	if err != nil {
+		_ = p.watcher.Close()
+		return nil, err
+	}
+	go p.watch()
+	if interval > 0 {
+		p.cron = cron.New()
+		_, err = p.cron.AddFunc(fmt.Sprintf("@every %s", interval), p.reload)
+		if err != nil {
+			_ = p.watcher.Close()
+			return nil, err
+		}
+		p.cron.Start()
+	}
+	return p, nil
+}
+
+// Close 停止重新加载, 已加载的内容仍可使用
+func (p *Provider) Close() {
+	_ = p.watcher.Close()
+	if p.cron != nil {
+		p.cron.Stop()
+	}
+}
+
+func (p *Provider) match(m *constant.Metadata, ip *lazyIP) bool {
+	return p.set.Load().match(m, ip)
+}
+
+func (p *Provider) watch() {
+	for {
+		select {
+		case e, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) != p.Path || !e.Has(fsnotify.Write) && !e.Has(fsnotify.Create) {
+				continue
+			}
+			logrus.Infoln(p.Path, "rule set modified")
+			p.reload()
+		case err, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Warningln(p.Path, err)
+		}
+	}
+}
+
+func (p *Provider) reload() {
+	err := p.load()
+	if err != nil {
+		logrus.Warningln(err)
+	}
+}
+
+func (p *Provider) load() error {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidRuleSet, p.Name, err)
+	}
+	var entries []string
+	switch p.Format {
+	case FormatYAML:
+		entries, err = parseYAML(data)
+	default:
+		entries, err = parseText(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidRuleSet, p.Name, err)
+	}
+	set := newRuleSet()
+	var skipped int
+	for _, entry := range entries {
+		err = set.add(p.Behavior, entry)
+		if err != nil {
+			// 跳过无效及不支持的条目, 如clash规则集中其他类型的规则
+			if skipped == 0 {
+				logrus.Warningln(p.Path, "rule set", p.Name, err)
+			}
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		logrus.Warningln(p.Path, "rule set", p.Name, "skipped", skipped, "invalid entries")
+	}
+	p.set.Store(set)
+	logrus.Infoln(p.Path, "rule set", p.Name, "loaded", "domains", set.domains.size,
+		"cidrs", set.cidrs.size+set.ipCIDRs.size, "rules", len(set.rules))
+	return nil
+}
+
+func parseText(data []byte) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
+
+func parseYAML(data []byte) ([]string, error) {
+	var v struct {
+		Payload []string `yaml:"payload"`
+	}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, entry := range v.Payload {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,250 @@
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"net"
+	"strings"
+)
+
+// 内置的动作, 其他动作为 Upstreams 中的名称
+const (
+	Direct = "DIRECT"
+	Proxy  = "PROXY"
+	Reject = "REJECT"
+)
+
+// 规则类型
+const (
+	TypeDomain        = "DOMAIN"
+	TypeDomainSuffix  = "DOMAIN-SUFFIX"
+	TypeDomainKeyword = "DOMAIN-KEYWORD"
+	TypeIPCIDR        = "IP-CIDR"
+	TypeIPCIDR6       = "IP-CIDR6" // 与 IP-CIDR 相同, 兼容clash
+	TypeDstPort       = "DST-PORT"
+	TypeSrcIPCIDR     = "SRC-IP-CIDR"
+	TypeUser          = "USER"
+	TypeInbound       = "INBOUND"
+	TypeRuleSet       = "RULE-SET"
+	TypeMatch         = "MATCH"
+)
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+// Rule 一条路由规则, 格式为 类型,条件,动作[,no-resolve], MATCH 没有条件
+// IP-CIDR 及 RULE-SET 中的网段在目标为域名时会先在本地解析, 带 no-resolve 时不解析, 只匹配ip目标
+type Rule struct {
+	Type    string
+	Payload string
+	Target  string
+	match   func(m *constant.Metadata, ip *lazyIP) bool
+}
+
+func (r *Rule) String() string {
+	if r.Type == TypeMatch {
+		return r.Type
+	}
+	return r.Type + "," + r.Payload
+}
+
+// Router 按顺序匹配的路由规则
+type Router struct {
+	rules     []*Rule
+	providers []*Provider
+}
+
+// New 解析路由规则, upstreams为可用作动作的服务端名称, providers为 RULE-SET 可引用的规则集
+func New(lines []string, upstreams []string, providers []*Provider) (*Router, error) {
+	targets := map[string]bool{Direct: true, Proxy: true, Reject: true}
+	for _, name := range upstreams {
+		targets[name] = true
+	}
+	sets := make(map[string]*Provider)
+	for _, p := range providers {
+		if _, ok := sets[p.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate rule set %s", ErrInvalidRule, p.Name)
+		}
+		sets[p.Name] = p
+	}
+	r := &Router{providers: providers}
+	for _, line := range lines {
+		rule, err := parse(line, sets)
+		if err != nil {
+			return nil, err
+		}
+		if !targets[rule.Target] {
+			return nil, fmt.Errorf("%w: %q: unknown target %s", ErrInvalidRule, line, rule.Target)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Close 停止重新加载引用的规则集
+func (r *Router) Close() {
+	if r == nil {
+		return
+	}
+	for _, p := range r.providers {
+		p.Close()
+	}
+}
+
+// Match 返回第一条匹配的规则, 没有匹配时返回nil
+func (r *Router) Match(m *constant.Metadata) *Rule {
+	if r == nil {
+		return nil
+	}
+	ip := &lazyIP{host: m.Dest.Addr}
+	for _, rule := range r.rules {
+		if rule.match(m, ip) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func parse(line string, sets map[string]*Provider) (*Rule, error) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	rule := &Rule{Type: strings.ToUpper(fields[0])}
+	if rule.Type == TypeMatch {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRule, line)
+		}
+		rule.Target = fields[1]
+		rule.match = func(*constant.Metadata, *lazyIP) bool {
+			return true
+		}
+		return rule, nil
+	}
+	if len(fields) < 3 || len(fields) > 4 || fields[1] == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRule, line)
+	}
+	rule.Payload, rule.Target = fields[1], fields[2]
+	var err error
+	rule.match, err = matcher(rule.Type, rule.Payload, sets)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", ErrInvalidRule, line, err)
+	}
+	if len(fields) == 4 {
+		if !strings.EqualFold(fields[3], noResolve) {
+			return nil, fmt.Errorf("%w: %q: unknown option %s", ErrInvalidRule, line, fields[3])
+		}
+		switch rule.Type {
+		case TypeIPCIDR, TypeIPCIDR6, TypeRuleSet:
+		default:
+			return nil, fmt.Errorf("%w: %q: %s does not support %s", ErrInvalidRule, line, rule.Type, noResolve)
+		}
+		// 目标为域名时不在本地解析, 只匹配ip目标
+		match := rule.match
+		rule.match = func(m *constant.Metadata, ip *lazyIP) bool {
+			return match(m, ip.literal())
+		}
+	}
+	return rule, nil
+}
+
+func matcher(typ, payload string, sets map[string]*Provider) (func(m *constant.Metadata, ip *lazyIP) bool, error) {
+	switch typ {
+	case TypeDomain:
+		payload = normalize(payload)
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			return isDomain(m.Dest.Addr) && normalize(m.Dest.Addr) == payload
+		}, nil
+	case TypeDomainSuffix:
+		payload = normalize(payload)
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			if !isDomain(m.Dest.Addr) {
+				return false
+			}
+			host := normalize(m.Dest.Addr)
+			return host == payload || strings.HasSuffix(host, "."+payload)
+		}, nil
+	case TypeDomainKeyword:
+		payload = normalize(payload)
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			return isDomain(m.Dest.Addr) && strings.Contains(normalize(m.Dest.Addr), payload)
+		}, nil
+	case TypeIPCIDR, TypeIPCIDR6:
+		n, err := acl.ParseCIDR(payload)
+		if err != nil {
+			return nil, err
+		}
+		return func(_ *constant.Metadata, ip *lazyIP) bool {
+			return n.Contains(ip.get())
+		}, nil
+	case TypeSrcIPCIDR:
+		n, err := acl.ParseCIDR(payload)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			src := net.ParseIP(m.Src.Addr)
+			return src != nil && n.Contains(src)
+		}, nil
+	case TypeDstPort:
+		min, max, err := acl.ParsePorts(payload)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			return m.Dest.Port >= min && m.Dest.Port <= max
+		}, nil
+	case TypeUser:
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			return m.User == payload
+		}, nil
+	case TypeInbound:
+		return func(m *constant.Metadata, _ *lazyIP) bool {
+			return strings.EqualFold(m.Type.String(), payload)
+		}, nil
+	case TypeRuleSet:
+		p, ok := sets[payload]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule set %s", payload)
+		}
+		return func(m *constant.Metadata, ip *lazyIP) bool {
+			return p.match(m, ip)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+}
+
+// lazyIP 目标地址的ip, 域名在第一次用到时解析, 解析失败时为nil
+type lazyIP struct {
+	host     string
+	ip       net.IP
+	resolved bool
+}
+
+func (l *lazyIP) get() net.IP {
+	if !l.resolved {
+		l.resolved = true
+		if ip := net.ParseIP(l.host); ip != nil {
+			l.ip = ip
+		} else if ip, err := resolver.ResolveIP(l.host); err == nil {
+			l.ip = ip
+		}
+	}
+	return l.ip
+}
+
+// literal 不解析域名的ip, 目标为域名时为nil
+func (l *lazyIP) literal() *lazyIP {
+	return &lazyIP{host: l.host, ip: net.ParseIP(l.host), resolved: true}
+}
+
+func isDomain(host string) bool {
+	return host != "" && net.ParseIP(host) == nil
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
@@ -0,0 +1,219 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failResolver 所有域名都解析失败, 避免测试访问网络
+type failResolver struct {
+	resolver.Resolver
+}
+
+func (failResolver) LookupIP(context.Context, string) ([]net.IP, error) {
+	return nil, resolver.ErrIPNotFound
+}
+
+func withoutDNS(t *testing.T) {
+	old := resolver.DefaultResolver
+	resolver.DefaultResolver = failResolver{}
+	t.Cleanup(func() {
+		resolver.DefaultResolver = old
+	})
+}
+
+// staticResolver 所有域名都解析为固定的ip
+type staticResolver struct {
+	resolver.Resolver
+	ip net.IP
+}
+
+func (r staticResolver) LookupIP(context.Context, string) ([]net.IP, error) {
+	return []net.IP{r.ip}, nil
+}
+
+func withResolved(t *testing.T, ip string) {
+	old := resolver.DefaultResolver
+	resolver.DefaultResolver = staticResolver{ip: net.ParseIP(ip)}
+	t.Cleanup(func() {
+		resolver.DefaultResolver = old
+	})
+}
+
+// noLookup 测试中不应解析任何域名
+type noLookup struct {
+	resolver.Resolver
+	t *testing.T
+}
+
+func (r noLookup) LookupIP(_ context.Context, host string) ([]net.IP, error) {
+	r.t.Errorf("unexpected lookup of %s", host)
+	return nil, resolver.ErrIPNotFound
+}
+
+func withoutLookup(t *testing.T) {
+	old := resolver.DefaultResolver
+	resolver.DefaultResolver = noLookup{t: t}
+	t.Cleanup(func() {
+		resolver.DefaultResolver = old
+	})
+}
+
+func mustRouter(t *testing.T, lines ...string) *Router {
+	t.Helper()
+	r, err := New(lines, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRouterUserInbound(t *testing.T) {
+	r := mustRouter(t,
+		"USER,admin,REJECT",
+		"INBOUND,socks5,DIRECT",
+		"INBOUND,HTTPS,DIRECT",
+		"MATCH,PROXY",
+	)
+	tests := []struct {
+		name string
+		typ  constant.Type
+		user string
+		want string
+	}{
+		{"socks5 user", constant.SOCKS5, "admin", "USER,admin"},
+		{"socks5 other user", constant.SOCKS5, "bob", "INBOUND,socks5"},
+		{"socks5 anonymous", constant.SOCKS5, "", "INBOUND,socks5"},
+		{"http connect user", constant.HTTPCONNECT, "admin", "USER,admin"},
+		{"http connect", constant.HTTPCONNECT, "bob", "INBOUND,HTTPS"},
+		{"http user", constant.HTTP, "admin", "USER,admin"},
+		{"http", constant.HTTP, "bob", "MATCH"},
+		{"user case sensitive", constant.HTTP, "Admin", "MATCH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &constant.Metadata{
+				Type: tt.typ,
+				User: tt.user,
+				Dest: constant.IP{Addr: "example.com", Port: 443},
+			}
+			got := r.Match(m)
+			if got == nil || got.String() != tt.want {
+				t.Fatalf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	withoutDNS(t)
+	r := mustRouter(t,
+		"DOMAIN,exact.example.com,DIRECT",
+		"DOMAIN-SUFFIX,example.com,PROXY",
+		"DOMAIN-KEYWORD,google,PROXY",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"SRC-IP-CIDR,192.168.1.0/24,REJECT",
+		"DST-PORT,8000-9000,REJECT",
+	)
+	tests := []struct {
+		dest string
+		port int64
+		src  string
+		want string
+	}{
+		{"exact.example.com", 443, "", "DOMAIN,exact.example.com"},
+		{"EXACT.example.com.", 443, "", "DOMAIN,exact.example.com"},
+		{"example.com", 443, "", "DOMAIN-SUFFIX,example.com"},
+		{"a.b.example.com", 443, "", "DOMAIN-SUFFIX,example.com"},
+		{"notexample.com", 443, "", ""},
+		{"www.google.co.jp", 443, "", "DOMAIN-KEYWORD,google"},
+		{"10.1.2.3", 443, "", "IP-CIDR,10.0.0.0/8"},
+		{"11.1.2.3", 443, "192.168.1.7", "SRC-IP-CIDR,192.168.1.0/24"},
+		{"11.1.2.3", 8080, "", "DST-PORT,8000-9000"},
+		{"11.1.2.3", 443, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dest, func(t *testing.T) {
+			got := r.Match(&constant.Metadata{
+				Src:  constant.IP{Addr: tt.src},
+				Dest: constant.IP{Addr: tt.dest, Port: tt.port},
+			})
+			if got == nil && tt.want != "" || got != nil && got.String() != tt.want {
+				t.Fatalf("got %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterInvalid(t *testing.T) {
+	tests := []string{
+		"DOMAIN,example.com",
+		"DOMAIN,,DIRECT",
+		"MATCH",
+		"UNKNOWN,x,DIRECT",
+		"DOMAIN,example.com,NOWHERE",
+		"IP-CIDR,10.0.0.0/33,DIRECT",
+		"DST-PORT,9000-8000,DIRECT",
+		"RULE-SET,missing,DIRECT",
+		"DOMAIN,example.com,DIRECT,no-resolve",
+		"IP-CIDR,10.0.0.0/8,DIRECT,resolve",
+		"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve,extra",
+	}
+	for _, line := range tests {
+		if _, err := New([]string{line}, nil, nil); !errors.Is(err, ErrInvalidRule) {
+			t.Fatalf("%q: got %v, want %v", line, err, ErrInvalidRule)
+		}
+	}
+}
+
+func TestRouterNoResolve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cidr.txt")
+	err := os.WriteFile(path, []byte("172.16.0.0/12\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProvider("cidr", path, "", BehaviorIPCIDR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	r, err := New([]string{
+		"IP-CIDR,10.0.0.0/8,DIRECT,no-resolve",
+		"IP-CIDR6,2001:db8::/32,DIRECT,NO-RESOLVE",
+		"RULE-SET,cidr,REJECT,no-resolve",
+	}, nil, []*Provider{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 目标为域名时不解析
+	withoutLookup(t)
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"example.com", ""},
+		{"10.1.1.1", "IP-CIDR,10.0.0.0/8"},
+		{"2001:db8::1", "IP-CIDR6,2001:db8::/32"},
+		{"172.16.1.1", "RULE-SET,cidr"},
+		{"192.0.2.1", ""},
+	}
+	for _, tt := range tests {
+		got := r.Match(&constant.Metadata{Dest: constant.IP{Addr: tt.dest, Port: 443}})
+		if got == nil && tt.want != "" || got != nil && got.String() != tt.want {
+			t.Errorf("%s: got %v, want %q", tt.dest, got, tt.want)
+		}
+	}
+
+	// 没有 no-resolve 时解析域名后匹配
+	withResolved(t, "10.2.2.2")
+	r = mustRouter(t, "IP-CIDR,10.0.0.0/8,DIRECT")
+	if got := r.Match(&constant.Metadata{Dest: constant.IP{Addr: "example.com", Port: 443}}); got == nil {
+		t.Fatal("resolved domain did not match")
+	}
+}
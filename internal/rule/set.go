@@ -0,0 +1,327 @@
+package rule
+
+import (
+	"fmt"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"net"
+	"strings"
+)
+
+// 规则集条目的解析方式, 与clash的rule-provider behavior一致, mixed为ip、网段或域名的列表
+const (
+	BehaviorMixed     = "mixed"
+	BehaviorDomain    = "domain"
+	BehaviorIPCIDR    = "ipcidr"
+	BehaviorClassical = "classical"
+)
+
+// noResolve IP-CIDR 及 RULE-SET 规则的参数, 目标为域名时不解析, 不匹配网段
+const noResolve = "no-resolve"
+
+// domainTrie 按标签倒序存储的域名树, 条目语法与clash一致:
+// example.com 只匹配该域名, +.example.com 匹配该域名及其子域名,
+// .example.com 只匹配子域名, * 匹配任意一个标签
+type domainTrie struct {
+	root *domainNode
+	size int
+}
+
+type domainNode struct {
+	children map[string]*domainNode
+	exact    bool // 匹配到该节点的域名
+	sub      bool // 匹配该节点的所有子域名
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &domainNode{}}
+}
+
+// insert 添加一个clash语法的域名条目, 格式错误时返回false
+func (t *domainTrie) insert(entry string) bool {
+	exact, sub := true, false
+	if s, ok := strings.CutPrefix(entry, "+."); ok {
+		entry, sub = s, true
+	} else if s, ok = strings.CutPrefix(entry, "."); ok {
+		entry, exact, sub = s, false, true
+	}
+	entry = normalize(entry)
+	if entry == "" {
+		return false
+	}
+	labels := strings.Split(entry, ".")
+	for _, label := range labels {
+		if label == "" {
+			return false
+		}
+	}
+	t.add(labels, exact, sub)
+	return true
+}
+
+// add 添加按顺序排列的标签, exact匹配该域名, sub匹配其子域名
+func (t *domainTrie) add(labels []string, exact, sub bool) {
+	node := t.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.sub {
+			// 已被更短的后缀覆盖
+			return
+		}
+		if node.children == nil {
+			node.children = make(map[string]*domainNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if !node.exact && !node.sub {
+		t.size++
+	}
+	node.exact = node.exact || exact
+	if sub && !node.sub {
+		node.sub = true
+		// 子域名都已匹配, 删除其下的条目
+		for _, child := range node.children {
+			t.size -= child.count()
+		}
+		node.children = nil
+	}
+}
+
+// count 以该节点为根的子树中的条目数
+func (n *domainNode) count() int {
+	var c int
+	if n.exact || n.sub {
+		c++
+	}
+	for _, child := range n.children {
+		c += child.count()
+	}
+	return c
+}
+
+func (t *domainTrie) match(domain string) bool {
+	domain = normalize(domain)
+	if domain == "" {
+		return false
+	}
+	return t.root.match(strings.Split(domain, "."))
+}
+
+// match labels为尚未匹配的标签, 从最后一个开始匹配
+func (n *domainNode) match(labels []string) bool {
+	if len(labels) == 0 {
+		return n.exact
+	}
+	if n.sub {
+		return true
+	}
+	last, rest := labels[len(labels)-1], labels[:len(labels)-1]
+	if child := n.children[last]; child != nil && child.match(rest) {
+		return true
+	}
+	if child := n.children["*"]; child != nil && child.match(rest) {
+		return true
+	}
+	return false
+}
+
+// cidrTree 按位存储网段前缀的二叉树, ipv4与ipv6分开存储, ipv4映射的ipv6地址按ipv4匹配
+type cidrTree struct {
+	v4   *cidrNode
+	v6   *cidrNode
+	size int
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	end      bool
+}
+
+func newCIDRTree() *cidrTree {
+	return &cidrTree{v4: &cidrNode{}, v6: &cidrNode{}}
+}
+
+func (t *cidrTree) root(ip net.IP) (*cidrNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, ip4
+	}
+	return t.v6, ip.To16()
+}
+
+// insert 添加一个网段, ipv4映射的ipv6网段按ipv4存储, 掩码无效时返回false
+func (t *cidrTree) insert(n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	node, ip := t.root(n.IP)
+	if len(ip) == net.IPv4len && bits == 8*net.IPv6len {
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	if bits == 0 || ones < 0 || ones > len(ip)*8 {
+		return false
+	}
+	for i := 0; i < ones; i++ {
+		if node.end {
+			// 已有更大的网段
+			return true
+		}
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &cidrNode{}
+		}
+		node = node.children[bit]
+	}
+	if !node.end {
+		node.end = true
+		// 删除被该网段覆盖的更小网段
+		for _, child := range node.children {
+			t.size -= child.count()
+		}
+		node.children = [2]*cidrNode{}
+		t.size++
+	}
+	return true
+}
+
+// count 以该节点为根的子树中的网段数
+func (n *cidrNode) count() int {
+	if n == nil {
+		return 0
+	}
+	var c int
+	if n.end {
+		c++
+	}
+	return c + n.children[0].count() + n.children[1].count()
+}
+
+func (t *cidrTree) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	node, ip := t.root(ip)
+	if ip == nil {
+		return false
+	}
+	for i := 0; i < len(ip)*8; i++ {
+		if node.end {
+			return true
+		}
+		node = node.children[ip[i/8]>>(7-i%8)&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.end
+}
+
+// ruleSet 规则集文件中的条目
+type ruleSet struct {
+	domains *domainTrie
+	cidrs   *cidrTree // 目标为域名时解析后匹配
+	ipCIDRs *cidrTree // no-resolve, 只匹配ip目标
+	rules   []func(m *constant.Metadata, ip *lazyIP) bool
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		domains: newDomainTrie(),
+		cidrs:   newCIDRTree(),
+		ipCIDRs: newCIDRTree(),
+	}
+}
+
+// add 按behavior添加一个条目, 条目无效或不支持时返回错误
+func (s *ruleSet) add(behavior, entry string) error {
+	switch behavior {
+	case BehaviorDomain:
+		if !s.domains.insert(entry) {
+			return fmt.Errorf("invalid domain %q", entry)
+		}
+	case BehaviorIPCIDR:
+		n, err := acl.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		if !s.cidrs.insert(n) {
+			return fmt.Errorf("invalid cidr %q", entry)
+		}
+	case BehaviorClassical:
+		return s.addClassical(entry)
+	default:
+		if n, err := acl.ParseCIDR(entry); err == nil {
+			if !s.cidrs.insert(n) {
+				return fmt.Errorf("invalid cidr %q", entry)
+			}
+		} else if !s.domains.insert(entry) {
+			return fmt.Errorf("invalid domain %q", entry)
+		}
+	}
+	return nil
+}
+
+// addClassical 添加 类型,条件[,no-resolve] 格式的条目, 域名及网段条目加入索引, 其他类型按顺序匹配
+func (s *ruleSet) addClassical(entry string) error {
+	fields := strings.Split(entry, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 2 || len(fields) > 3 || fields[1] == "" {
+		return fmt.Errorf("invalid rule %q", entry)
+	}
+	typ, payload := strings.ToUpper(fields[0]), fields[1]
+	ipOnly := len(fields) == 3 && strings.EqualFold(fields[2], noResolve)
+	if len(fields) == 3 && !ipOnly {
+		return fmt.Errorf("invalid rule %q: unknown option %s", entry, fields[2])
+	}
+	switch typ {
+	case TypeDomain, TypeDomainSuffix:
+		domain := normalize(payload)
+		if domain == "" || strings.Contains(domain, "*") {
+			break
+		}
+		s.domains.add(strings.Split(domain, "."), true, typ == TypeDomainSuffix)
+		return nil
+	case TypeIPCIDR, TypeIPCIDR6:
+		n, err := acl.ParseCIDR(payload)
+		if err != nil {
+			return fmt.Errorf("invalid rule %q: %v", entry, err)
+		}
+		tree := s.cidrs
+		if ipOnly {
+			tree = s.ipCIDRs
+		}
+		if !tree.insert(n) {
+			return fmt.Errorf("invalid rule %q: unsupported cidr", entry)
+		}
+		return nil
+	case TypeRuleSet, TypeMatch:
+		return fmt.Errorf("invalid rule %q: %s not allowed in rule set", entry, typ)
+	}
+	match, err := matcher(typ, payload, nil)
+	if err != nil {
+		return fmt.Errorf("invalid rule %q: %v", entry, err)
+	}
+	s.rules = append(s.rules, match)
+	return nil
+}
+
+// match 先匹配域名及ip目标, 最后解析域名匹配网段
+func (s *ruleSet) match(m *constant.Metadata, ip *lazyIP) bool {
+	host := m.Dest.Addr
+	if isDomain(host) {
+		if s.domains.match(host) {
+			return true
+		}
+	} else if s.ipCIDRs.size > 0 && s.ipCIDRs.contains(net.ParseIP(host)) {
+		return true
+	}
+	for _, rule := range s.rules {
+		if rule(m, ip) {
+			return true
+		}
+	}
+	return s.cidrs.size > 0 && s.cidrs.contains(ip.get())
+}
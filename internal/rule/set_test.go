@@ -0,0 +1,417 @@
+package rule
+
+import (
+	"github.com/xmapst/lightsocks/internal/constant"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainTrie(t *testing.T) {
+	trie := newDomainTrie()
+	for _, entry := range []string{
+		"exact.com",
+		"+.suffix.com",
+		".sub.com",
+		"*.wild.com",
+		"a.*.deep.com",
+		"Upper.COM.",
+	} {
+		if !trie.insert(entry) {
+			t.Fatalf("insert %q failed", entry)
+		}
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		// 不带前缀的条目只匹配该域名
+		{"exact.com", true},
+		{"EXACT.com.", true},
+		{"www.exact.com", false},
+		{"notexact.com", false},
+		// +. 匹配该域名及其子域名
+		{"suffix.com", true},
+		{"www.suffix.com", true},
+		{"a.b.suffix.com", true},
+		{"nosuffix.com", false},
+		// . 只匹配子域名
+		{"sub.com", false},
+		{"www.sub.com", true},
+		{"a.b.sub.com", true},
+		// * 匹配一个标签
+		{"wild.com", false},
+		{"www.wild.com", true},
+		{"a.b.wild.com", false},
+		{"a.x.deep.com", true},
+		{"a.deep.com", false},
+		{"b.x.deep.com", false},
+		{"upper.com", true},
+		{"com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := trie.match(tt.domain); got != tt.want {
+			t.Errorf("match(%q): got %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+	if trie.size != 6 {
+		t.Fatalf("size: got %d, want 6", trie.size)
+	}
+	for _, entry := range []string{"", "+.", ".", "a..com", "+..com"} {
+		if trie.insert(entry) {
+			t.Errorf("insert %q: want failure", entry)
+		}
+	}
+}
+
+func TestDomainTriePrune(t *testing.T) {
+	trie := newDomainTrie()
+	for _, entry := range []string{"a.example.com", "b.a.example.com", "*.example.com", "example.com"} {
+		trie.insert(entry)
+	}
+	if trie.size != 4 {
+		t.Fatalf("size before prune: got %d, want 4", trie.size)
+	}
+	// 后缀覆盖已有的子域名条目, 该域名本身的条目保留
+	trie.insert("+.example.com")
+	if trie.size != 1 {
+		t.Fatalf("size after prune: got %d, want 1", trie.size)
+	}
+	// 已被覆盖的条目不再计数
+	trie.insert("c.example.com")
+	trie.insert(".example.com")
+	trie.insert("example.com")
+	if trie.size != 1 {
+		t.Fatalf("size after covered inserts: got %d, want 1", trie.size)
+	}
+	for _, domain := range []string{"example.com", "a.example.com", "x.y.example.com"} {
+		if !trie.match(domain) {
+			t.Errorf("match(%q): got false", domain)
+		}
+	}
+
+	// 只匹配子域名的条目不覆盖该域名本身
+	trie = newDomainTrie()
+	trie.insert("www.example.org")
+	trie.insert(".example.org")
+	if trie.size != 1 || trie.match("example.org") || !trie.match("www.example.org") {
+		t.Fatalf("subdomain prune: size %d", trie.size)
+	}
+	trie.insert("example.org")
+	if trie.size != 1 || !trie.match("example.org") {
+		t.Fatalf("exact after subdomain: size %d", trie.size)
+	}
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestCIDRTree(t *testing.T) {
+	tree := newCIDRTree()
+	for _, s := range []string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7/32", "2001:db8::/32", "0.0.0.0/32"} {
+		tree.insert(mustCIDR(t, s))
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.255.255.255", true},
+		{"11.0.0.1", false},
+		{"192.168.1.200", true},
+		{"192.168.2.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"::ffff:10.1.1.1", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"0.0.0.0", true},
+		{"0.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := tree.contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("contains(%s): got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if tree.contains(nil) {
+		t.Error("contains(nil): got true")
+	}
+	if tree.size != 5 {
+		t.Fatalf("size: got %d, want 5", tree.size)
+	}
+}
+
+func TestCIDRTreePrune(t *testing.T) {
+	tree := newCIDRTree()
+	for _, s := range []string{"10.1.0.0/16", "10.2.3.0/24", "10.2.4.4/32", "172.16.0.0/12"} {
+		tree.insert(mustCIDR(t, s))
+	}
+	if tree.size != 4 {
+		t.Fatalf("size before prune: got %d, want 4", tree.size)
+	}
+	// 更大的网段覆盖已有的网段
+	tree.insert(mustCIDR(t, "10.0.0.0/8"))
+	if tree.size != 2 {
+		t.Fatalf("size after prune: got %d, want 2", tree.size)
+	}
+	// 已被覆盖或重复的网段不再计数
+	tree.insert(mustCIDR(t, "10.9.0.0/16"))
+	tree.insert(mustCIDR(t, "10.0.0.0/8"))
+	if tree.size != 2 {
+		t.Fatalf("size after covered inserts: got %d, want 2", tree.size)
+	}
+	if !tree.contains(net.ParseIP("10.200.0.1")) || !tree.contains(net.ParseIP("172.20.0.1")) {
+		t.Fatal("pruned tree lost coverage")
+	}
+	tree.insert(mustCIDR(t, "0.0.0.0/0"))
+	if tree.size != 1 || !tree.contains(net.ParseIP("8.8.8.8")) || tree.contains(net.ParseIP("::1")) {
+		t.Fatalf("default route: size %d", tree.size)
+	}
+}
+
+func TestCIDRTreeMapped(t *testing.T) {
+	tree := newCIDRTree()
+	// ipv4映射的ipv6网段按ipv4存储
+	for _, s := range []string{"::ffff:0:0/96", "::ffff:10.0.0.0/104"} {
+		if !tree.insert(mustCIDR(t, s)) {
+			t.Fatalf("insert %s failed", s)
+		}
+	}
+	if tree.size != 1 || !tree.contains(net.ParseIP("8.8.8.8")) || !tree.contains(net.ParseIP("::ffff:1.2.3.4")) {
+		t.Fatalf("mapped /96: size %d", tree.size)
+	}
+	if tree.contains(net.ParseIP("2001:db8::1")) || tree.contains(net.ParseIP("::1")) {
+		t.Fatal("mapped /96 matched ipv6")
+	}
+
+	tree = newCIDRTree()
+	for _, s := range []string{"::ffff:192.168.0.0/112", "2001:db8::/32", "10.0.0.0/8", "::/0"} {
+		if !tree.insert(mustCIDR(t, s)) {
+			t.Fatalf("insert %s failed", s)
+		}
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.3.4", true},
+		{"192.169.0.1", false},
+		{"10.1.1.1", true},
+		{"::ffff:10.1.1.1", true},
+		{"2001:db8::1", true},
+		{"fe80::1", true},
+	}
+	for _, tt := range tests {
+		if got := tree.contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("contains(%s): got %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	// ::/0 剪掉ipv6中的网段, ipv4网段保留
+	if tree.size != 3 {
+		t.Fatalf("size: got %d, want 3", tree.size)
+	}
+
+	// 无法按位存储的网段
+	for _, n := range []*net.IPNet{
+		{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(64, 128)},
+		{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.IPMask{255, 0, 255, 0}},
+	} {
+		if tree.insert(n) {
+			t.Errorf("insert %s: want failure", n)
+		}
+	}
+	s := newRuleSet()
+	if err := s.add(BehaviorClassical, "IP-CIDR6,::ffff:0:0/96,no-resolve"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add(BehaviorMixed, "::ffff:172.16.0.0/108"); err != nil {
+		t.Fatal(err)
+	}
+	if !matchSet(s, "127.0.0.1", 443) || !s.cidrs.contains(net.ParseIP("172.20.0.1")) {
+		t.Fatal("mapped prefixes missed ipv4")
+	}
+}
+
+func metadata(dest string, port int64) *constant.Metadata {
+	return &constant.Metadata{
+		Type: constant.SOCKS5,
+		Dest: constant.IP{Addr: dest, Port: port},
+	}
+}
+
+func matchSet(s *ruleSet, dest string, port int64) bool {
+	m := metadata(dest, port)
+	return s.match(m, &lazyIP{host: m.Dest.Addr})
+}
+
+func TestRuleSetBehavior(t *testing.T) {
+	withoutDNS(t)
+	tests := []struct {
+		behavior string
+		entries  []string
+		invalid  []string
+		match    []string
+		miss     []string
+	}{
+		{
+			behavior: BehaviorMixed,
+			entries:  []string{"example.com", "+.example.org", "10.0.0.0/8", "192.0.2.1"},
+			invalid:  []string{"a..b"},
+			match:    []string{"example.com", "www.example.org", "example.org", "10.1.1.1", "192.0.2.1"},
+			miss:     []string{"www.example.com", "192.0.2.2"},
+		},
+		{
+			behavior: BehaviorDomain,
+			entries:  []string{"example.com", ".example.org"},
+			match:    []string{"example.com", "www.example.org"},
+			miss:     []string{"www.example.com", "example.org"},
+		},
+		{
+			behavior: BehaviorIPCIDR,
+			entries:  []string{"10.0.0.0/8", "2001:db8::/32"},
+			invalid:  []string{"example.com", "10.0.0.0/33"},
+			match:    []string{"10.1.1.1", "2001:db8::1"},
+			miss:     []string{"11.1.1.1", "example.com"},
+		},
+		{
+			behavior: BehaviorClassical,
+			entries: []string{
+				"DOMAIN,exact.com",
+				"DOMAIN-SUFFIX,suffix.com",
+				"DOMAIN-KEYWORD,keyword",
+				"IP-CIDR,10.0.0.0/8",
+				"IP-CIDR6,2001:db8::/32,no-resolve",
+				"DST-PORT,25",
+			},
+			invalid: []string{
+				"exact.com",
+				"GEOIP,CN",
+				"MATCH,DIRECT",
+				"RULE-SET,other",
+				"IP-CIDR,10.0.0.0/8,DIRECT",
+				"IP-CIDR,bad",
+			},
+			match: []string{"exact.com", "suffix.com", "a.suffix.com", "has-keyword.net", "10.1.1.1", "2001:db8::1"},
+			miss:  []string{"www.exact.com", "other.net", "2001:db9::1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.behavior, func(t *testing.T) {
+			s := newRuleSet()
+			for _, entry := range tt.entries {
+				if err := s.add(tt.behavior, entry); err != nil {
+					t.Fatalf("add %q: %v", entry, err)
+				}
+			}
+			for _, entry := range tt.invalid {
+				if err := s.add(tt.behavior, entry); err == nil {
+					t.Errorf("add %q: want error", entry)
+				}
+			}
+			for _, dest := range tt.match {
+				if !matchSet(s, dest, 443) {
+					t.Errorf("match %s: got false", dest)
+				}
+			}
+			for _, dest := range tt.miss {
+				if matchSet(s, dest, 443) {
+					t.Errorf("match %s: got true", dest)
+				}
+			}
+			if tt.behavior == BehaviorClassical && !matchSet(s, "other.net", 25) {
+				t.Error("match other.net:25: got false")
+			}
+		})
+	}
+}
+
+func TestRuleSetNoResolve(t *testing.T) {
+	withResolved(t, "10.1.2.3")
+	s := newRuleSet()
+	for _, entry := range []string{"IP-CIDR,10.0.0.0/8,no-resolve", "IP-CIDR,172.16.0.0/12"} {
+		if err := s.add(BehaviorClassical, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no-resolve 的网段不匹配域名目标, 其他网段匹配解析后的ip
+	if matchSet(s, "example.com", 443) {
+		t.Fatal("no-resolve cidr matched a domain")
+	}
+	if !matchSet(s, "10.9.9.9", 443) {
+		t.Fatal("no-resolve cidr missed an ip")
+	}
+	withResolved(t, "172.16.1.1")
+	if !matchSet(s, "example.com", 443) {
+		t.Fatal("resolved cidr missed a domain")
+	}
+}
+
+func TestProviderLoad(t *testing.T) {
+	withoutDNS(t)
+	dir := t.TempDir()
+	text := filepath.Join(dir, "list.txt")
+	err := os.WriteFile(text, []byte("# comment\n\n+.example.com\n10.0.0.0/8\nbad..entry\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yml := filepath.Join(dir, "classical.yaml")
+	err = os.WriteFile(yml, []byte("payload:\n  - DOMAIN-SUFFIX,example.org\n  - 'IP-CIDR,192.168.0.0/16,no-resolve'\n  - PROCESS-NAME,curl\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProvider("list", text, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.Format != FormatText || p.Behavior != BehaviorMixed {
+		t.Fatalf("format %s behavior %s", p.Format, p.Behavior)
+	}
+	set := p.set.Load()
+	if set.domains.size != 1 || set.cidrs.size != 1 {
+		t.Fatalf("sizes: %d domains, %d cidrs", set.domains.size, set.cidrs.size)
+	}
+
+	c, err := NewProvider("classical", yml, "", BehaviorClassical, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Format != FormatYAML {
+		t.Fatalf("format %s", c.Format)
+	}
+	r, err := New([]string{"RULE-SET,list,REJECT", "RULE-SET,classical,DIRECT"}, nil, []*Provider{p, c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"www.example.com", "RULE-SET,list"},
+		{"10.1.1.1", "RULE-SET,list"},
+		{"www.example.org", "RULE-SET,classical"},
+		{"192.168.1.1", "RULE-SET,classical"},
+		{"example.net", ""},
+	}
+	for _, tt := range tests {
+		got := r.Match(metadata(tt.dest, 443))
+		if got == nil && tt.want != "" || got != nil && got.String() != tt.want {
+			t.Errorf("%s: got %v, want %q", tt.dest, got, tt.want)
+		}
+	}
+
+	for _, behavior := range []string{"clash", "domains"} {
+		if _, err = NewProvider("bad", text, "", behavior, 0); err == nil {
+			t.Errorf("behavior %q: want error", behavior)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStaleHandshake    = errors.New("handshake timestamp out of window")
+	ErrReplayedHandshake = errors.New("handshake replayed")
+	ErrReplayCacheFull   = errors.New("too many handshakes in replay window")
+)
+
+// replayFilter 记录时间窗口内出现过的握手nonce, 拒绝过期及重放的握手
+// nonce保留到其时间戳移出窗口为止, 不会提前淘汰, 缓存已满时拒绝新的握手
+type replayFilter struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int // 0为不限制
+	nonces map[string]struct{}
+	expiry nonceHeap
+	now    func() time.Time
+}
+
+func newReplayFilter(window time.Duration, size int) *replayFilter {
+	return &replayFilter{
+		window: window,
+		size:   size,
+		nonces: make(map[string]struct{}),
+		now:    time.Now,
+	}
+}
+
+func (f *replayFilter) check(h *protocol.Handshake) error {
+	now := f.now()
+	diff := now.Sub(h.Time())
+	if diff < -f.window || diff > f.window {
+		return ErrStaleHandshake
+	}
+	key := string(h.Nonce)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(now)
+	if _, ok := f.nonces[key]; ok {
+		return ErrReplayedHandshake
+	}
+	if f.size > 0 && len(f.nonces) >= f.size {
+		return ErrReplayCacheFull
+	}
+	f.nonces[key] = struct{}{}
+	heap.Push(&f.expiry, nonceEntry{
+		key:    key,
+		expire: h.Time().Add(f.window),
+	})
+	return nil
+}
+
+// expire 删除时间戳已移出窗口的nonce, 这些握手会被判定为过期
+func (f *replayFilter) expire(now time.Time) {
+	for len(f.expiry) > 0 && f.expiry[0].expire.Before(now) {
+		e := heap.Pop(&f.expiry).(nonceEntry)
+		delete(f.nonces, e.key)
+	}
+}
+
+type nonceEntry struct {
+	key    string
+	expire time.Time
+}
+
+// nonceHeap 按移出窗口的时间排序的最小堆
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *nonceHeap) Push(x any) {
+	*h = append(*h, x.(nonceEntry))
+}
+
+func (h *nonceHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"testing"
+	"time"
+)
+
+func newTestHandshake(t *testing.T, ts time.Time) *protocol.Handshake {
+	h, err := protocol.NewHandshake("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Timestamp = ts.Unix()
+	return h
+}
+
+func newTestReplayFilter(window time.Duration, size int, now *time.Time) *replayFilter {
+	f := newReplayFilter(window, size)
+	f.now = func() time.Time {
+		return *now
+	}
+	return f
+}
+
+func TestReplayFilterReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	f := newTestReplayFilter(time.Minute, 16, &now)
+	h := newTestHandshake(t, now)
+	if err := f.check(h); err != nil {
+		t.Fatalf("first handshake: %v", err)
+	}
+	if err := f.check(h); err != ErrReplayedHandshake {
+		t.Fatalf("replayed handshake: got %v, want %v", err, ErrReplayedHandshake)
+	}
+	// 时间戳仍在窗口内, nonce不能过期
+	now = now.Add(time.Minute)
+	if err := f.check(h); err != ErrReplayedHandshake {
+		t.Fatalf("replay at window edge: got %v, want %v", err, ErrReplayedHandshake)
+	}
+	now = now.Add(time.Second)
+	if err := f.check(h); err != ErrStaleHandshake {
+		t.Fatalf("replay after window: got %v, want %v", err, ErrStaleHandshake)
+	}
+}
+
+func TestReplayFilterStale(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	f := newTestReplayFilter(time.Minute, 16, &now)
+	tests := []struct {
+		name string
+		ts   time.Time
+		want error
+	}{
+		{"now", now, nil},
+		{"past edge", now.Add(-time.Minute), nil},
+		{"future edge", now.Add(time.Minute), nil},
+		{"too old", now.Add(-time.Minute - time.Second), ErrStaleHandshake},
+		{"too new", now.Add(time.Minute + time.Second), ErrStaleHandshake},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := f.check(newTestHandshake(t, tt.ts)); err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayFilterFull(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	f := newTestReplayFilter(time.Minute, 4, &now)
+	var accepted []*protocol.Handshake
+	for i := 0; i < 4; i++ {
+		h := newTestHandshake(t, now)
+		if err := f.check(h); err != nil {
+			t.Fatalf("handshake %d: %v", i, err)
+		}
+		accepted = append(accepted, h)
+	}
+	// 缓存已满时不淘汰窗口内的nonce, 拒绝新的握手
+	if err := f.check(newTestHandshake(t, now)); err != ErrReplayCacheFull {
+		t.Fatalf("handshake over size: got %v, want %v", err, ErrReplayCacheFull)
+	}
+	for i, h := range accepted {
+		if err := f.check(h); err != ErrReplayedHandshake {
+			t.Fatalf("replay %d while full: got %v, want %v", i, err, ErrReplayedHandshake)
+		}
+	}
+	// 移出窗口的nonce被删除后接受新的握手
+	now = now.Add(time.Minute + time.Second)
+	if err := f.check(newTestHandshake(t, now)); err != nil {
+		t.Fatalf("handshake after expiry: %v", err)
+	}
+	if len(f.nonces) != 1 || f.expiry.Len() != 1 {
+		t.Fatalf("cache size after expiry: %d nonces, %d heap entries", len(f.nonces), f.expiry.Len())
+	}
+}
+
+func TestReplayFilterExpiryOrder(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	f := newTestReplayFilter(time.Minute, 0, &now)
+	// 时间戳较晚的nonce先到达, 按时间戳而不是到达顺序过期
+	late := newTestHandshake(t, now.Add(30*time.Second))
+	early := newTestHandshake(t, now.Add(-30*time.Second))
+	for _, h := range []*protocol.Handshake{late, early} {
+		if err := f.check(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(45 * time.Second)
+	f.expire(now)
+	if _, ok := f.nonces[string(early.Nonce)]; ok {
+		t.Fatal("early nonce not expired")
+	}
+	if err := f.check(late); err != ErrReplayedHandshake {
+		t.Fatalf("late replay: got %v, want %v", err, ErrReplayedHandshake)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 客户端收到 protocol.StatusNotAllowed 后不再重试
+var (
+	ErrReverseDisabled = fmt.Errorf("%w: reverse tunnel disabled", acl.ErrDenied)
+	ErrReverseRevoked  = fmt.Errorf("%w: reverse tunnel revoked", acl.ErrDenied)
+)
+
+// Reverse 客户端注册的反向隧道
+type Reverse struct {
+	ID     string    `json:"id"`
+	User   string    `json:"user"`   // 客户端使用的凭据
+	Client string    `json:"client"` // 客户端地址
+	Addr   string    `json:"addr"`   // 服务端监听的地址
+	Start  time.Time `json:"start"`
+
+	ln   net.Listener
+	sess *mux.Session
+}
+
+func (r *Reverse) close() {
+	_ = r.ln.Close()
+	if r.sess != nil {
+		_ = r.sess.Close()
+	}
+}
+
+// reverseTable 已注册的反向隧道, 撤销后同一凭据不能再次注册该端口, 直到服务端重启
+type reverseTable struct {
+	mu      sync.Mutex
+	entries map[string]*Reverse
+	revoked map[string]struct{} // user/port
+}
+
+var reverses = &reverseTable{
+	entries: make(map[string]*Reverse),
+	revoked: make(map[string]struct{}),
+}
+
+// Reverses 已注册的反向隧道, 按注册时间排序
+func Reverses() []*Reverse {
+	reverses.mu.Lock()
+	defer reverses.mu.Unlock()
+	list := make([]*Reverse, 0, len(reverses.entries))
+	for _, r := range reverses.entries {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Start.Before(list[j].Start)
+	})
+	return list
+}
+
+// RevokeReverse 关闭反向隧道并禁止该凭据再次注册该端口
+func RevokeReverse(id string) bool {
+	reverses.mu.Lock()
+	r, ok := reverses.entries[id]
+	if ok {
+		delete(reverses.entries, id)
+		_, port, _ := net.SplitHostPort(r.Addr)
+		reverses.revoked[revokeKey(r.User, port)] = struct{}{}
+		r.close()
+	}
+	reverses.mu.Unlock()
+	if ok {
+		logrus.Infoln(r.ID, r.Client, "reverse tunnel", r.Addr, "revoked", "user", r.User)
+	}
+	return ok
+}
+
+func revokeKey(user, port string) string {
+	return user + "/" + port
+}
+
+// listen 检查配置后监听addr并登记
+func (t *reverseTable) listen(id uuid.UUID, user string, client net.Addr, addr string) (*Reverse, error) {
+	if !conf.App.Reverse.Enable {
+		return nil, ErrReverseDisabled
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	_port, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := acl.New(false, acl.Rule{Ports: conf.App.Reverse.Ports}, acl.Rule{})
+	if err != nil {
+		return nil, err
+	}
+	err = policy.CheckHost("", _port)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.revoked[revokeKey(user, port)]; ok {
+		return nil, ErrReverseRevoked
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reverse{
+		ID:     id.String(),
+		User:   user,
+		Client: client.String(),
+		Addr:   ln.Addr().String(),
+		Start:  time.Now(),
+		ln:     ln,
+	}
+	t.entries[r.ID] = r
+	return r, nil
+}
+
+func (t *reverseTable) remove(r *Reverse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries[r.ID] == r {
+		delete(t.entries, r.ID)
+	}
+	r.close()
+}
+
+// closeAll 服务端关闭时关闭所有反向隧道
+func (t *reverseTable) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, r := range t.entries {
+		delete(t.entries, id)
+		r.close()
+	}
+}
+
+// serveReverse 为客户端监听反向隧道的地址, 连入的连接在隧道连接上的多路复用会话中打开流转发给客户端
+// 服务端作为会话的打开方, 客户端关闭隧道连接后停止监听
+func (l *Listener) serveReverse(id uuid.UUID, sess *session, tcpIn chan<- *constant.TCPContext) {
+	defer l.wg.Done()
+	client := sess.conn.RemoteAddr()
+	r, err := reverses.listen(id, sess.user, client, sess.handshake.Addr)
+	if err != nil {
+		logrus.Warningln(id, client, "reverse tunnel", sess.handshake.Addr, "user", sess.user, err)
+		_ = protocol.WriteBindReply(sess.conn, nil, err)
+		_ = sess.conn.Close()
+		return
+	}
+	defer reverses.remove(r)
+	err = protocol.WriteBindReply(sess.conn, r.ln.Addr(), nil)
+	if err != nil {
+		logrus.Errorln(id, client, err)
+		return
+	}
+	logrus.Infoln(id, client, "reverse tunnel listening at", r.Addr, "user", sess.user)
+	muxSess := mux.Client(sess.conn, l.conf.MuxConfig())
+	reverses.mu.Lock()
+	r.sess = muxSess
+	reverses.mu.Unlock()
+	go func() {
+		// 客户端不打开流, Accept 在会话关闭后返回
+		for {
+			stream, err := muxSess.Accept()
+			if err != nil {
+				break
+			}
+			_ = stream.Close()
+		}
+		_ = r.ln.Close()
+	}()
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			break
+		}
+		streamID, _ := uuid.NewV4()
+		metadata := newMetadata(streamID, conn.RemoteAddr(), client.String(), sess.user)
+		metadata.Type = constant.REVERSE
+		peer := conn.RemoteAddr().String()
+		l.wg.Add(1)
+		tcpIn <- &constant.TCPContext{
+			Conn:     conn,
+			Metadata: metadata,
+			DialFn: func() (net.Conn, error) {
+				return muxSess.Open(peer)
+			},
+			PostFn: func() {
+				l.wg.Done()
+			},
+		}
+	}
+	logrus.Infoln(id, client, "reverse tunnel", r.Addr, "closed")
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// withReverse 允许注册反向隧道, 测试结束后关闭所有反向隧道
+func withReverse(t *testing.T, ports ...string) (*Listener, chan *constant.TCPContext) {
+	l := withCredentials(t, 0)
+	conf.App.Reverse = conf.Reverse{Enable: true, Ports: ports}
+	t.Cleanup(reverses.closeAll)
+	return l, make(chan *constant.TCPContext, 1)
+}
+
+// register 以token注册监听addr的反向隧道, 返回客户端一侧的隧道连接及服务端的监听地址
+func register(t *testing.T, l *Listener, tcpIn chan<- *constant.TCPContext, token, addr string) (net.Conn, string, error) {
+	hs, err := protocol.NewReverseHandshake(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	l.wg.Add(1)
+	go l.handle(s, tcpIn)
+	salt, frame, codec := encodeHandshake(t, token, hs)
+	_, err = c.Write(append(salt, frame...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := codec.ReadFull(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := protocol.ParseHandshakeAck(packet.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ack.Features.Has(protocol.FeatureReverse) {
+		t.Fatal("reverse tunnel not negotiated")
+	}
+	codec.Negotiate(ack.Features, protocol.Options{})
+	conn := N.NewSecureTCPConn(c, codec)
+	bind, err := protocol.ReadBindReply(conn)
+	return conn, bind, err
+}
+
+func lookupReverse(addr string) *Reverse {
+	for _, r := range Reverses() {
+		if r.Addr == addr {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestReverseTunnel(t *testing.T) {
+	l, tcpIn := withReverse(t)
+	conn, bind, err := register(t, l, tcpIn, "team-a-token", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := lookupReverse(bind)
+	if r == nil || r.User != "team-a" {
+		t.Fatalf("reverse tunnel %s not listed: %+v", bind, Reverses())
+	}
+	// 客户端作为会话的接受方
+	sess := mux.Server(conn, mux.Config{})
+	defer sess.Close()
+
+	peer, err := net.Dial("tcp", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	var ctx *constant.TCPContext
+	select {
+	case ctx = <-tcpIn:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not forwarded")
+	}
+	if ctx.Metadata.Type != constant.REVERSE || ctx.Metadata.User != "team-a" {
+		t.Fatalf("metadata: %+v", ctx.Metadata)
+	}
+	defer ctx.PostFn()
+
+	// 连接目标即在会话上打开流, 目标为连入的对端地址
+	stream, err := ctx.DialFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	accepted, err := sess.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if accepted.Target() != peer.LocalAddr().String() {
+		t.Fatalf("target: got %s, want %s", accepted.Target(), peer.LocalAddr())
+	}
+	_, err = stream.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(accepted, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatalf("read: %q %v", buf, err)
+	}
+}
+
+func TestReverseRevoke(t *testing.T) {
+	l, tcpIn := withReverse(t)
+	conn, bind, err := register(t, l, tcpIn, "team-a-token", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := mux.Server(conn, mux.Config{})
+	defer sess.Close()
+	r := lookupReverse(bind)
+	if r == nil {
+		t.Fatalf("reverse tunnel %s not listed", bind)
+	}
+
+	if RevokeReverse("unknown") {
+		t.Fatal("unknown reverse tunnel revoked")
+	}
+	if !RevokeReverse(r.ID) {
+		t.Fatal("reverse tunnel not revoked")
+	}
+	if lookupReverse(bind) != nil {
+		t.Fatal("revoked reverse tunnel still listed")
+	}
+	// 撤销后停止监听并关闭隧道连接
+	if c, err := net.Dial("tcp", bind); err == nil {
+		_ = c.Close()
+		t.Fatal("revoked reverse tunnel still listening")
+	}
+	if _, err = sess.Accept(); err == nil {
+		t.Fatal("revoked reverse tunnel session still open")
+	}
+
+	// 同一凭据不能再次注册该端口, 其他凭据可以
+	_, _, err = register(t, l, tcpIn, "team-a-token", bind)
+	if protocol.StatusOf(err) != protocol.StatusNotAllowed {
+		t.Fatalf("register revoked port: got %v, want %v", err, protocol.StatusNotAllowed)
+	}
+	_, again, err := register(t, l, tcpIn, "default-token", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != bind {
+		t.Fatalf("bind: got %s, want %s", again, bind)
+	}
+}
+
+func TestReverseNotAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		enable bool
+		ports  []string
+	}{
+		{"disabled", false, nil},
+		{"port", true, []string{"9000-9100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, tcpIn := withReverse(t, tt.ports...)
+			conf.App.Reverse.Enable = tt.enable
+			_, bind, err := register(t, l, tcpIn, "team-a-token", "127.0.0.1:0")
+			if protocol.StatusOf(err) != protocol.StatusNotAllowed {
+				t.Fatalf("got %q %v, want %v", bind, err, protocol.StatusNotAllowed)
+			}
+			if len(Reverses()) != 0 {
+				t.Fatalf("rejected reverse tunnel listed: %+v", Reverses())
+			}
+		})
+	}
+}
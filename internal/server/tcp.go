@@ -3,26 +3,34 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/gofrs/uuid"
 	"github.com/pires/go-proxyproto"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/lightsocks/internal/auth"
+	"github.com/xmapst/lightsocks/internal/cipher"
 	"github.com/xmapst/lightsocks/internal/conf"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
 	N "github.com/xmapst/lightsocks/internal/net"
 	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/statistic"
 	"github.com/xmapst/lightsocks/internal/tunnel"
+	"github.com/xmapst/lightsocks/internal/udp"
+	"io"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 )
 
 type Listener struct {
-	tcp  net.Listener
-	wg   *sync.WaitGroup
-	conf *conf.Config
+	tcp    net.Listener
+	wg     *sync.WaitGroup
+	conf   *conf.Config
+	replay *replayFilter
 }
 
 func (l *Listener) RawAddress() string {
@@ -34,6 +42,7 @@ func (l *Listener) Address() string {
 }
 
 func (l *Listener) close() {
+	reverses.closeAll()
 	if l.tcp != nil {
 		_ = l.tcp.Close()
 		return
@@ -72,12 +81,23 @@ func (l *Listener) ShutdownWithTimeout(timeout time.Duration) error {
 
 func New() *Listener {
 	return &Listener{
-		wg:   new(sync.WaitGroup),
-		conf: conf.App,
+		wg:     new(sync.WaitGroup),
+		conf:   conf.App,
+		replay: newReplayFilter(conf.App.Replay.Window, conf.App.Replay.Size),
 	}
 }
 
 func (l *Listener) ListenAndServe() (err error) {
+	err = cipher.Verify(l.conf.Local.Method)
+	if err != nil {
+		logrus.Errorln(err)
+		return err
+	}
+	_, err = l.conf.CodecOptions()
+	if err != nil {
+		logrus.Errorln(err)
+		return err
+	}
 	tcpAddr, err := net.ResolveTCPAddr("tcp", l.RawAddress())
 	if err != nil {
 		logrus.Errorln(err)
@@ -115,40 +135,231 @@ func (l *Listener) ListenAndServe() (err error) {
 
 func (l *Listener) handle(srcConn net.Conn, tcpIn chan<- *constant.TCPContext) {
 	id, _ := uuid.NewV4()
-	packet, err := protocol.ReadFull([]byte(l.conf.Local.Token), srcConn)
+	sess, err := l.handshake(srcConn)
 	if err != nil {
 		l.wg.Done()
-		logrus.Errorln(id, srcConn.RemoteAddr(), err)
+		if errors.Is(err, protocol.ErrClientTooOld) {
+			logrus.Errorln(id, srcConn.RemoteAddr(), err, "(please upgrade the client)")
+		} else if err == io.EOF {
+			// 客户端连接池淘汰的空闲连接
+			logrus.Debugln(id, srcConn.RemoteAddr(), "closed before handshake")
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			logrus.Warningln(id, srcConn.RemoteAddr(), "handshake timeout")
+		} else {
+			logrus.Errorln(id, srcConn.RemoteAddr(), err)
+		}
 		_ = srcConn.Close()
 		return
 	}
-	destAddr := string(packet.Payload)
-	logrus.Debugln(id, srcConn.RemoteAddr(), "-->", destAddr, packet.RandNu)
-	tcpIn <- &constant.TCPContext{
-		Conn: srcConn,
-		Metadata: &constant.Metadata{
-			ID:      id,
-			NetWork: constant.TCP,
-			Type:    constant.SOCKS5,
-			Src: func() constant.IP {
-				host, port, _ := net.SplitHostPort(srcConn.RemoteAddr().String())
-				_port, _ := strconv.ParseInt(port, 10, 64)
-				return constant.IP{
-					Addr: host,
-					Port: _port,
-				}
-			}(),
-			Dest: func() constant.IP {
-				host, port, _ := net.SplitHostPort(destAddr)
-				_port, _ := strconv.ParseInt(port, 10, 64)
-				return constant.IP{
-					Addr: host,
-					Port: _port,
-				}
-			}(),
-		},
+	if sess.ack.Features.Has(protocol.FeatureMux) {
+		l.serveMux(id, sess, tcpIn)
+		return
+	}
+	if sess.ack.Features.Has(protocol.FeatureUDP) {
+		l.serveUDP(id, sess)
+		return
+	}
+	if sess.ack.Features.Has(protocol.FeatureReverse) {
+		l.serveReverse(id, sess, tcpIn)
+		return
+	}
+	destAddr := sess.handshake.Addr
+	logrus.Debugln(id, srcConn.RemoteAddr(), "-->", destAddr, "user", sess.user, "version", sess.ack.Version, "features", sess.ack.Features)
+	ctx := &constant.TCPContext{
+		Conn:     sess.conn,
+		Metadata: newMetadata(id, srcConn.RemoteAddr(), destAddr, sess.user),
 		PostFn: func() {
 			l.wg.Done()
 		},
 	}
+	if sess.ack.Features.Has(protocol.FeatureBind) {
+		replyBind(ctx)
+	} else {
+		replyStatus(ctx, sess.ack.Features)
+	}
+	tcpIn <- ctx
+}
+
+// serveMux 将多路复用会话中的流分发到 tunnel.TCPIn
+func (l *Listener) serveMux(id uuid.UUID, sess *session, tcpIn chan<- *constant.TCPContext) {
+	defer l.wg.Done()
+	remoteAddr := sess.conn.RemoteAddr()
+	logrus.Infoln(id, remoteAddr, "mux session accepted", "user", sess.user, "version", sess.ack.Version, "features", sess.ack.Features)
+	muxSess := mux.Server(sess.conn, l.conf.MuxConfig())
+	defer func() {
+		_ = muxSess.Close()
+	}()
+	for {
+		stream, err := muxSess.Accept()
+		if err != nil {
+			logrus.Infoln(id, remoteAddr, "mux session closed", err)
+			return
+		}
+		streamID, _ := uuid.NewV4()
+		logrus.Debugln(streamID, remoteAddr, "-->", stream.Target(), "mux session", id, "stream", stream.ID())
+		l.wg.Add(1)
+		ctx := &constant.TCPContext{
+			Conn:     stream,
+			Metadata: newMetadata(streamID, remoteAddr, stream.Target(), sess.user),
+			PostFn: func() {
+				l.wg.Done()
+			},
+		}
+		replyStatus(ctx, sess.ack.Features)
+		tcpIn <- ctx
+	}
+}
+
+// serveUDP 转发隧道连接中的UDP数据报
+func (l *Listener) serveUDP(id uuid.UUID, sess *session) {
+	defer l.wg.Done()
+	metadata := newMetadata(id, sess.conn.RemoteAddr(), "", sess.user)
+	metadata.NetWork = constant.UDP
+	logrus.Infoln(id, metadata.Src, "udp tunnel accepted", "user", sess.user)
+	udp.ServeTunnel(sess.conn, metadata)
+	logrus.Infoln(id, metadata.Src, "udp tunnel closed")
+}
+
+// replyStatus 协商了 protocol.FeatureStatus 时, 连接目标后向客户端发送连接结果
+func replyStatus(ctx *constant.TCPContext, features protocol.Feature) {
+	if !features.Has(protocol.FeatureStatus) {
+		return
+	}
+	conn := ctx.Conn
+	ctx.PreFn = func(net.Addr) {
+		_ = protocol.WriteStatus(conn, nil)
+	}
+	ctx.ErrFn = func(err error) {
+		_ = protocol.WriteStatus(conn, err)
+	}
+}
+
+// replyBind 处理BIND请求, 开始监听及对端连入后分别向客户端发送应答
+func replyBind(ctx *constant.TCPContext) {
+	conn := ctx.Conn
+	ctx.Bind = true
+	ctx.BindFn = func(bind net.Addr) {
+		_ = protocol.WriteBindReply(conn, bind, nil)
+	}
+	ctx.PreFn = func(peer net.Addr) {
+		_ = protocol.WriteBindReply(conn, peer, nil)
+	}
+	ctx.ErrFn = func(err error) {
+		_ = protocol.WriteBindReply(conn, nil, err)
+	}
+}
+
+func newMetadata(id uuid.UUID, src net.Addr, dest, user string) *constant.Metadata {
+	return &constant.Metadata{
+		ID:      id,
+		User:    user,
+		NetWork: constant.TCP,
+		Type:    constant.SOCKS5,
+		Src: func() constant.IP {
+			host, port, _ := net.SplitHostPort(src.String())
+			_port, _ := strconv.ParseInt(port, 10, 64)
+			return constant.IP{
+				Addr: host,
+				Port: _port,
+			}
+		}(),
+		Dest: func() constant.IP {
+			host, port, _ := net.SplitHostPort(dest)
+			_port, _ := strconv.ParseInt(port, 10, 64)
+			return constant.IP{
+				Addr: host,
+				Port: _port,
+			}
+		}(),
+	}
+}
+
+// session 隧道连接握手后的状态
+type session struct {
+	user      string // 客户端使用的凭据
+	conn      *N.SecureTCPConn
+	handshake *protocol.Handshake
+	ack       *protocol.HandshakeAck
+}
+
+var ErrNoCredential = errors.New("no enabled credential")
+
+// maxHandshakeLen 握手帧的最大长度, 认证前不接受更大的帧
+const maxHandshakeLen = 1 << 17
+
+// authenticate 依次使用启用的凭据派生密钥尝试解密握手帧, 确定连接使用的凭据
+func (l *Listener) authenticate(salt, frame []byte) (*protocol.Codec, *protocol.Packet, conf.Credential, error) {
+	// 凭据可动态配置
+	creds := conf.App.EnabledCredentials()
+	if len(creds) == 0 {
+		return nil, nil, conf.Credential{}, ErrNoCredential
+	}
+	for _, cred := range creds {
+		c, err := cipher.Derive(l.conf.Local.Method, []byte(cred.Token), salt)
+		if err != nil {
+			return nil, nil, cred, err
+		}
+		codec := protocol.NewCodec(c)
+		codec.Server = true
+		packet, err := codec.UnPack(frame)
+		if err == nil {
+			return codec, packet, cred, nil
+		}
+		if errors.Is(err, protocol.ErrCorruptPacket) {
+			// 密钥正确但帧格式不符, 是协议版本化之前的客户端
+			return nil, nil, cred, fmt.Errorf("%w: unversioned handshake", protocol.ErrClientTooOld)
+		}
+	}
+	return nil, nil, conf.Credential{}, cipher.ErrAuthentication
+}
+
+// handshake 读取客户端发送的随机盐并识别客户端凭据, 派生本连接的会话密钥,
+// 校验握手帧后应答协商的版本及能力
+func (l *Listener) handshake(srcConn net.Conn) (*session, error) {
+	// 未认证的连接不能一直占用, 握手完成后清除超时
+	if timeout := conf.App.Handshake.Timeout; timeout > 0 {
+		_ = srcConn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	salt := make([]byte, cipher.SaltSize)
+	_, err := io.ReadFull(srcConn, salt)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := protocol.ReadFrameBytes(srcConn, maxHandshakeLen)
+	if err != nil {
+		return nil, err
+	}
+	codec, packet, cred, err := l.authenticate(salt, frame)
+	if err != nil {
+		return nil, err
+	}
+	hs, err := protocol.ParseHandshake(packet.Payload)
+	if err != nil {
+		return nil, err
+	}
+	err = l.replay.check(hs)
+	if err != nil {
+		switch err {
+		case ErrReplayedHandshake, ErrReplayCacheFull:
+			statistic.DefaultManager.PushReplayRejected()
+		case ErrStaleHandshake:
+			statistic.DefaultManager.PushStaleRejected()
+		}
+		return nil, err
+	}
+	ack := hs.Negotiate()
+	opts, _ := l.conf.CodecOptions()
+	codec.Negotiate(ack.Features, opts)
+	conn := N.NewSecureTCPConn(srcConn, codec)
+	_, err = conn.Write(ack.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	_ = srcConn.SetReadDeadline(time.Time{})
+	return &session{
+		user:      cred.Name,
+		conn:      conn,
+		handshake: hs,
+		ack:       ack,
+	}, nil
 }
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withCredentials 服务端接受default及team-a, team-b已停用
+func withCredentials(t *testing.T, timeout time.Duration) *Listener {
+	old := conf.App
+	conf.App = &conf.Config{
+		Local: conf.Server{Token: "default-token", Method: cipher.AES256GCM},
+		Credentials: []conf.Credential{
+			{Name: "team-a", Token: "team-a-token", Enable: true},
+			{Name: "team-b", Token: "team-b-token", Enable: false},
+		},
+		Handshake: conf.Handshake{Timeout: timeout},
+	}
+	t.Cleanup(func() {
+		conf.App = old
+	})
+	return &Listener{
+		wg:     new(sync.WaitGroup),
+		conf:   conf.App,
+		replay: newReplayFilter(time.Minute, 16),
+	}
+}
+
+// clientHandshake 连接example.com:443的握手
+func clientHandshake(t *testing.T, token string) ([]byte, []byte, *protocol.Codec) {
+	hs, err := protocol.NewHandshake("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeHandshake(t, token, hs)
+}
+
+// encodeHandshake 以token派生密钥编码握手帧, 返回随机盐及握手帧
+func encodeHandshake(t *testing.T, token string, hs *protocol.Handshake) ([]byte, []byte, *protocol.Codec) {
+	salt, err := cipher.NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cipher.Derive(cipher.AES256GCM, []byte(token), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := protocol.NewCodec(c)
+	frame, err := codec.Encode(hs.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return salt, frame, codec
+}
+
+func TestAuthenticate(t *testing.T) {
+	l := withCredentials(t, 0)
+	tests := []struct {
+		name  string
+		token string
+		user  string
+		err   error
+	}{
+		{"default", "default-token", conf.DefaultCredential, nil},
+		{"team", "team-a-token", "team-a", nil},
+		{"disabled", "team-b-token", "", cipher.ErrAuthentication},
+		{"unknown", "team-c-token", "", cipher.ErrAuthentication},
+		{"wrong key", "team-a-tokem", "", cipher.ErrAuthentication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			salt, frame, _ := clientHandshake(t, tt.token)
+			codec, packet, cred, err := l.authenticate(salt, frame)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if cred.Name != tt.user || codec == nil || packet == nil {
+				t.Fatalf("credential %q, want %q", cred.Name, tt.user)
+			}
+		})
+	}
+
+	// 没有启用的凭据时拒绝所有连接
+	conf.App.Local.Token = ""
+	conf.App.Credentials = nil
+	salt, frame, _ := clientHandshake(t, "default-token")
+	if _, _, _, err := l.authenticate(salt, frame); !errors.Is(err, ErrNoCredential) {
+		t.Fatalf("no credentials: got %v, want %v", err, ErrNoCredential)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	l := withCredentials(t, 50*time.Millisecond)
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	// 未认证的连接超时后握手失败
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.handshake(s)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("got %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+func TestHandshakeClearsDeadline(t *testing.T) {
+	l := withCredentials(t, 50*time.Millisecond)
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	salt, frame, codec := clientHandshake(t, "team-a-token")
+	go func() {
+		_, _ = c.Write(append(salt, frame...))
+	}()
+	type result struct {
+		sess *session
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sess, err := l.handshake(s)
+		done <- result{sess, err}
+	}()
+	packet, err := codec.ReadFull(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = protocol.ParseHandshakeAck(packet.Payload); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.sess.user != "team-a" {
+		t.Fatalf("user: got %q, want team-a", r.sess.user)
+	}
+	// 握手完成后不再有读超时
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		_, _ = c.Write([]byte("x"))
+	}()
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(s, b); err != nil {
+		t.Fatalf("read after handshake: %v", err)
+	}
+}
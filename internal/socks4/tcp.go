@@ -75,12 +75,13 @@ func (p *Proxy) handshake() (addr string, err error) {
 	logrus.Infoln(p.id, p.srcAddr(), cmdMap[command])
 	// command only support connect
 	if command != CmdConnect {
+		p.writeReply(RequestRejected, nil)
 		logrus.Errorln(p.id, p.srcAddr(), ErrRequestUnknownCode)
 		return "", ErrRequestUnknownCode
 	}
 	user := p.readUntilNull(buf[7:])
 	if p.auth.Enable() && !p.auth.Verify(user, "", p.conn.RemoteAddr().String()) {
-		_, _ = p.conn.Write([]byte{0x01, 0x00})
+		p.writeReply(RequestIdentdMismatched, nil)
 		logrus.Errorln(p.id, p.srcAddr(), ErrRequestIdentdMismatched)
 		return "", ErrRequestIdentdMismatched
 
@@ -144,12 +145,11 @@ func (p *Proxy) processRequest(target string, tcpIn chan<- *constant.TCPContext)
 				}
 			}(),
 		},
-		PreFn: func() {
-			_, err := p.conn.Write([]byte{0x00, 0x5A, 0x00, 0x00, 0, 0, 0, 0})
-			if err != nil {
-				logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
-				return
-			}
+		PreFn: func(bind net.Addr) {
+			p.writeReply(RequestGranted, bind)
+		},
+		ErrFn: func(error) {
+			p.writeReply(RequestRejected, nil)
 		},
 		PostFn: func() {
 			p.wg.Done()
@@ -158,6 +158,21 @@ func (p *Proxy) processRequest(target string, tcpIn chan<- *constant.TCPContext)
 	return nil
 }
 
+// writeReply 应答请求, bind为IPv4地址时携带实际的地址及端口, 否则为0
+func (p *Proxy) writeReply(code Code, bind net.Addr) {
+	buf := []byte{0x00, code, 0, 0, 0, 0, 0, 0}
+	if addr, ok := bind.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			binary.BigEndian.PutUint16(buf[2:4], uint16(addr.Port))
+			copy(buf[4:], ip4)
+		}
+	}
+	_, err := p.conn.Write(buf)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
+	}
+}
+
 func (p *Proxy) readUntilNull(src []byte) string {
 	buf := &bytes.Buffer{}
 	for _, v := range src {
@@ -8,6 +8,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/lightsocks/internal/auth"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/udp"
 	"io"
 	"net"
 	"strconv"
@@ -18,8 +20,9 @@ type Proxy struct {
 	id   uuid.UUID
 	wg   *sync.WaitGroup
 	conn net.Conn
-	Udp  string
+	Udp  *udp.Listener
 	auth *auth.Auth
+	user string // 认证通过的用户
 }
 
 type DialFunc func(network, addr string) (net.Conn, error)
@@ -163,6 +166,7 @@ func (p *Proxy) passwordAuth() error {
 
 	password := buf[p3:p4]
 	if p.auth.Verify(user, string(password), p.conn.RemoteAddr().String()) {
+		p.user = user
 		_, _ = p.conn.Write([]byte{0x01, 0x00})
 		return nil
 	}
@@ -226,19 +230,43 @@ func (p *Proxy) processRequest(tcpIn chan<- *constant.TCPContext) error {
 	// command support connect
 	switch buf[1] {
 	case CmdUdp:
-		return p.handleUdpCmd()
-	case CmdConnect, CmdBind:
+		announced := &net.UDPAddr{Port: int(port)}
+		if buf[3] != constant.ATypeDomainName {
+			announced.IP = net.IP(addr)
+		}
+		return p.handleUdpCmd(announced)
+	case CmdConnect:
 		return p.handleConnectCmd(target, tcpIn)
+	case CmdBind:
+		return p.handleBindCmd(target, tcpIn)
 	default:
+		p.writeReply(protocol.StatusCommandNotSupported, nil)
 		return errors.New("command not supported")
 	}
 }
 
 func (p *Proxy) handleConnectCmd(target string, tcpIn chan<- *constant.TCPContext) error {
-	tcpIn <- &constant.TCPContext{
+	tcpIn <- p.newContext(target)
+	return nil
+}
+
+// handleBindCmd 监听并等待target连入, 开始监听及对端连入后分别应答
+func (p *Proxy) handleBindCmd(target string, tcpIn chan<- *constant.TCPContext) error {
+	ctx := p.newContext(target)
+	ctx.Bind = true
+	ctx.BindFn = func(bind net.Addr) {
+		p.writeReply(protocol.StatusSucceeded, bind)
+	}
+	tcpIn <- ctx
+	return nil
+}
+
+func (p *Proxy) newContext(target string) *constant.TCPContext {
+	return &constant.TCPContext{
 		Conn: p.conn,
 		Metadata: &constant.Metadata{
 			ID:      p.id,
+			User:    p.user,
 			NetWork: constant.TCP,
 			Type:    constant.SOCKS5,
 			Src: func() constant.IP {
@@ -258,60 +286,71 @@ func (p *Proxy) handleConnectCmd(target string, tcpIn chan<- *constant.TCPContex
 				}
 			}(),
 		},
-		PreFn: func() {
-			_, err := p.conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01})
-			if err != nil {
-				logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
-				return
-			}
+		PreFn: func(bind net.Addr) {
+			p.writeReply(protocol.StatusSucceeded, bind)
+		},
+		ErrFn: func(err error) {
+			p.writeReply(protocol.StatusOf(err), nil)
 		},
 		PostFn: func() {
 			p.wg.Done()
 		},
 	}
-	return nil
 }
 
-func (p *Proxy) handleUdpCmd() error {
-	host, port, err := net.SplitHostPort(p.Udp)
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
-	}
-	_port, err := strconv.Atoi(port)
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
-	}
-	udpAddr, err := net.ResolveIPAddr("ip", host)
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
-	}
-	hostByte := udpAddr.IP.To4()
-	portByte := make([]byte, 2)
-	binary.BigEndian.PutUint16(portByte, uint16(_port))
-	buf := append([]byte{Version, 0x00, 0x00, 0x01}, hostByte...)
-	buf = append(buf, portByte...)
-	_, err = p.conn.Write(buf)
+// writeReply 应答请求, 连接结果与SOCKS5应答码取值一致, bind未知时为0.0.0.0:0
+func (p *Proxy) writeReply(status protocol.Status, bind net.Addr) {
+	buf := append([]byte{Version, byte(status), 0x00}, encodeAddr(bind)...)
+	_, err := p.conn.Write(buf)
 	if err != nil {
 		logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
-		return err
 	}
+}
 
-	forward := func(src net.Conn) {
-		defer func(src net.Conn) {
-			_ = src.Close()
-		}(src)
-		for {
-			_, err = io.ReadFull(src, make([]byte, 100))
-			if err != nil {
-				logrus.Errorln(p.id, p.srcAddr(), err)
-				break
-			}
+// encodeAddr 编码为 addrtype | addr | port
+func encodeAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	var buf []byte
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
 		}
+		buf = append([]byte{constant.ATypeIPv4}, ip4...)
+	} else {
+		buf = append([]byte{constant.ATypeIPv6}, ip.To16()...)
 	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
 
-	forward(p.conn)
+// handleUdpCmd 登记客户端声明的发送地址并应答转发端口, 控制连接关闭后删除登记
+func (p *Proxy) handleUdpCmd(announced *net.UDPAddr) error {
+	defer p.wg.Done()
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(p.conn)
+	if p.Udp == nil {
+		p.writeReply(protocol.StatusFailure, nil)
+		return errors.New("udp relay not available")
+	}
+	assoc := p.Udp.Associate(p.user, p.conn.RemoteAddr(), announced)
+	defer assoc.Close()
+	// 转发端口监听在所有地址时应答客户端连入的地址
+	bind := *p.Udp.Addr()
+	if bind.IP.IsUnspecified() {
+		if addr, ok := p.conn.LocalAddr().(*net.TCPAddr); ok {
+			bind.IP = addr.IP
+		}
+	}
+	p.writeReply(protocol.StatusSucceeded, &bind)
+	logrus.Infoln(p.id, p.srcAddr(), "udp associate", announced, "relay", &bind)
+	_, _ = io.Copy(io.Discard, p.conn)
+	logrus.Infoln(p.id, p.srcAddr(), "udp associate closed")
 	return nil
 }
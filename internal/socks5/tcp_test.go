@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"bytes"
+	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/rule"
+	"github.com/xmapst/lightsocks/internal/udp"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient 完成无认证的协商, 返回客户端一侧的连接及Handle的结果
+func testClient(t *testing.T, p *Proxy, wg *sync.WaitGroup, tcpIn chan<- *constant.TCPContext) (net.Conn, <-chan error) {
+	if conf.App == nil {
+		conf.App = &conf.Config{}
+	}
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	done := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		done <- p.Handle(wg, uuid.Must(uuid.NewV4()), s, tcpIn)
+	}()
+	_, err := c.Write([]byte{Version, 1, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(c, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, []byte{Version, 0x00}) {
+		t.Fatalf("method reply: %v", reply)
+	}
+	return c, done
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	var wg sync.WaitGroup
+	c, done := testClient(t, &Proxy{}, &wg, nil)
+	_, err := c.Write([]byte{Version, 0x09, 0x00, constant.ATypeIPv4, 1, 2, 3, 4, 0, 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(c, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{Version, 0x07, 0x00, constant.ATypeIPv4, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(reply, want) {
+		t.Fatalf("reply: got %v, want %v", reply, want)
+	}
+	if err = <-done; err == nil {
+		t.Fatal("unsupported command accepted")
+	}
+}
+
+func TestUdpAssociateDone(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	relay := udp.NewListener(conn)
+	go relay.Serve()
+
+	var wg sync.WaitGroup
+	c, done := testClient(t, &Proxy{Udp: relay}, &wg, nil)
+	_, err = c.Write([]byte{Version, CmdUdp, 0x00, constant.ATypeIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(c, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("reply status: %d", reply[1])
+	}
+	if port := int(reply[8])<<8 | int(reply[9]); port != relay.Addr().Port {
+		t.Fatalf("relay port: got %d, want %d", port, relay.Addr().Port)
+	}
+
+	// 控制连接关闭后请求结束, 监听关闭时不再等待该连接
+	_ = c.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("udp associate did not release the wait group")
+	}
+}
+
+// connectAs 以用户名密码认证后请求连接target, 返回交给 tunnel 的连接
+func connectAs(t *testing.T, user, pass, target string) *constant.TCPContext {
+	c, s := net.Pipe()
+	defer c.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	tcpIn := make(chan *constant.TCPContext, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- new(Proxy).Handle(&wg, uuid.Must(uuid.NewV4()), s, tcpIn)
+	}()
+	reply := make([]byte, 2)
+	_, err := c.Write([]byte{Version, 1, 0x02})
+	if err == nil {
+		_, err = io.ReadFull(c, reply)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := append(append([]byte{0x01, byte(len(user))}, user...), byte(len(pass)))
+	_, err = c.Write(append(auth, pass...))
+	if err == nil {
+		_, err = io.ReadFull(c, reply)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 {
+		t.Fatalf("authentication failed: %v", reply)
+	}
+	host, port, _ := net.SplitHostPort(target)
+	req := append([]byte{Version, CmdConnect, 0x00, constant.ATypeDomainName, byte(len(host))}, host...)
+	_, err = c.Write(append(req, 0x01, 0xbb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-tcpIn
+	if ctx.Metadata.Dest.Addr != host || strconv.FormatInt(ctx.Metadata.Dest.Port, 10) != port {
+		t.Fatalf("dest: %+v", ctx.Metadata.Dest)
+	}
+	return ctx
+}
+
+func TestRouteUser(t *testing.T) {
+	old := conf.App
+	conf.App = &conf.Config{
+		Users: []conf.User{
+			{UserName: "admin", Password: "pw"},
+			{UserName: "bob", Password: "pw"},
+		},
+	}
+	defer func() {
+		conf.App = old
+	}()
+	router, err := rule.New([]string{
+		"USER,admin,REJECT",
+		"INBOUND,Socks5,DIRECT",
+		"MATCH,PROXY",
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"admin", "USER,admin"},
+		{"bob", "INBOUND,Socks5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			ctx := connectAs(t, tt.user, "pw", "example.com:443")
+			if ctx.Metadata.User != tt.user || ctx.Metadata.Type != constant.SOCKS5 {
+				t.Fatalf("metadata: user %q type %s", ctx.Metadata.User, ctx.Metadata.Type)
+			}
+			if r := router.Match(ctx.Metadata); r == nil || r.String() != tt.want {
+				t.Fatalf("rule: got %v, want %s", r, tt.want)
+			}
+		})
+	}
+}
@@ -16,6 +16,14 @@ func init() {
 		downloadBlip:  atomic.NewInt64(0),
 		uploadTotal:   atomic.NewInt64(0),
 		downloadTotal: atomic.NewInt64(0),
+		replayTotal:   atomic.NewInt64(0),
+		staleTotal:    atomic.NewInt64(0),
+		poolHit:       atomic.NewInt64(0),
+		poolMiss:      atomic.NewInt64(0),
+		poolEvicted:   atomic.NewInt64(0),
+		poolIdle:      atomic.NewInt64(0),
+		udpUpload:     atomic.NewInt64(0),
+		udpDownload:   atomic.NewInt64(0),
 	}
 
 	go DefaultManager.handle()
@@ -29,6 +37,14 @@ type Manager struct {
 	downloadBlip  *atomic.Int64
 	uploadTotal   *atomic.Int64
 	downloadTotal *atomic.Int64
+	replayTotal   *atomic.Int64
+	staleTotal    *atomic.Int64
+	poolHit       *atomic.Int64
+	poolMiss      *atomic.Int64
+	poolEvicted   *atomic.Int64
+	poolIdle      *atomic.Int64
+	udpUpload     *atomic.Int64
+	udpDownload   *atomic.Int64
 }
 
 func (m *Manager) Join(c tracker) {
@@ -49,6 +65,48 @@ func (m *Manager) PushDownloaded(size int64) {
 	m.downloadTotal.Add(size)
 }
 
+// PushReplayRejected 记录一次因重放被拒绝的握手
+func (m *Manager) PushReplayRejected() {
+	m.replayTotal.Inc()
+}
+
+// PushStaleRejected 记录一次因时间戳过期被拒绝的握手
+func (m *Manager) PushStaleRejected() {
+	m.staleTotal.Inc()
+}
+
+// PushPoolHit 记录一次从连接池取到空闲连接
+func (m *Manager) PushPoolHit() {
+	m.poolHit.Inc()
+}
+
+// PushPoolMiss 记录一次连接池为空而直接建立连接
+func (m *Manager) PushPoolMiss() {
+	m.poolMiss.Inc()
+}
+
+// PushPoolEvicted 记录一次因过期或断开被淘汰的空闲连接
+func (m *Manager) PushPoolEvicted() {
+	m.poolEvicted.Inc()
+}
+
+// SetPoolIdle 记录连接池当前的空闲连接数
+func (m *Manager) SetPoolIdle(n int64) {
+	m.poolIdle.Store(n)
+}
+
+// PushUDPUploaded 记录发往目标的UDP数据量, 同时计入总流量
+func (m *Manager) PushUDPUploaded(size int64) {
+	m.udpUpload.Add(size)
+	m.PushUploaded(size)
+}
+
+// PushUDPDownloaded 记录目标返回的UDP数据量, 同时计入总流量
+func (m *Manager) PushUDPDownloaded(size int64) {
+	m.udpDownload.Add(size)
+	m.PushDownloaded(size)
+}
+
 func (m *Manager) Now() (up int64, down int64) {
 	return m.uploadBlip.Load(), m.downloadBlip.Load()
 }
@@ -64,6 +122,20 @@ func (m *Manager) Snapshot() *Snapshot {
 		UploadTotal:   m.uploadTotal.Load(),
 		DownloadTotal: m.downloadTotal.Load(),
 		Connections:   connections,
+		Rejected: Rejected{
+			Replay: m.replayTotal.Load(),
+			Stale:  m.staleTotal.Load(),
+		},
+		Pool: Pool{
+			Idle:      m.poolIdle.Load(),
+			Hits:      m.poolHit.Load(),
+			Misses:    m.poolMiss.Load(),
+			Evictions: m.poolEvicted.Load(),
+		},
+		UDP: UDP{
+			UploadTotal:   m.udpUpload.Load(),
+			DownloadTotal: m.udpDownload.Load(),
+		},
 	}
 }
 
@@ -74,6 +146,13 @@ func (m *Manager) ResetStatistic() {
 	m.downloadTemp.Store(0)
 	m.downloadBlip.Store(0)
 	m.downloadTotal.Store(0)
+	m.replayTotal.Store(0)
+	m.staleTotal.Store(0)
+	m.poolHit.Store(0)
+	m.poolMiss.Store(0)
+	m.poolEvicted.Store(0)
+	m.udpUpload.Store(0)
+	m.udpDownload.Store(0)
 }
 
 func (m *Manager) handle() {
@@ -91,4 +170,27 @@ type Snapshot struct {
 	DownloadTotal int64     `json:"downloadTotal"`
 	UploadTotal   int64     `json:"uploadTotal"`
 	Connections   []tracker `json:"connections"`
+	Rejected      Rejected  `json:"rejected"`
+	Pool          Pool      `json:"pool"`
+	UDP           UDP       `json:"udp"`
+}
+
+// Rejected 服务端拒绝的握手次数
+type Rejected struct {
+	Replay int64 `json:"replay"`
+	Stale  int64 `json:"stale"`
+}
+
+// Pool 客户端到服务端的连接池
+type Pool struct {
+	Idle      int64 `json:"idle"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// UDP 转发的UDP数据量, 已计入总流量
+type UDP struct {
+	UploadTotal   int64 `json:"uploadTotal"`
+	DownloadTotal int64 `json:"downloadTotal"`
 }
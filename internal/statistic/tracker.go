@@ -2,8 +2,10 @@ package statistic
 
 import (
 	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/compress"
 	"github.com/xmapst/lightsocks/internal/constant"
 	"go.uber.org/atomic"
+	"io"
 	"net"
 	"time"
 )
@@ -19,6 +21,7 @@ type trackerInfo struct {
 	UploadTotal   *atomic.Int64      `json:"upload"`
 	DownloadTotal *atomic.Int64      `json:"download"`
 	Start         time.Time          `json:"start"`
+	Compress      *compress.Stats    `json:"compress,omitempty"`
 }
 
 type TcpTracker struct {
@@ -52,10 +55,57 @@ func (tt *TcpTracker) Close() error {
 	return tt.Conn.Close()
 }
 
-func NewTCPTracker(conn net.Conn, metadata *constant.Metadata) *TcpTracker {
+// NewTCPTracker 跟踪连接流量, 经过隧道的连接同时记录帧压缩情况
+func NewTCPTracker(conn net.Conn, metadata *constant.Metadata, compress *compress.Stats) *TcpTracker {
 	t := &TcpTracker{
 		Conn:    conn,
 		manager: DefaultManager,
+		trackerInfo: &trackerInfo{
+			UUID:          metadata.ID,
+			Start:         time.Now(),
+			Metadata:      metadata,
+			UploadTotal:   atomic.NewInt64(0),
+			DownloadTotal: atomic.NewInt64(0),
+			Compress:      compress,
+		},
+	}
+	DefaultManager.Join(t)
+	return t
+}
+
+// UdpTracker 跟踪一个UDP映射的流量, 关闭时同时关闭映射的出口
+type UdpTracker struct {
+	*trackerInfo
+	closer  io.Closer
+	manager *Manager
+}
+
+func (ut *UdpTracker) ID() string {
+	return ut.UUID.String()
+}
+
+// PushUploaded 记录发往目标的数据报
+func (ut *UdpTracker) PushUploaded(size int) {
+	ut.manager.PushUDPUploaded(int64(size))
+	ut.UploadTotal.Add(int64(size))
+}
+
+// PushDownloaded 记录目标返回的数据报
+func (ut *UdpTracker) PushDownloaded(size int) {
+	ut.manager.PushUDPDownloaded(int64(size))
+	ut.DownloadTotal.Add(int64(size))
+}
+
+func (ut *UdpTracker) Close() error {
+	ut.manager.Leave(ut)
+	return ut.closer.Close()
+}
+
+// NewUDPTracker 跟踪UDP映射, closer为映射的出口
+func NewUDPTracker(metadata *constant.Metadata, closer io.Closer) *UdpTracker {
+	t := &UdpTracker{
+		closer:  closer,
+		manager: DefaultManager,
 		trackerInfo: &trackerInfo{
 			UUID:          metadata.ID,
 			Start:         time.Now(),
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/rule"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrBindUnsupported = errors.New("server does not support bind")
+	ErrBindUpstream    = errors.New("bind is not supported through upstream")
+)
+
+// bindTimeout 等待对端连入的最长时间
+const bindTimeout = 2 * time.Minute
+
+// bindTarget 处理BIND请求, 返回连入的对端连接, 并将 Metadata.Dest 更新为对端地址
+// 路由到服务端时由服务端监听, 返回承载对端数据的隧道连接, 不支持路由到 Upstreams
+func bindTarget(ctx *constant.TCPContext, chain string) (net.Conn, error) {
+	switch chain {
+	case "", rule.Direct:
+		return acceptPeer(ctx)
+	case rule.Proxy:
+		return dialBind(ctx)
+	default:
+		return nil, ErrBindUpstream
+	}
+}
+
+// dialBind 通过隧道请求服务端监听, 依次读取监听地址及对端地址
+func dialBind(ctx *constant.TCPContext) (net.Conn, error) {
+	hs, err := protocol.NewBindHandshake(ctx.Metadata.Dest.String())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialServer(hs)
+	if err != nil {
+		return nil, err
+	}
+	bind, err := protocol.ReadBindReply(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if ctx.BindFn != nil {
+		ctx.BindFn(tcpAddr(bind))
+	}
+	peer, err := protocol.ReadBindReply(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ctx.Metadata.Dest = toIP(tcpAddr(peer))
+	return conn, nil
+}
+
+// acceptPeer 监听随机端口并只接受来自预期对端ip的一个连接, 对端ip为0.0.0.0时接受任意连接
+// 对端端口不做检查, 如主动模式FTP的数据连接来自20端口而不是请求中的端口
+func acceptPeer(ctx *constant.TCPContext) (net.Conn, error) {
+	policy := conf.App.ACL
+	if conf.App.Mode != conf.ServerMode {
+		policy = nil
+	}
+	expected, err := resolver.ResolveIP(ctx.Metadata.Dest.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if !expected.IsUnspecified() {
+		err = policy.CheckIP(expected)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func(ln net.Listener) {
+		_ = ln.Close()
+	}(ln)
+	if ctx.BindFn != nil {
+		ctx.BindFn(&net.TCPAddr{
+			IP:   bindIP(ctx.Conn, expected),
+			Port: ln.Addr().(*net.TCPAddr).Port,
+		})
+	}
+	_ = ln.SetDeadline(time.Now().Add(bindTimeout))
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if !expected.IsUnspecified() && !peer.IP.Equal(expected) {
+			logrus.Warningln(ctx.Metadata.ID, peer, "-->", ln.Addr(), "unexpected bind peer, want", expected)
+			_ = conn.Close()
+			continue
+		}
+		if err = policy.CheckIP(peer.IP); err != nil {
+			logrus.Warningln(ctx.Metadata.ID, peer, "-->", ln.Addr(), "user", ctx.Metadata.User, err)
+			_ = conn.Close()
+			continue
+		}
+		ctx.Metadata.Dest = toIP(peer)
+		return conn, nil
+	}
+}
+
+// bindIP 应答给客户端的监听ip, 取访问对端时使用的本地ip, 对端未知时取客户端连入的本地ip
+func bindIP(conn net.Conn, peer net.IP) net.IP {
+	if !peer.IsUnspecified() {
+		// UDP连接不发送数据, 只用于选择路由, 端口任意
+		c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: peer, Port: 9})
+		if err == nil {
+			defer func(c net.Conn) {
+				_ = c.Close()
+			}(c)
+			return c.LocalAddr().(*net.UDPAddr).IP
+		}
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// tcpAddr 解析 ip:port 形式的地址, 格式错误时返回nil
+func tcpAddr(addr string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	_port, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: _port}
+}
+
+func toIP(addr *net.TCPAddr) constant.IP {
+	if addr == nil {
+		return constant.IP{}
+	}
+	return constant.IP{
+		Addr: addr.IP.String(),
+		Port: int64(addr.Port),
+	}
+}
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"errors"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/rule"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// withDirect 以直连模式运行, 不检查出口策略
+func withDirect(t *testing.T) {
+	app := conf.App
+	conf.App = &conf.Config{Mode: conf.DirectMode}
+	t.Cleanup(func() {
+		conf.App = app
+	})
+}
+
+// bindContext 返回请求BIND的上下文, 监听地址通过返回的通道传出
+func bindContext(t *testing.T, peer string) (*constant.TCPContext, <-chan net.Addr) {
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	bound := make(chan net.Addr, 1)
+	return &constant.TCPContext{
+		Conn:     s,
+		Metadata: &constant.Metadata{Dest: constant.IP{Addr: peer, Port: 21}},
+		Bind:     true,
+		BindFn: func(bind net.Addr) {
+			bound <- bind
+		},
+	}, bound
+}
+
+type bindResult struct {
+	conn net.Conn
+	err  error
+}
+
+func acceptAsync(ctx *constant.TCPContext) <-chan bindResult {
+	done := make(chan bindResult, 1)
+	go func() {
+		conn, err := bindTarget(ctx, rule.Direct)
+		done <- bindResult{conn, err}
+	}()
+	return done
+}
+
+func dialFrom(t *testing.T, local net.IP, addr net.Addr) net.Conn {
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: local}, Timeout: time.Second}
+	conn, err := d.Dial("tcp", addr.String())
+	if err != nil {
+		t.Skip("dial from", local, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestBindDirect(t *testing.T) {
+	withDirect(t)
+	ctx, bound := bindContext(t, "127.0.0.1")
+	done := acceptAsync(ctx)
+
+	var bind net.Addr
+	select {
+	case bind = <-bound:
+	case res := <-done:
+		t.Fatal("bind:", res.err)
+	}
+	addr := bind.(*net.TCPAddr)
+	if !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+		t.Fatalf("bind address: %v", bind)
+	}
+	peer := dialFrom(t, net.IPv4(127, 0, 0, 1), bind)
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.conn.Close()
+
+	local := peer.LocalAddr().(*net.TCPAddr)
+	if ctx.Metadata.Dest.Addr != "127.0.0.1" || ctx.Metadata.Dest.Port != int64(local.Port) {
+		t.Fatalf("dest: got %v, want %v", ctx.Metadata.Dest, local)
+	}
+	_, err := peer.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(res.conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatalf("read: %q %v", buf, err)
+	}
+}
+
+func TestBindUnexpectedPeer(t *testing.T) {
+	withDirect(t)
+	ctx, bound := bindContext(t, "127.0.0.2")
+	done := acceptAsync(ctx)
+
+	var bind net.Addr
+	select {
+	case bind = <-bound:
+	case res := <-done:
+		t.Fatal("bind:", res.err)
+	}
+	// 来自其他ip的连接被关闭, 监听继续等待预期的对端
+	other := dialFrom(t, net.IPv4(127, 0, 0, 1), bind)
+	_ = other.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := other.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Fatalf("unexpected peer not closed: %v", err)
+	}
+	select {
+	case res := <-done:
+		t.Fatalf("unexpected peer accepted: %v", res.err)
+	default:
+	}
+
+	dialFrom(t, net.IPv4(127, 0, 0, 2), bind)
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.conn.Close()
+	if ctx.Metadata.Dest.Addr != "127.0.0.2" {
+		t.Fatalf("dest: %v", ctx.Metadata.Dest)
+	}
+}
+
+func TestBindUpstream(t *testing.T) {
+	withDirect(t)
+	ctx, _ := bindContext(t, "127.0.0.1")
+	_, err := bindTarget(ctx, "hk")
+	if !errors.Is(err, ErrBindUpstream) {
+		t.Fatalf("got %v, want %v", err, ErrBindUpstream)
+	}
+}
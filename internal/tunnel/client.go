@@ -0,0 +1,213 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/pool"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var (
+	ErrMuxUnsupported     = errors.New("server does not support mux")
+	ErrUDPUnsupported     = errors.New("server does not support udp")
+	ErrReverseUnsupported = errors.New("server does not support reverse tunnel")
+	ErrUnknownUpstream    = errors.New("unknown upstream")
+)
+
+var (
+	muxPool     *mux.Pool
+	muxPoolOnce sync.Once
+	connPool    *pool.Pool
+)
+
+// startPool 启用连接池时预先建立到服务端的连接
+func startPool() {
+	if conf.App.Pool.Size <= 0 {
+		return
+	}
+	connPool = pool.New(conf.App.Pool.Size, conf.App.Pool.MaxIdle, conf.App.Pool.Probe, dialRaw)
+}
+
+// dialTunnel 建立到服务端的隧道, 启用多路复用时在已有的会话中打开流
+func dialTunnel(addr string) (net.Conn, error) {
+	if conf.App.Mux.Enable {
+		muxPoolOnce.Do(func() {
+			muxPool = mux.NewPool(conf.App.Mux.Connections, conf.App.MuxConfig(), dialMux)
+		})
+		return muxPool.Open(addr)
+	}
+	hs, err := protocol.NewHandshake(addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialServer(hs)
+}
+
+// DialUDP 建立转发UDP数据报的隧道连接
+func DialUDP() (net.Conn, error) {
+	hs, err := protocol.NewUDPHandshake()
+	if err != nil {
+		return nil, err
+	}
+	return dialServer(hs)
+}
+
+// DialReverse 建立注册反向隧道的连接, addr为服务端监听的地址, 返回服务端实际监听的地址
+func DialReverse(addr string) (net.Conn, string, error) {
+	hs, err := protocol.NewReverseHandshake(addr)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := dialServer(hs)
+	if err != nil {
+		return nil, "", err
+	}
+	bind, err := protocol.ReadBindReply(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, "", err
+	}
+	return conn, bind, nil
+}
+
+// dialMux 建立多路复用会话使用的隧道连接
+func dialMux() (net.Conn, error) {
+	hs, err := protocol.NewMuxHandshake()
+	if err != nil {
+		return nil, err
+	}
+	return dialServer(hs)
+}
+
+// dialServer 连接服务端并完成握手, 启用连接池时优先使用池中的连接
+func dialServer(hs *protocol.Handshake) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if connPool != nil {
+		conn, err = connPool.Get()
+	} else {
+		conn, err = dialRaw()
+	}
+	if err != nil {
+		return nil, err
+	}
+	codec, err := handshake(conn, hs, conf.App.Server.Method, conf.App.Server.Token)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return N.NewSecureTCPConn(conn, codec), nil
+}
+
+// dialUpstream 经路由规则指定的服务端建立隧道, 不使用连接池及多路复用
+func dialUpstream(name, addr string) (net.Conn, error) {
+	u, ok := conf.App.Upstream(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUpstream, name)
+	}
+	hs, err := protocol.NewHandshake(addr)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConf *tls.Config
+	if u.TLS {
+		tlsConf = conf.App.TLSConf
+	}
+	conn, err := dialTCP(constant.IP{
+		Addr: u.Host,
+		Port: u.Port,
+	}, tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := handshake(conn, hs, u.Method, u.Token)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return N.NewSecureTCPConn(conn, codec), nil
+}
+
+// dialRaw 建立到服务端的TCP或TLS连接
+func dialRaw() (net.Conn, error) {
+	var tlsConf *tls.Config
+	if conf.App.TLS.Enable {
+		tlsConf = conf.App.TLSConf
+	}
+	return dialTCP(constant.IP{
+		Addr: conf.App.Server.Host,
+		Port: conf.App.Server.Port,
+	}, tlsConf)
+}
+
+func dialTCP(target constant.IP, tlsConf *tls.Config) (net.Conn, error) {
+	ip, err := resolver.ResolveIP(target.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return dialIP(ip, target.Port, tlsConf)
+}
+
+func dialIP(ip net.IP, port int64, tlsConf *tls.Config) (net.Conn, error) {
+	dial := net.Dialer{Timeout: conf.App.Timeout}
+	destAddr := net.JoinHostPort(ip.String(), strconv.FormatInt(port, 10))
+	if tlsConf != nil {
+		return tls.DialWithDialer(&dial, "tcp", destAddr, tlsConf)
+	}
+	return dial.Dial("tcp", destAddr)
+}
+
+// handshake 以服务端的加密方式及token发送随机盐并派生本连接的会话密钥, 发送握手帧后等待服务端应答协商结果
+func handshake(conn net.Conn, hs *protocol.Handshake, method, token string) (*protocol.Codec, error) {
+	salt, err := cipher.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	c, err := cipher.Derive(method, []byte(token), salt)
+	if err != nil {
+		return nil, err
+	}
+	codec := protocol.NewCodec(c)
+	frame, err := codec.Encode(hs.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	// 随机盐与握手帧一起发送
+	_, err = conn.Write(append(salt, frame...))
+	if err != nil {
+		return nil, err
+	}
+	packet, err := codec.ReadFull(conn)
+	if err != nil {
+		return nil, err
+	}
+	ack, err := protocol.ParseHandshakeAck(packet.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if hs.Features.Has(protocol.FeatureMux) && !ack.Features.Has(protocol.FeatureMux) {
+		return nil, ErrMuxUnsupported
+	}
+	if hs.Features.Has(protocol.FeatureBind) && !ack.Features.Has(protocol.FeatureBind) {
+		return nil, ErrBindUnsupported
+	}
+	if hs.Features.Has(protocol.FeatureUDP) && !ack.Features.Has(protocol.FeatureUDP) {
+		return nil, ErrUDPUnsupported
+	}
+	if hs.Features.Has(protocol.FeatureReverse) && !ack.Features.Has(protocol.FeatureReverse) {
+		return nil, ErrReverseUnsupported
+	}
+	opts, _ := conf.App.CodecOptions()
+	codec.Negotiate(ack.Features, opts)
+	return codec, nil
+}
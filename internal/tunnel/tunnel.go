@@ -1,17 +1,28 @@
 package tunnel
 
 import (
-	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/smallnest/chanx"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/compress"
 	"github.com/xmapst/lightsocks/internal/conf"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
 	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/protocol"
 	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/rule"
 	"github.com/xmapst/lightsocks/internal/statistic"
 	"net"
 	"runtime"
-	"strconv"
+)
+
+// 被拒绝的连接向入站返回 protocol.StatusNotAllowed
+var (
+	ErrRejected = fmt.Errorf("%w: rejected by rule", acl.ErrDenied)
+	ErrNoServer = errors.New("no server configured")
 )
 
 var (
@@ -19,109 +30,177 @@ var (
 	workers = 4
 )
 
-func Start(token string) {
-	go process(token)
+func Start() {
+	if conf.App.Mode == conf.ClientMode {
+		startPool()
+	}
+	go process()
 }
 
 // processTCP starts a loop to handle tcp packet
-func processTCP(token string) {
+func processTCP() {
 	for conn := range TCPIn.Out {
-		go handleTCPConn(conn, token)
+		go handleTCPConn(conn)
 	}
 }
 
-func process(token string) {
+func process() {
 	if num := runtime.GOMAXPROCS(0); num > workers {
 		workers = num
 	}
 	workers *= workers
 	for i := 0; i < workers; i++ {
-		go processTCP(token)
+		go processTCP()
 	}
 }
 
-func handleTCPConn(ctx *constant.TCPContext, token string) {
-	dial := net.Dialer{Timeout: conf.App.Timeout}
+func handleTCPConn(ctx *constant.TCPContext) {
 	defer func(conn net.Conn) {
 		_ = conn.Close()
 	}(ctx.Conn)
-
-	// connect to the target
-	target := ctx.Metadata.Dest
-	if conf.App.Mode == conf.ClientMode {
-		target = constant.IP{
-			Addr: conf.App.Server.Host,
-			Port: conf.App.Server.Port,
+	defer func() {
+		if ctx.PostFn != nil {
+			ctx.PostFn()
 		}
+	}()
+
+	// 客户端按路由规则确定连接的去向
+	var chain string
+	if ctx.DialFn == nil && conf.App.Mode != conf.ServerMode {
+		chain = route(ctx.Metadata)
 	}
-	ip, err := resolver.ResolveIP(target.Addr)
-	if err != nil {
-		logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, err)
-		return
-	}
-	destAddr := net.JoinHostPort(ip.String(), strconv.FormatInt(target.Port, 10))
+	proxied := chain != "" && chain != rule.Direct
+
+	// connect to the target
 	var destConn net.Conn
-	if conf.App.TLS.Enable && conf.App.Mode == conf.ClientMode {
-		destConn, err = tls.DialWithDialer(&dial, "tcp", destAddr, conf.App.TLSConf)
-	} else {
-		destConn, err = dial.Dial("tcp", destAddr)
+	var err error
+	switch {
+	case ctx.DialFn != nil:
+		destConn, err = ctx.DialFn()
+	case chain == rule.Reject:
+		err = ErrRejected
+	case chain == rule.Proxy && conf.App.Mode != conf.ClientMode:
+		err = ErrNoServer
+	case ctx.Bind:
+		destConn, err = bindTarget(ctx, chain)
+	case chain == rule.Proxy:
+		// 发送被代理的信息
+		destConn, err = dialTunnel(ctx.Metadata.Dest.String())
+	case proxied:
+		destConn, err = dialUpstream(chain, ctx.Metadata.Dest.String())
+	default:
+		destConn, err = dialTarget(ctx.Metadata)
 	}
 	if err != nil {
-		logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, err)
+		if errors.Is(err, acl.ErrDenied) {
+			logrus.Warningln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, "user", ctx.Metadata.User, err)
+		} else {
+			logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, err)
+		}
+		if ctx.ErrFn != nil {
+			ctx.ErrFn(err)
+		}
 		return
 	}
 	defer func(destConn net.Conn) {
 		_ = destConn.Close()
 	}(destConn)
 
-	// 发送被代理的信息
-	if conf.App.Mode == conf.ClientMode {
-		destSecConn := &N.SecureTCPConn{ReadWriteCloser: destConn}
-		_, err = destSecConn.EncodeWrite([]byte(token), []byte(ctx.Metadata.Dest.String()))
+	// 等待服务端连接目标的结果
+	if !ctx.Bind && proxied && features(destConn).Has(protocol.FeatureStatus) {
+		err = protocol.ReadStatus(destConn)
 		if err != nil {
 			logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, err)
-			return
-		}
-		// redirect http proxy
-		if ctx.Line != "" {
-			_, err = destSecConn.EncodeWrite([]byte(token), []byte(ctx.Line))
-			if err != nil {
-				logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, err)
-				return
+			if ctx.ErrFn != nil {
+				ctx.ErrFn(err)
 			}
+			return
 		}
 	}
 
 	if ctx.PreFn != nil {
-		ctx.PreFn()
-	}
-	defer func() {
-		if ctx.PostFn != nil {
-			ctx.PostFn()
-		}
-	}()
-	// direct http proxy
-	var src, dest, _type = ctx.Conn, destConn, constant.Direct
-	if conf.App.Mode == conf.DirectMode {
-		if ctx.Line != "" {
-			_, err = destConn.Write([]byte(ctx.Line))
-			if err != nil {
-				logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Src, "-->", ctx.Metadata.Dest, err)
-				return
-			}
-		}
-	} else {
-		_type = constant.Proxy
-		if conf.App.Mode == conf.ClientMode {
-			src, dest = destConn, ctx.Conn
+		var bind net.Addr
+		switch {
+		case ctx.Bind:
+			bind = tcpAddr(ctx.Metadata.Dest.String())
+		case chain == rule.Direct:
+			bind = destConn.LocalAddr()
 		}
+		ctx.PreFn(bind)
 	}
-	dest = statistic.NewTCPTracker(dest, ctx.Metadata)
+	var src, dest = ctx.Conn, destConn
+	if proxied {
+		src, dest = destConn, ctx.Conn
+	}
+	dest = statistic.NewTCPTracker(dest, ctx.Metadata, compressStats(src))
 	relay := &N.Relay{
 		Src:      src,
 		Dest:     dest,
 		Metadata: ctx.Metadata,
-		Token:    []byte(token),
 	}
-	relay.Start(_type)
+	relay.Start()
+}
+
+// route 返回第一条匹配的路由规则的动作并记录在metadata中,
+// 没有匹配时客户端模式经服务端转发, 直连模式直接连接
+func route(metadata *constant.Metadata) string {
+	chain := rule.Direct
+	if conf.App.Mode == conf.ClientMode {
+		chain = rule.Proxy
+	}
+	if r := conf.App.Router.Match(metadata); r != nil {
+		metadata.Rule = r.String()
+		chain = r.Target
+	}
+	metadata.Chain = chain
+	logrus.Debugln(metadata.ID, metadata.Src, "-->", metadata.Dest, "rule", metadata.Rule, "chain", chain)
+	return chain
+}
+
+// dialTarget 连接目标地址, 服务端在解析前后分别检查出口策略, 并直接连接检查过的ip
+func dialTarget(metadata *constant.Metadata) (net.Conn, error) {
+	policy := conf.App.ACL
+	if conf.App.Mode != conf.ServerMode {
+		policy = nil
+	}
+	err := policy.CheckHost(metadata.Dest.Addr, metadata.Dest.Port)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := resolver.ResolveIP(metadata.Dest.Addr)
+	if err != nil {
+		return nil, err
+	}
+	err = policy.CheckIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	return dialIP(ip, metadata.Dest.Port, nil)
+}
+
+// features 隧道连接握手协商的能力
+func features(conn net.Conn) protocol.Feature {
+	if codec := tunnelCodec(conn); codec != nil {
+		return codec.Features
+	}
+	return 0
+}
+
+// compressStats 隧道连接的压缩统计, 多路复用的流为所在会话的统计
+func compressStats(conn net.Conn) *compress.Stats {
+	if codec := tunnelCodec(conn); codec != nil {
+		return codec.Stats
+	}
+	return nil
+}
+
+// tunnelCodec 隧道连接或多路复用的流所在隧道连接的编解码, 其他连接返回nil
+func tunnelCodec(conn net.Conn) *protocol.Codec {
+	if stream, ok := conn.(*mux.Stream); ok {
+		conn = stream.Conn()
+	}
+	if secConn, ok := conn.(*N.SecureTCPConn); ok {
+		return secConn.Codec()
+	}
+	return nil
 }
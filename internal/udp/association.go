@@ -0,0 +1,133 @@
+package udp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Association 一个SOCKS5 UDP ASSOCIATE请求, 只转发来自登记地址的数据报
+// 控制连接关闭后调用 Close 删除登记并关闭相关的NAT映射
+type Association struct {
+	user string
+	ip   string
+	port int // 0为接受该ip任意端口的数据报
+	l    *Listener
+
+	mu      sync.Mutex
+	entries map[*natEntry]struct{}
+	closed  bool
+}
+
+// associations 已登记的UDP ASSOCIATE请求, 可并发使用
+type associations struct {
+	mu    sync.Mutex
+	exact map[string]*Association   // ip:port
+	any   map[string][]*Association // ip
+}
+
+// Associate 登记UDP ASSOCIATE请求, control为控制连接的客户端地址, announced为请求中声明的发送地址
+// 声明的ip与控制连接一致时只接受声明的端口, 否则客户端可能经过NAT, 接受控制连接ip的任意端口
+func (u *Listener) Associate(user string, control net.Addr, announced *net.UDPAddr) *Association {
+	a := &Association{
+		user:    user,
+		l:       u,
+		entries: make(map[*natEntry]struct{}),
+	}
+	var controlIP net.IP
+	if addr, ok := control.(*net.TCPAddr); ok {
+		controlIP = addr.IP
+	} else if host, _, err := net.SplitHostPort(control.String()); err == nil {
+		controlIP = net.ParseIP(host)
+	}
+	a.ip = controlIP.String()
+	if announced != nil && announced.IP.Equal(controlIP) {
+		a.port = announced.Port
+	}
+	u.assocs.add(a)
+	return a
+}
+
+// Close 删除登记并关闭该请求的所有NAT映射
+func (a *Association) Close() {
+	a.l.assocs.remove(a)
+	a.mu.Lock()
+	a.closed = true
+	entries := a.entries
+	a.entries = nil
+	a.mu.Unlock()
+	for e := range entries {
+		_ = e.tracker.Close()
+	}
+}
+
+// add 记录请求的NAT映射, 请求已关闭时返回false
+func (a *Association) add(e *natEntry) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.entries[e] = struct{}{}
+	return true
+}
+
+func (a *Association) delete(e *natEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.entries, e)
+}
+
+func (as *associations) add(a *Association) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if a.port != 0 {
+		if as.exact == nil {
+			as.exact = make(map[string]*Association)
+		}
+		as.exact[net.JoinHostPort(a.ip, strconv.Itoa(a.port))] = a
+		return
+	}
+	if as.any == nil {
+		as.any = make(map[string][]*Association)
+	}
+	as.any[a.ip] = append(as.any[a.ip], a)
+}
+
+func (as *associations) remove(a *Association) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if a.port != 0 {
+		key := net.JoinHostPort(a.ip, strconv.Itoa(a.port))
+		if as.exact[key] == a {
+			delete(as.exact, key)
+		}
+		return
+	}
+	list := as.any[a.ip]
+	for i, v := range list {
+		if v == a {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(as.any, a.ip)
+	} else {
+		as.any[a.ip] = list
+	}
+}
+
+// lookup 查找来源地址登记的请求, 优先匹配端口, 未登记时返回nil
+func (as *associations) lookup(src *net.UDPAddr) *Association {
+	ip := src.IP.String()
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if a, ok := as.exact[net.JoinHostPort(ip, strconv.Itoa(src.Port))]; ok {
+		return a
+	}
+	if list := as.any[ip]; len(list) > 0 {
+		return list[len(list)-1]
+	}
+	return nil
+}
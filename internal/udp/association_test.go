@@ -0,0 +1,224 @@
+package udp
+
+import (
+	"bytes"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testTimeout NAT映射的空闲超时
+const testTimeout = 300 * time.Millisecond
+
+// TestMain 配置在所有测试中共用, 已关闭映射的空闲计时器仍会读取
+func TestMain(m *testing.M) {
+	conf.App = &conf.Config{
+		CIDR: []string{"127.0.0.1"},
+		UDP:  conf.UDP{Timeout: testTimeout},
+	}
+	os.Exit(m.Run())
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// newTestListener 直接转发的UDP转发端口及一个回显服务
+func newTestListener(t *testing.T) (*Listener, *net.UDPAddr) {
+	l := NewListener(listenUDP(t))
+	go l.Serve()
+	return l, newEcho(t)
+}
+
+// newEcho 回显收到的数据报
+func newEcho(t *testing.T) *net.UDPAddr {
+	echo := listenUDP(t)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return echo.LocalAddr().(*net.UDPAddr)
+}
+
+// request 发往target的SOCKS5 UDP数据报
+func request(target *net.UDPAddr, data string) []byte {
+	return append(header(target.String()), data...)
+}
+
+// exchange 经转发端口发送数据报并等待回显
+func exchange(t *testing.T, client *net.UDPConn, l *Listener, target *net.UDPAddr, data string) {
+	t.Helper()
+	_, err := client.WriteToUDP(request(target, data), l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := request(target, data); !bytes.Equal(buf[:n], want) {
+		t.Fatalf("got %q, want %q", buf[:n], want)
+	}
+}
+
+// waitFor 等待cond成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func natSize(l *Listener) int {
+	l.nat.mu.Lock()
+	defer l.nat.mu.Unlock()
+	return len(l.nat.entries)
+}
+
+func assocSize(a *Association) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.entries)
+}
+
+func TestAssociate(t *testing.T) {
+	l, _ := newTestListener(t)
+	control := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	tests := []struct {
+		name      string
+		announced *net.UDPAddr
+		port      int
+	}{
+		{"exact", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}, 5000},
+		{"zero", &net.UDPAddr{IP: net.IPv4zero}, 0},
+		{"other ip", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, 0},
+		{"none", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := l.Associate("user", control, tt.announced)
+			if a.ip != "127.0.0.1" || a.port != tt.port {
+				t.Fatalf("got %s:%d, want 127.0.0.1:%d", a.ip, a.port, tt.port)
+			}
+			src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+			if got := l.assocs.lookup(src); got != a {
+				t.Fatalf("lookup: got %p, want %p", got, a)
+			}
+			a.Close()
+			if got := l.assocs.lookup(src); got != nil {
+				t.Fatalf("lookup after close: got %p", got)
+			}
+		})
+	}
+}
+
+func TestAssociationRelay(t *testing.T) {
+	l, target := newTestListener(t)
+	client := listenUDP(t)
+	a := l.Associate("user", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, client.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+
+	exchange(t, client, l, target, "hello")
+	exchange(t, client, l, target, "again")
+	if n := natSize(l); n != 1 {
+		t.Fatalf("nat entries: got %d, want 1", n)
+	}
+	if n := assocSize(a); n != 1 {
+		t.Fatalf("association entries: got %d, want 1", n)
+	}
+	l.nat.mu.Lock()
+	for _, e := range l.nat.entries {
+		if e.tracker.Metadata.User != "user" || e.tracker.Metadata.Type != constant.SOCKS5 {
+			t.Fatalf("metadata: %+v", e.tracker.Metadata)
+		}
+	}
+	l.nat.mu.Unlock()
+
+	// 未登记的来源地址被丢弃
+	other := listenUDP(t)
+	_, err := other.WriteToUDP(request(target, "dropped"), l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := other.Read(make([]byte, 2048)); err == nil {
+		t.Fatalf("unregistered source relayed %d bytes", n)
+	}
+	if n := natSize(l); n != 1 {
+		t.Fatalf("nat entries after unregistered source: got %d, want 1", n)
+	}
+}
+
+func TestAssociationClose(t *testing.T) {
+	l, target := newTestListener(t)
+	client := listenUDP(t)
+	a := l.Associate("user", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, client.LocalAddr().(*net.UDPAddr))
+	exchange(t, client, l, target, "hello")
+
+	// 控制连接关闭后删除登记及NAT映射
+	a.Close()
+	waitFor(t, "nat entries removed", func() bool {
+		return natSize(l) == 0
+	})
+	if got := l.assocs.lookup(client.LocalAddr().(*net.UDPAddr)); got != nil {
+		t.Fatal("association still registered")
+	}
+	_, err := client.WriteToUDP(request(target, "closed"), l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 2048)); err == nil {
+		t.Fatalf("closed association relayed %d bytes", n)
+	}
+	if n := natSize(l); n != 0 {
+		t.Fatalf("nat entries after close: got %d, want 0", n)
+	}
+	// 关闭后建立的映射立即关闭
+	if a.add(&natEntry{}) {
+		t.Fatal("closed association accepted a nat entry")
+	}
+}
+
+func TestAssociationIdle(t *testing.T) {
+	l, target := newTestListener(t)
+	client := listenUDP(t)
+	a := l.Associate("user", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, client.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+	exchange(t, client, l, target, "hello")
+
+	// 空闲超时后关闭NAT映射, 登记保留
+	waitFor(t, "idle nat entry removed", func() bool {
+		return natSize(l) == 0 && assocSize(a) == 0
+	})
+	if got := l.assocs.lookup(client.LocalAddr().(*net.UDPAddr)); got != a {
+		t.Fatal("association removed by idle timeout")
+	}
+	// 之后的数据报建立新的映射
+	exchange(t, client, l, target, "again")
+	if n := natSize(l); n != 1 {
+		t.Fatalf("nat entries: got %d, want 1", n)
+	}
+}
@@ -0,0 +1,85 @@
+package udp
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"net"
+	"strings"
+)
+
+// Forwarder 静态UDP端口转发, 来源地址在允许的地址组内时将数据报原样转发到固定的目标
+type Forwarder struct {
+	conn   *net.UDPConn
+	target string
+	nat    natTable
+}
+
+func NewForwarder(conn *net.UDPConn, target string) *Forwarder {
+	return &Forwarder{
+		conn:   conn,
+		target: target,
+	}
+}
+
+// Serve 转发数据报直到监听关闭, 之后关闭所有映射
+func (f *Forwarder) Serve() {
+	defer f.nat.close()
+	var data = make([]byte, protocol.MaxDatagram)
+	for {
+		n, srcAddr, err := f.conn.ReadFromUDP(data)
+		if err != nil {
+			if strings.Contains(err.Error(), net.ErrClosed.Error()) {
+				break
+			}
+			logrus.Errorln("READ error", err)
+			continue
+		}
+		if n <= 0 {
+			continue
+		}
+		if !auth.VerifyIP(srcAddr.String()) {
+			logrus.Debugln(srcAddr, "access denied, not in allowed address group")
+			continue
+		}
+		go f.handlePacket(srcAddr, append([]byte(nil), data[:n]...))
+	}
+}
+
+func (f *Forwarder) handlePacket(srcAddr *net.UDPAddr, message []byte) {
+	e, err := f.nat.get(nil, srcAddr, f.target, constant.FORWARD, f.handleRemoteRead)
+	if err != nil {
+		logrus.Warningln(srcAddr, "-->", f.target, err)
+		return
+	}
+	err = e.remote.WriteTo(message, f.target)
+	if err != nil {
+		logrus.Warningln(e.tracker.ID(), srcAddr, "-->", f.target, err)
+		return
+	}
+	e.idle.active()
+	e.tracker.PushUploaded(len(message))
+}
+
+// handleRemoteRead 将目标返回的数据报原样发送给客户端, 出口关闭后删除映射
+func (f *Forwarder) handleRemoteRead(e *natEntry) {
+	defer func() {
+		f.nat.remove(e)
+		_ = e.tracker.Close()
+		logrus.Infoln(e.tracker.ID(), e.key, "udp session closed")
+	}()
+	buf := make([]byte, protocol.MaxDatagram)
+	for {
+		data, _, err := e.remote.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		e.idle.active()
+		e.tracker.PushDownloaded(len(data))
+		_, err = f.conn.WriteToUDP(data, e.src)
+		if err != nil {
+			logrus.Warningln(err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestForwarder 转发到回显服务, 只允许127.0.0.1
+func newTestForwarder(t *testing.T) (*Forwarder, <-chan struct{}) {
+	_, target := newTestListener(t)
+	f := NewForwarder(listenUDP(t), target.String())
+	done := make(chan struct{})
+	go func() {
+		f.Serve()
+		close(done)
+	}()
+	return f, done
+}
+
+func TestForwarderAllowed(t *testing.T) {
+	f, _ := newTestForwarder(t)
+	client := listenUDP(t)
+	addr := f.conn.LocalAddr().(*net.UDPAddr)
+	_, err := client.WriteToUDP([]byte("hello"), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("got %q", buf[:n])
+	}
+}
+
+func TestForwarderDenied(t *testing.T) {
+	f, _ := newTestForwarder(t)
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip("127.0.0.2 not available:", err)
+	}
+	defer client.Close()
+	// 来源地址不在允许的地址组内时丢弃, 不建立映射
+	_, err = client.WriteToUDP([]byte("hello"), f.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 2048)); err == nil {
+		t.Fatalf("denied source forwarded %d bytes", n)
+	}
+	f.nat.mu.Lock()
+	n := len(f.nat.entries)
+	f.nat.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("nat entries: got %d, want 0", n)
+	}
+}
+
+func TestForwarderClose(t *testing.T) {
+	f, done := newTestForwarder(t)
+	client := listenUDP(t)
+	_, err := client.WriteToUDP([]byte("hello"), f.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = client.Read(make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	f.nat.mu.Lock()
+	var e *natEntry
+	for _, v := range f.nat.entries {
+		e = v
+	}
+	f.nat.mu.Unlock()
+	if e == nil {
+		t.Fatal("nat entry not established")
+	}
+
+	// 监听关闭后关闭所有映射
+	_ = f.conn.Close()
+	<-done
+	waitFor(t, "nat entries removed", func() bool {
+		f.nat.mu.Lock()
+		defer f.nat.mu.Unlock()
+		return len(f.nat.entries) == 0
+	})
+	if _, _, err = e.remote.ReadFrom(make([]byte, 16)); err == nil {
+		t.Fatal("remote still open")
+	}
+	if _, err = f.nat.get(nil, client.LocalAddr().(*net.UDPAddr), f.target, 0, f.handleRemoteRead); err == nil {
+		t.Fatal("closed forwarder established a nat entry")
+	}
+}
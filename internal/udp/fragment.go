@@ -0,0 +1,139 @@
+package udp
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	// fragEnd FRAG的最高位, 标识最后一个分片
+	fragEnd = 0x80
+	// reassemblyTimeout 重组超时, RFC 1928 要求不小于5秒
+	reassemblyTimeout = 5 * time.Second
+	// maxReassembly 单个来源地址重组队列的数据上限
+	maxReassembly = protocol.MaxDatagram
+)
+
+// reassembly 一个来源地址正在重组的数据报
+type reassembly struct {
+	header []byte // 第一个分片的头部
+	pos    byte   // 已收到的最后一个分片序号
+	data   []byte
+	timer  *time.Timer
+}
+
+// reassembler 按 RFC 1928 第7节重组分片的数据报, 每个来源地址一个重组队列
+type reassembler struct {
+	mu      sync.Mutex
+	queues  map[string]*reassembly
+	timeout time.Duration // 为0时使用reassemblyTimeout
+}
+
+// push 处理收到的数据报, 未分片时直接返回, 分片时返回重组完成后FRAG为0的数据报, 未完成时返回nil
+// 同一来源的分片需按顺序处理
+func (r *reassembler) push(src string, message []byte) []byte {
+	if len(message) < 4 {
+		return message
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	frag := message[2]
+	if frag == 0 {
+		// 收到未分片的数据报时放弃正在重组的队列
+		r.drop(src)
+		return message
+	}
+	n := headerLen(message)
+	if n < 0 {
+		logrus.Warningln(src, "invalid udp fragment")
+		r.drop(src)
+		return nil
+	}
+	pos := frag &^ fragEnd
+	q := r.queues[src]
+	// 序号小于等于已收到的分片或目标地址不同时开始新的队列
+	if q != nil && (pos <= q.pos || !bytes.Equal(q.header[3:], message[3:n])) {
+		r.drop(src)
+		q = nil
+	}
+	if q == nil {
+		if pos != 1 {
+			return nil
+		}
+		if r.queues == nil {
+			r.queues = make(map[string]*reassembly)
+		}
+		q = &reassembly{header: append([]byte(nil), message[:n]...)}
+		timeout := r.timeout
+		if timeout <= 0 {
+			timeout = reassemblyTimeout
+		}
+		q.timer = time.AfterFunc(timeout, func() {
+			r.expire(src, q)
+		})
+		r.queues[src] = q
+	} else if pos != q.pos+1 {
+		// 中间的分片丢失
+		r.drop(src)
+		return nil
+	}
+	if len(q.data)+len(message)-n > maxReassembly {
+		logrus.Warningln(src, "udp reassembly exceeds", maxReassembly, "bytes")
+		r.drop(src)
+		return nil
+	}
+	q.pos = pos
+	q.data = append(q.data, message[n:]...)
+	if frag&fragEnd == 0 {
+		return nil
+	}
+	r.drop(src)
+	q.header[2] = 0
+	return append(q.header, q.data...)
+}
+
+// drop 放弃来源地址的重组队列, 调用方需持有mu
+func (r *reassembler) drop(src string) {
+	if q, ok := r.queues[src]; ok {
+		q.timer.Stop()
+		delete(r.queues, src)
+	}
+}
+
+func (r *reassembler) expire(src string, q *reassembly) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queues[src] == q {
+		logrus.Warningln(src, "udp reassembly timeout, fragment", q.pos)
+		delete(r.queues, src)
+	}
+}
+
+// headerLen SOCKS5 UDP头部的长度, 格式错误时返回-1
+func headerLen(message []byte) int {
+	if len(message) < 4 {
+		return -1
+	}
+	var n int
+	switch message[3] {
+	case constant.ATypeIPv4:
+		n = 4 + 4 + 2
+	case constant.ATypeIPv6:
+		n = 4 + 16 + 2
+	case constant.ATypeDomainName:
+		if len(message) < 5 {
+			return -1
+		}
+		n = 4 + 1 + int(message[4]) + 2
+	default:
+		return -1
+	}
+	if len(message) < n {
+		return -1
+	}
+	return n
+}
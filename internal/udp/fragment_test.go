@@ -0,0 +1,172 @@
+package udp
+
+import (
+	"bytes"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"testing"
+	"time"
+)
+
+// fragment 目标为1.2.3.4:53的SOCKS5 UDP数据报
+func fragment(frag byte, data string) []byte {
+	return append([]byte{0, 0, frag, constant.ATypeIPv4, 1, 2, 3, 4, 0, 53}, data...)
+}
+
+func datagram(data string) []byte {
+	return fragment(0, data)
+}
+
+const testSrc = "10.0.0.1:5353"
+
+// pushAll 依次处理分片, 返回最后一个分片的结果, 中间的分片不应得到结果
+func pushAll(t *testing.T, r *reassembler, messages ...[]byte) []byte {
+	t.Helper()
+	for i, m := range messages[:len(messages)-1] {
+		if got := r.push(testSrc, m); got != nil {
+			t.Fatalf("fragment %d: unexpected datagram %q", i, got)
+		}
+	}
+	return r.push(testSrc, messages[len(messages)-1])
+}
+
+func TestReassembleInOrder(t *testing.T) {
+	var r reassembler
+	got := pushAll(t, &r,
+		fragment(1, "hello "),
+		fragment(2, "fragmented "),
+		fragment(3|fragEnd, "world"),
+	)
+	if want := datagram("hello fragmented world"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if len(r.queues) != 0 {
+		t.Fatalf("queue not released: %d", len(r.queues))
+	}
+}
+
+func TestReassembleUnfragmented(t *testing.T) {
+	var r reassembler
+	if got := r.push(testSrc, datagram("plain")); !bytes.Equal(got, datagram("plain")) {
+		t.Fatalf("got %q", got)
+	}
+	// 只有一个分片且带结束标记
+	if got := r.push(testSrc, fragment(1|fragEnd, "single")); !bytes.Equal(got, datagram("single")) {
+		t.Fatalf("got %q", got)
+	}
+	// 未分片的数据报放弃正在重组的队列
+	r.push(testSrc, fragment(1, "a"))
+	if got := r.push(testSrc, datagram("plain")); !bytes.Equal(got, datagram("plain")) {
+		t.Fatalf("got %q", got)
+	}
+	if got := r.push(testSrc, fragment(2|fragEnd, "b")); got != nil {
+		t.Fatalf("fragment of dropped queue reassembled: %q", got)
+	}
+}
+
+func TestReassembleOutOfOrder(t *testing.T) {
+	var r reassembler
+	// 中间的分片丢失或乱序时放弃整个数据报
+	if got := pushAll(t, &r, fragment(1, "a"), fragment(3, "c"), fragment(2, "b"), fragment(4|fragEnd, "d")); got != nil {
+		t.Fatalf("out of order reassembled: %q", got)
+	}
+	// 不从第一个分片开始
+	if got := pushAll(t, &r, fragment(2, "b"), fragment(3|fragEnd, "c")); got != nil {
+		t.Fatalf("missing first fragment reassembled: %q", got)
+	}
+	if len(r.queues) != 0 {
+		t.Fatalf("queue not released: %d", len(r.queues))
+	}
+}
+
+func TestReassembleDuplicate(t *testing.T) {
+	var r reassembler
+	// 重复的分片序号不大于已收到的序号, 重新开始队列
+	if got := pushAll(t, &r, fragment(1, "a"), fragment(2, "b"), fragment(2, "b"), fragment(3|fragEnd, "c")); got != nil {
+		t.Fatalf("duplicate reassembled: %q", got)
+	}
+	// 重复的第一个分片开始新的队列
+	got := pushAll(t, &r, fragment(1, "a"), fragment(1, "x"), fragment(2|fragEnd, "y"))
+	if want := datagram("xy"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReassembleRestart(t *testing.T) {
+	var r reassembler
+	// 新的数据报从序号1开始, 放弃未完成的数据报
+	got := pushAll(t, &r,
+		fragment(1, "old"),
+		fragment(2, "old"),
+		fragment(1, "new "),
+		fragment(2|fragEnd, "datagram"),
+	)
+	if want := datagram("new datagram"); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// 目标地址不同时重新开始
+	other := fragment(2|fragEnd, "b")
+	other[4] = 5
+	if got = pushAll(t, &r, fragment(1, "a"), other); got != nil {
+		t.Fatalf("fragments of different targets reassembled: %q", got)
+	}
+}
+
+func TestReassembleSources(t *testing.T) {
+	var r reassembler
+	// 不同来源地址的队列互不影响
+	r.push("10.0.0.1:1", fragment(1, "a"))
+	r.push("10.0.0.2:2", fragment(1, "x"))
+	if got := r.push("10.0.0.1:1", fragment(2|fragEnd, "b")); !bytes.Equal(got, datagram("ab")) {
+		t.Fatalf("got %q", got)
+	}
+	if got := r.push("10.0.0.2:2", fragment(2|fragEnd, "y")); !bytes.Equal(got, datagram("xy")) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	r := reassembler{timeout: 20 * time.Millisecond}
+	r.push(testSrc, fragment(1, "a"))
+	time.Sleep(100 * time.Millisecond)
+	r.mu.Lock()
+	n := len(r.queues)
+	r.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("queue not expired: %d", n)
+	}
+	if got := r.push(testSrc, fragment(2|fragEnd, "b")); got != nil {
+		t.Fatalf("expired queue reassembled: %q", got)
+	}
+}
+
+func TestReassembleSizeLimit(t *testing.T) {
+	var r reassembler
+	chunk := string(make([]byte, maxReassembly/2))
+	rest := string(make([]byte, maxReassembly-2*len(chunk)))
+	if got := pushAll(t, &r, fragment(1, chunk), fragment(2, chunk), fragment(3|fragEnd, rest+"x")); got != nil {
+		t.Fatalf("oversized datagram reassembled: %d bytes", len(got))
+	}
+	if len(r.queues) != 0 {
+		t.Fatalf("queue not released: %d", len(r.queues))
+	}
+	// 恰好达到上限
+	got := pushAll(t, &r, fragment(1, chunk), fragment(2, chunk), fragment(3|fragEnd, rest))
+	if len(got) != 10+maxReassembly {
+		t.Fatalf("datagram at limit: got %d bytes", len(got))
+	}
+}
+
+func TestReassembleInvalid(t *testing.T) {
+	var r reassembler
+	short := []byte{0, 0, 1}
+	if got := r.push(testSrc, short); !bytes.Equal(got, short) {
+		t.Fatalf("short message: got %v", got)
+	}
+	if got := r.push(testSrc, []byte{0, 0, 1, 0x09, 1, 2}); got != nil {
+		t.Fatalf("invalid address type: got %v", got)
+	}
+	truncated := fragment(1, "")[:8]
+	if got := r.push(testSrc, truncated); got != nil {
+		t.Fatalf("truncated header: got %v", got)
+	}
+}
@@ -0,0 +1,181 @@
+package udp
+
+import (
+	"errors"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"github.com/xmapst/lightsocks/internal/tunnel"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTooManySessions = errors.New("too many udp sessions")
+
+// natEntry 一个客户端来源地址的NAT映射, 所有目标共用一个出口
+type natEntry struct {
+	key     string
+	src     *net.UDPAddr
+	assoc   *Association
+	ready   chan struct{} // 出口建立完成后关闭
+	err     error
+	remote  remote
+	tracker *statistic.UdpTracker
+	idle    *idleTimer
+}
+
+// natTable 客户端来源地址到NAT映射, 可并发使用
+type natTable struct {
+	mu      sync.Mutex
+	entries map[string]*natEntry
+	clients map[string]int // 每个客户端ip的映射数
+	closed  bool
+}
+
+// get 取出来源地址的映射, 不存在时建立, 同一来源并发的数据报只建立一个映射
+// a为nil时映射不属于SOCKS5 UDP ASSOCIATE请求, read负责将目标返回的数据报发送给客户端
+func (t *natTable) get(a *Association, src *net.UDPAddr, target string, typ constant.Type, read func(e *natEntry)) (*natEntry, error) {
+	key := src.String()
+	ip := src.IP.String()
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if e, ok := t.entries[key]; ok {
+		t.mu.Unlock()
+		<-e.ready
+		return e, e.err
+	}
+	if max := conf.App.UDP.MaxSessions; max > 0 && t.clients[ip] >= max {
+		t.mu.Unlock()
+		return nil, ErrTooManySessions
+	}
+	if t.entries == nil {
+		t.entries = make(map[string]*natEntry)
+		t.clients = make(map[string]int)
+	}
+	e := &natEntry{
+		key:   key,
+		src:   src,
+		assoc: a,
+		ready: make(chan struct{}),
+	}
+	t.entries[key] = e
+	t.clients[ip]++
+	t.mu.Unlock()
+
+	defer close(e.ready)
+	e.remote, e.err = newRemote()
+	if e.err != nil {
+		t.remove(e)
+		return nil, e.err
+	}
+	var user string
+	if a != nil {
+		user = a.user
+	}
+	id, _ := uuid.NewV4()
+	e.tracker = statistic.NewUDPTracker(&constant.Metadata{
+		ID:      id,
+		User:    user,
+		NetWork: constant.UDP,
+		Type:    typ,
+		Src: constant.IP{
+			Addr: ip,
+			Port: int64(src.Port),
+		},
+		Dest: func() constant.IP {
+			host, port, _ := net.SplitHostPort(target)
+			_port, _ := strconv.ParseInt(port, 10, 64)
+			return constant.IP{
+				Addr: host,
+				Port: _port,
+			}
+		}(),
+	}, e.remote)
+	e.idle = newIdleTimer(func() {
+		_ = e.remote.Close()
+	})
+	if a != nil && !a.add(e) {
+		// 控制连接已关闭
+		_ = e.tracker.Close()
+	}
+	logrus.Infoln(id, key, "udp session established", "user", user)
+	go read(e)
+	return e, nil
+}
+
+func (t *natTable) remove(e *natEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries[e.key] != e {
+		return
+	}
+	delete(t.entries, e.key)
+	ip := e.src.IP.String()
+	if t.clients[ip]--; t.clients[ip] <= 0 {
+		delete(t.clients, ip)
+	}
+}
+
+// close 关闭所有映射, 之后不再建立新的映射
+func (t *natTable) close() {
+	t.mu.Lock()
+	t.closed = true
+	entries := make([]*natEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+	for _, e := range entries {
+		<-e.ready
+		if e.err == nil {
+			_ = e.tracker.Close()
+		}
+	}
+}
+
+// newRemote 客户端模式下经隧道转发, 否则直接发送
+func newRemote() (remote, error) {
+	if conf.App.Mode == conf.ClientMode {
+		conn, err := tunnel.DialUDP()
+		if err != nil {
+			return nil, err
+		}
+		return &tunnelRemote{conn: conn}, nil
+	}
+	return newSocketRemote(nil)
+}
+
+// idleTimer 空闲超过 UDP.Timeout 后调用close
+// 不使用读超时, 避免读取隧道中的数据报时中途超时导致数据流错位
+type idleTimer struct {
+	last  atomic.Int64
+	close func()
+}
+
+func newIdleTimer(close func()) *idleTimer {
+	t := &idleTimer{close: close}
+	t.active()
+	t.check()
+	return t
+}
+
+func (t *idleTimer) active() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *idleTimer) check() {
+	timeout := conf.App.UDP.Timeout
+	if idle := time.Since(time.Unix(0, t.last.Load())); idle < timeout {
+		time.AfterFunc(timeout-idle, t.check)
+		return
+	}
+	t.close()
+}
@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"errors"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"net"
+	"testing"
+	"time"
+)
+
+// withMaxSessions 限制每个客户端ip的映射数
+func withMaxSessions(t *testing.T, max int) {
+	old := conf.App.UDP.MaxSessions
+	conf.App.UDP.MaxSessions = max
+	t.Cleanup(func() {
+		conf.App.UDP.MaxSessions = old
+	})
+}
+
+// listed 映射是否出现在连接列表中
+func listed(e *natEntry) bool {
+	for _, c := range statistic.DefaultManager.Snapshot().Connections {
+		if c.ID() == e.tracker.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNATSessionLimit(t *testing.T) {
+	withMaxSessions(t, 2)
+	l, target := newTestListener(t)
+	a := l.Associate("user", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, nil)
+	defer a.Close()
+
+	first, second, third := listenUDP(t), listenUDP(t), listenUDP(t)
+	exchange(t, first, l, target, "first")
+	exchange(t, second, l, target, "second")
+
+	// 同一客户端ip超出限制的来源地址不建立映射
+	_, err := third.WriteToUDP(request(target, "third"), l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = third.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := third.Read(make([]byte, 2048)); err == nil {
+		t.Fatalf("source over the limit relayed %d bytes", n)
+	}
+	if n := natSize(l); n != 2 {
+		t.Fatalf("nat entries: got %d, want 2", n)
+	}
+	_, err = l.nat.get(a, third.LocalAddr().(*net.UDPAddr), target.String(), constant.SOCKS5, l.handleRemoteRead)
+	if !errors.Is(err, ErrTooManySessions) {
+		t.Fatalf("got %v, want %v", err, ErrTooManySessions)
+	}
+
+	// 空闲的映射被删除后释放名额
+	waitFor(t, "idle nat entries removed", func() bool {
+		return natSize(l) == 0
+	})
+	exchange(t, third, l, target, "third")
+	l.nat.mu.Lock()
+	n := l.nat.clients["127.0.0.1"]
+	l.nat.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("client sessions: got %d, want 1", n)
+	}
+}
+
+func TestNATTracker(t *testing.T) {
+	l, target := newTestListener(t)
+	client := listenUDP(t)
+	a := l.Associate("user", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, client.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+
+	before := statistic.DefaultManager.Snapshot().UDP
+	exchange(t, client, l, target, "hello")
+	var e *natEntry
+	l.nat.mu.Lock()
+	for _, v := range l.nat.entries {
+		e = v
+	}
+	l.nat.mu.Unlock()
+	if e == nil {
+		t.Fatal("no nat entry")
+	}
+	if !listed(e) {
+		t.Fatal("nat entry not listed")
+	}
+	if dest := e.tracker.Metadata.Dest; dest.Addr != target.IP.String() || dest.Port != int64(target.Port) {
+		t.Fatalf("dest: got %v, want %v", dest, target)
+	}
+	waitFor(t, "udp traffic counted", func() bool {
+		after := statistic.DefaultManager.Snapshot().UDP
+		return after.UploadTotal-before.UploadTotal >= 5 && after.DownloadTotal-before.DownloadTotal >= 5
+	})
+	if e.tracker.UploadTotal.Load() != 5 {
+		t.Fatalf("uploaded: got %d, want 5", e.tracker.UploadTotal.Load())
+	}
+
+	// 空闲超时后从连接列表中删除
+	waitFor(t, "idle nat entry unlisted", func() bool {
+		return !listed(e)
+	})
+}
+
+func TestNATClose(t *testing.T) {
+	l, target := newTestListener(t)
+	client := listenUDP(t)
+	a := l.Associate("user", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, client.LocalAddr().(*net.UDPAddr))
+	defer a.Close()
+	exchange(t, client, l, target, "hello")
+
+	// 关闭后删除所有映射, 不再建立新的映射
+	l.nat.close()
+	waitFor(t, "nat entries removed", func() bool {
+		return natSize(l) == 0
+	})
+	_, err := l.nat.get(a, client.LocalAddr().(*net.UDPAddr), target.String(), constant.SOCKS5, l.handleRemoteRead)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("got %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -0,0 +1,87 @@
+package udp
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/conf"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"io"
+	"net"
+)
+
+// ServeTunnel 服务端转发隧道连接中的UDP数据报, 返回的数据报携带来源地址
+// 每个隧道连接使用一个UDP socket, 双向空闲超过 UDP.Timeout 后关闭
+func ServeTunnel(conn net.Conn, metadata *constant.Metadata) {
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+	r, err := newSocketRemote(conf.App.ACL)
+	if err != nil {
+		logrus.Errorln(metadata.ID, metadata.Src, "udp listen", err)
+		return
+	}
+	// 通过API关闭时同时关闭隧道连接
+	tracker := statistic.NewUDPTracker(metadata, closers{r, conn})
+	defer func(tracker *statistic.UdpTracker) {
+		_ = tracker.Close()
+	}(tracker)
+	idle := newIdleTimer(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		defer func(conn net.Conn) {
+			_ = conn.Close()
+		}(conn)
+		buf := make([]byte, protocol.MaxDatagram)
+		for {
+			data, from, err := r.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			idle.active()
+			tracker.PushDownloaded(len(data))
+			err = protocol.WriteDatagram(conn, from, data)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, protocol.MaxDatagram)
+	for {
+		target, data, err := protocol.ReadDatagram(conn, buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && err != io.EOF {
+				logrus.Warningln(metadata.ID, metadata.Src, "udp tunnel read", err)
+			}
+			return
+		}
+		idle.active()
+		err = r.WriteTo(data, target)
+		if err != nil {
+			if errors.Is(err, acl.ErrDenied) {
+				logrus.Warningln(metadata.ID, metadata.Src, "-->", target, "user", metadata.User, err)
+			} else {
+				logrus.Errorln(metadata.ID, metadata.Src, "-->", target, err)
+			}
+			continue
+		}
+		tracker.PushUploaded(len(data))
+	}
+}
+
+// closers 依次关闭
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var err error
+	for _, v := range c {
+		if e := v.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
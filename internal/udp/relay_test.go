@@ -0,0 +1,97 @@
+package udp
+
+import (
+	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTunnel 在管道的服务端一侧转发数据报, 返回客户端一侧的连接
+func serveTunnel(t *testing.T) (net.Conn, <-chan struct{}) {
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	done := make(chan struct{})
+	go func() {
+		ServeTunnel(s, &constant.Metadata{
+			ID:      uuid.Must(uuid.NewV4()),
+			NetWork: constant.UDP,
+		})
+		close(done)
+	}()
+	return c, done
+}
+
+func TestServeTunnel(t *testing.T) {
+	conn, _ := serveTunnel(t)
+	echo := newEcho(t)
+	buf := make([]byte, protocol.MaxDatagram)
+	for _, data := range []string{"hello", "again"} {
+		err := protocol.WriteDatagram(conn, echo.String(), []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, got, err := protocol.ReadDatagram(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data || from != echo.String() {
+			t.Fatalf("got %q from %s, want %q from %s", got, from, data, echo)
+		}
+	}
+
+	// 返回的数据报携带各自的来源地址
+	other := newEcho(t)
+	err := protocol.WriteDatagram(conn, other.String(), []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, got, err := protocol.ReadDatagram(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "other" || from != other.String() {
+		t.Fatalf("got %q from %s, want %q from %s", got, from, "other", other)
+	}
+}
+
+func TestServeTunnelIdle(t *testing.T) {
+	conn, done := serveTunnel(t)
+	echo := newEcho(t)
+	err := protocol.WriteDatagram(conn, echo.String(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = protocol.ReadDatagram(conn, make([]byte, protocol.MaxDatagram))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 空闲超过 UDP.Timeout 后关闭隧道连接
+	select {
+	case <-done:
+	case <-time.After(testTimeout + 2*time.Second):
+		t.Fatal("idle tunnel not closed")
+	}
+	_, _, err = protocol.ReadDatagram(conn, make([]byte, protocol.MaxDatagram))
+	if err == nil {
+		t.Fatal("read from closed tunnel")
+	}
+}
+
+func TestServeTunnelInvalid(t *testing.T) {
+	conn, done := serveTunnel(t)
+	// 长度为0的数据报使数据流无法继续解析, 关闭隧道连接
+	_, err := conn.Write([]byte{0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("tunnel with invalid datagram not closed")
+	}
+}
@@ -0,0 +1,121 @@
+package udp
+
+import (
+	"github.com/xmapst/lightsocks/internal/acl"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// maxDests 单个出口缓存的已解析目标数, 超出后清空重新解析
+const maxDests = 1024
+
+// remote NAT映射的出口
+type remote interface {
+	// WriteTo 发送数据报到目标地址 host:port
+	WriteTo(data []byte, target string) error
+	// ReadFrom 读取目标返回的数据报及来源地址 ip:port, 返回的data引用buf
+	ReadFrom(buf []byte) (data []byte, from string, err error)
+	Close() error
+}
+
+// socketRemote 使用一个未连接的UDP socket直接收发, 任意目标返回的数据报都会转发
+type socketRemote struct {
+	pc     *net.UDPConn
+	policy *acl.Policy
+
+	mu    sync.Mutex
+	dests map[string]*net.UDPAddr
+}
+
+// newSocketRemote 创建直连出口, policy为nil时不检查出口策略
+func newSocketRemote(policy *acl.Policy) (*socketRemote, error) {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &socketRemote{
+		pc:     pc,
+		policy: policy,
+		dests:  make(map[string]*net.UDPAddr),
+	}, nil
+}
+
+func (r *socketRemote) WriteTo(data []byte, target string) error {
+	dest, err := r.resolve(target)
+	if err != nil {
+		return err
+	}
+	_, err = r.pc.WriteToUDP(data, dest)
+	return err
+}
+
+func (r *socketRemote) ReadFrom(buf []byte) ([]byte, string, error) {
+	n, from, err := r.pc.ReadFromUDP(buf)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf[:n], from.String(), nil
+}
+
+func (r *socketRemote) Close() error {
+	return r.pc.Close()
+}
+
+// resolve 解析目标地址, 在解析前后分别检查出口策略
+func (r *socketRemote) resolve(target string) (*net.UDPAddr, error) {
+	r.mu.Lock()
+	dest, ok := r.dests[target]
+	r.mu.Unlock()
+	if ok {
+		return dest, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	_port, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	err = r.policy.CheckHost(host, _port)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := resolver.ResolveIP(host)
+	if err != nil {
+		return nil, err
+	}
+	err = r.policy.CheckIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	dest = &net.UDPAddr{IP: ip, Port: int(_port)}
+	r.mu.Lock()
+	if len(r.dests) >= maxDests {
+		r.dests = make(map[string]*net.UDPAddr)
+	}
+	r.dests[target] = dest
+	r.mu.Unlock()
+	return dest, nil
+}
+
+// tunnelRemote 客户端模式下经隧道由服务端收发
+type tunnelRemote struct {
+	conn net.Conn
+}
+
+func (r *tunnelRemote) WriteTo(data []byte, target string) error {
+	return protocol.WriteDatagram(r.conn, target, data)
+}
+
+func (r *tunnelRemote) ReadFrom(buf []byte) ([]byte, string, error) {
+	from, data, err := protocol.ReadDatagram(r.conn, buf)
+	return data, from, err
+}
+
+func (r *tunnelRemote) Close() error {
+	return r.conn.Close()
+}
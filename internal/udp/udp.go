@@ -4,25 +4,37 @@ import (
 	"encoding/binary"
 	"github.com/sirupsen/logrus"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
 	"net"
 	"strconv"
 	"strings"
-	"time"
 )
 
-type udp struct {
+// Listener SOCKS5 UDP转发端口, 只转发已登记的 Association 的数据报
+type Listener struct {
 	conn      *net.UDPConn
-	srcUdpMap SrcUdpMap
+	nat       natTable
+	fragments reassembler
+	assocs    associations
 }
 
-func Listen(conn *net.UDPConn) {
-	u := &udp{
+func NewListener(conn *net.UDPConn) *Listener {
+	return &Listener{
 		conn: conn,
 	}
-	go u.timeout()
+}
+
+// Addr 转发端口的地址
+func (u *Listener) Addr() *net.UDPAddr {
+	return u.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Serve 转发数据报直到监听关闭, 之后关闭所有映射
+func (u *Listener) Serve() {
+	defer u.nat.close()
+	var data = make([]byte, protocol.MaxDatagram)
 	for {
-		var data = make([]byte, 8192)
-		n, srcAddr, err := conn.ReadFromUDP(data)
+		n, srcAddr, err := u.conn.ReadFromUDP(data)
 		if err != nil {
 			if strings.Contains(err.Error(), net.ErrClosed.Error()) {
 				break
@@ -33,20 +45,19 @@ func Listen(conn *net.UDPConn) {
 		if n <= 0 {
 			continue
 		}
-		logrus.Infof("[%v]:", srcAddr)
-		go u.handleUdpPacket(srcAddr, data[:n])
-	}
-}
-
-func (u *udp) timeout() {
-	tick := time.Tick(time.Second * 100)
-	for {
-		select {
-		case <-tick:
-			u.srcUdpMap.timeout()
+		logrus.Debugf("[%v]:", srcAddr)
+		a := u.assocs.lookup(srcAddr)
+		if a == nil {
+			logrus.Debugln(srcAddr, "udp datagram from unregistered source dropped")
+			continue
+		}
+		// 分片需按到达顺序重组, 在读取循环中处理
+		message := u.fragments.push(srcAddr.String(), append([]byte(nil), data[:n]...))
+		if message == nil {
+			continue
 		}
+		go u.handleUdpPacket(a, srcAddr, message)
 	}
-
 }
 
 /**
@@ -69,11 +80,9 @@ func (u *udp) timeout() {
        o  DATA     user data
 */
 
-func (u *udp) handleUdpPacket(srcAddr *net.UDPAddr, message []byte) {
-	logrus.Infoln(srcAddr.String() + " send udp package!")
-	length := len(message)
-	index := 3
-	if length < index {
+func (u *Listener) handleUdpPacket(a *Association, srcAddr *net.UDPAddr, message []byte) {
+	logrus.Debugln(srcAddr.String() + " send udp package!")
+	if headerLen(message) < 0 {
 		logrus.Errorln("error package")
 		return
 	}
@@ -81,12 +90,8 @@ func (u *udp) handleUdpPacket(srcAddr *net.UDPAddr, message []byte) {
 		logrus.Errorln("rev failed not 0x0000")
 		return
 	}
-	if message[2] != 0x00 {
-		logrus.Errorln("FRAG  not support")
-		return
-	}
 	atype := message[3]
-	index = 4
+	index := 4
 	var addr = ""
 	if atype == constant.ATypeIPv4 {
 		index += 4
@@ -103,139 +108,62 @@ func (u *udp) handleUdpPacket(srcAddr *net.UDPAddr, message []byte) {
 	port := binary.BigEndian.Uint16(message[index : index+2])
 	index += 2
 	data := message[index:]
-	originHeader := message[0:index]
-	u.handleUdpPacket2(srcAddr, addr, port, data, originHeader)
+	u.handleUdpPacket2(a, srcAddr, addr, port, data)
 
 }
 
-func (u *udp) handleUdpPacket2(srcAddr *net.UDPAddr, dstAddr string, port uint16, message []byte, originHeader []byte) {
-	srcUdpInfo := u.srcUdpMap.get(srcAddr)
-	laddr := srcUdpInfo.localAddr
-	var destAddr *net.UDPAddr
-	ua := dstAddr + ":" + strconv.Itoa(int(port))
-	remoteConn := srcUdpInfo.getRemoteConn(ua)
-	if remoteConn == nil {
-		destAddr, _ = net.ResolveUDPAddr("udp", ua)
-		udpCon, err := net.DialUDP("udp", laddr, destAddr)
-		if err != nil {
-			logrus.Warningln("error connect " + dstAddr)
-			return
-		}
-		remoteConn = udpCon
-		srcUdpInfo.addRemoteConn(ua, remoteConn)
-		if laddr == nil {
-			srcUdpInfo.setLocalAddr(udpCon.LocalAddr().(*net.UDPAddr))
-		}
-		go u.handleRemoteRead(srcAddr, udpCon, originHeader, ua, srcUdpInfo)
+func (u *Listener) handleUdpPacket2(a *Association, srcAddr *net.UDPAddr, dstAddr string, port uint16, message []byte) {
+	target := net.JoinHostPort(dstAddr, strconv.Itoa(int(port)))
+	e, err := u.nat.get(a, srcAddr, target, constant.SOCKS5, u.handleRemoteRead)
+	if err != nil {
+		logrus.Warningln(srcAddr, "-->", target, err)
+		return
 	}
-	_, err := remoteConn.Write(message)
+	err = e.remote.WriteTo(message, target)
 	if err != nil {
-		srcUdpInfo.deleteRemoteConn(ua)
+		logrus.Warningln(e.tracker.ID(), srcAddr, "-->", target, err)
 		return
 	}
-	srcUdpInfo.active()
+	e.idle.active()
+	e.tracker.PushUploaded(len(message))
 }
 
-func (u *udp) handleRemoteRead(srcAddr *net.UDPAddr, udpCon *net.UDPConn,
-	originHeader []byte, key string, info *SrcUdpInfo) {
-	var b [65507]byte
+// handleRemoteRead 将目标返回的数据报加上SOCKS5 UDP头发送给客户端, 出口关闭后删除映射
+func (u *Listener) handleRemoteRead(e *natEntry) {
+	defer func() {
+		u.nat.remove(e)
+		e.assoc.delete(e)
+		_ = e.tracker.Close()
+		logrus.Infoln(e.tracker.ID(), e.key, "udp session closed")
+	}()
+	buf := make([]byte, protocol.MaxDatagram)
 	for {
-		err := udpCon.SetReadDeadline(time.Now().Add(time.Second * 100))
-		if err != nil {
-			logrus.Warningln(err)
-		}
-		n, err := udpCon.Read(b[:])
+		data, from, err := e.remote.ReadFrom(buf)
 		if err != nil {
-			logrus.Warningln("udp read error==========", err)
-			break
-		}
-		info.active()
-		buf := append(originHeader, b[:n]...)
-		_, err = u.conn.WriteToUDP(buf, srcAddr)
-		if err != nil {
-			logrus.Warningln(err)
-		}
-	}
-
-	info.deleteRemoteConn(key)
-
-}
-
-type SrcUdpMap struct {
-	associated map[string]*SrcUdpInfo // src string->src addr
-}
-
-func (u *SrcUdpMap) get(srcAddr *net.UDPAddr) *SrcUdpInfo {
-	src := srcAddr.String()
-	if u.associated[src] != nil {
-		return u.associated[src]
-	}
-	r := &SrcUdpInfo{
-		srcAddr:        srcAddr,
-		lastActiveTime: time.Now(),
-		localDestCon:   make(map[string]*net.UDPConn),
-	}
-	return r
-}
-
-func (u *SrcUdpMap) delete(srcAddr *net.UDPAddr) {
-	src := srcAddr.String()
-	delete(u.associated, src)
-}
-
-func (u *SrcUdpMap) timeout() {
-	for k, v := range u.associated {
-		if v.lastActiveTime.Add(time.Second * 100).Before(time.Now()) {
-			delete(u.associated, k)
-			v.Destroy()
-			logrus.Warningln("delete" + k)
+			return
 		}
-	}
-}
-
-type SrcUdpInfo struct {
-	srcAddr        *net.UDPAddr
-	localAddr      *net.UDPAddr
-	lastActiveTime time.Time
-	localDestCon   map[string]*net.UDPConn //  dst -> conn
-}
-
-func (u *SrcUdpInfo) setLocalAddr(localAddr *net.UDPAddr) {
-	u.localAddr = localAddr
-	u.lastActiveTime = time.Now()
-
-}
-
-func (u *SrcUdpInfo) active() {
-	u.lastActiveTime = time.Now()
-}
-
-func (u *SrcUdpInfo) deleteRemoteConn(remoteAddr string) {
-	if c, ok := u.localDestCon[remoteAddr]; ok {
-		err := c.Close()
+		e.idle.active()
+		e.tracker.PushDownloaded(len(data))
+		_, err = u.conn.WriteToUDP(append(header(from), data...), e.src)
 		if err != nil {
 			logrus.Warningln(err)
 		}
-		delete(u.localDestCon, remoteAddr)
-	}
-}
-
-func (u *SrcUdpInfo) addRemoteConn(remoteAddr string, con *net.UDPConn) {
-	u.localDestCon[remoteAddr] = con
-}
-
-func (u *SrcUdpInfo) getRemoteConn(remoteAddr string) *net.UDPConn {
-	if c, ok := u.localDestCon[remoteAddr]; ok {
-		return c
 	}
-	return nil
 }
 
-func (u *SrcUdpInfo) Destroy() {
-	for _, v := range u.localDestCon {
-		err := v.Close()
-		if err != nil {
-			logrus.Warningln(err)
-		}
+// header 将 ip:port 编码为SOCKS5 UDP头
+func header(addr string) []byte {
+	buf := []byte{0x00, 0x00, 0x00}
+	host, port, _ := net.SplitHostPort(addr)
+	_port, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		buf = append(append(buf, constant.ATypeDomainName, byte(len(host))), host...)
+	case ip.To4() != nil:
+		buf = append(append(buf, constant.ATypeIPv4), ip.To4()...)
+	default:
+		buf = append(append(buf, constant.ATypeIPv6), ip.To16()...)
 	}
+	return binary.BigEndian.AppendUint16(buf, uint16(_port))
 }